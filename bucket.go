@@ -1,15 +1,58 @@
 package leakybucket
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"math/rand"
 	"time"
 )
 
 var (
 	// ErrorFull is returned when the amount requested to add exceeds the remaining space in the bucket.
+	// Backends return it as a *FullError carrying the bucket's state, so compare with errors.Is.
 	ErrorFull = errors.New("add exceeds free capacity")
+
+	// ErrorOverCapacity is returned when the amount requested to add exceeds the bucket's total
+	// capacity, so that no add of that amount can ever succeed.
+	ErrorOverCapacity = errors.New("add exceeds total capacity")
+
+	// ErrorInvalidParams is returned when creating a bucket with no capacity or a rate that
+	// isn't positive, which would make a bucket that is always full.
+	ErrorInvalidParams = errors.New("bucket capacity and rate must be positive")
 )
 
+// FullError is the error of an add that didn't fit, carrying the state of the bucket it was
+// refused against, so that code only handed the error, such as after it was wrapped, can still
+// recover when to retry with errors.As. errors.Is reports it as ErrorFull.
+type FullError struct {
+	BucketState
+}
+
+// NewFullError returns a *FullError for an add refused against state. It is meant to be used
+// by leakybucket implementers in place of ErrorFull.
+func NewFullError(state BucketState) error {
+	return &FullError{BucketState: state}
+}
+
+func (e *FullError) Error() string {
+	return ErrorFull.Error()
+}
+
+// Is reports whether target is ErrorFull.
+func (e *FullError) Is(target error) bool {
+	return target == ErrorFull
+}
+
+// ValidateParams returns ErrorInvalidParams if a bucket of capacity and rate would always be
+// full. It is meant to be used by leakybucket implementers when creating buckets.
+func ValidateParams(capacity uint, rate time.Duration) error {
+	if capacity == 0 || rate <= 0 {
+		return ErrorInvalidParams
+	}
+	return nil
+}
+
 // Bucket interface for interacting with leaky buckets: https://en.wikipedia.org/wiki/Leaky_bucket
 type Bucket interface {
 	// Capacity of the bucket.
@@ -21,10 +64,49 @@ type Bucket interface {
 	// Reset returns when the bucket will be drained.
 	Reset() time.Time
 
-	// Add to the bucket. Returns bucket state after adding.
+	// Rate returns how long it takes for the bucket's full capacity to drain.
+	Rate() time.Duration
+
+	// Add to the bucket. Returns bucket state after adding. Adding 0 is the canonical way to
+	// read and refresh the bucket's state, starting a new window if the last one is over,
+	// without consuming anything or writing to the backend, as Peek does.
 	Add(uint) (BucketState, error)
 
+	// TryAdd adds to the bucket like Add, but reports a full bucket as ok == false rather than
+	// ErrorFull, so that err is only set when the backend fails.
+	TryAdd(uint) (state BucketState, ok bool, err error)
+
+	// TakeUpTo adds as much of the amount to the bucket as fits, from none of it to all of it,
+	// returning how much it added. A full bucket is not an error.
+	TakeUpTo(uint) (granted uint, state BucketState, err error)
+
+	// AddWithTime adds to the bucket as if at the given time, which drives the reset window
+	// instead of the current time. Useful for replaying events.
 	AddWithTime(uint, time.Time) (BucketState, error)
+
+	// AddContext adds to the bucket like Add, giving up once ctx is done.
+	AddContext(context.Context, uint) (BucketState, error)
+
+	// Peek returns the bucket's current state, refreshed from the backing store, without
+	// adding to it.
+	Peek() (BucketState, error)
+
+	// WouldAccept reports whether adding the amount now would fit, refreshing the bucket's
+	// state but without adding to it.
+	WouldAccept(uint) (bool, error)
+
+	// SetRemaining sets the remaining space in the bucket, clamped to its capacity, without
+	// changing when it resets.
+	SetRemaining(uint) error
+
+	// Refund gives back an amount added to the bucket, such as when the operation it was added
+	// for failed, without changing when the bucket resets. The remaining space never exceeds the
+	// capacity.
+	Refund(uint) (BucketState, error)
+
+	// Drain empties the bucket, restoring its remaining space to full capacity and starting a
+	// new reset window. Implementations of the Bucket interface must provide it.
+	Drain() error
 }
 
 // BucketState is a snapshot of a bucket's properties.
@@ -34,9 +116,316 @@ type BucketState struct {
 	Reset     time.Time
 }
 
+// String formats the state for logs, such as
+// "capacity=100 remaining=42 reset=2024-01-02T03:04:05Z (in 37s)".
+func (s BucketState) String() string {
+	return s.string(time.Now())
+}
+
+func (s BucketState) string(now time.Time) string {
+	when := "in " + roughly(s.Reset.Sub(now)).String()
+	if !s.Reset.After(now) {
+		when = roughly(now.Sub(s.Reset)).String() + " ago"
+	}
+	return fmt.Sprintf("capacity=%d remaining=%d reset=%s (%s)", s.Capacity, s.Remaining,
+		s.Reset.UTC().Format(time.RFC3339), when)
+}
+
+// roughly rounds d to seconds, or to milliseconds if it is shorter than a second.
+func roughly(d time.Duration) time.Duration {
+	if d < time.Second {
+		return d.Round(time.Millisecond)
+	}
+	return d.Round(time.Second)
+}
+
+// RemainingAfter returns the space left in a bucket of capacity whose backend counts used in its
+// window. A count below zero, which racing refunds can leave behind, leaves all of it, and a
+// count over the capacity, such as after the capacity shrank, leaves none, rather than wrapping
+// around to a huge remaining that would lift the limit.
+func RemainingAfter(capacity uint, used int64) uint {
+	if used <= 0 {
+		return capacity
+	}
+	if uint64(used) >= uint64(capacity) {
+		return 0
+	}
+	return capacity - uint(used)
+}
+
+// Min returns the smaller of a and b, such as to clamp an amount to a bucket's capacity. It is
+// meant to be used by leakybucket implementers.
+func Min(a, b uint) uint {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+// Utilization returns the fraction of the bucket in state that is used, from 0 for an empty
+// bucket to 1 for a full one. A bucket with no capacity is reported as full.
+func Utilization(state BucketState) float64 {
+	if state.Capacity == 0 {
+		return 1
+	}
+	if state.Remaining >= state.Capacity {
+		return 0
+	}
+	return float64(state.Capacity-state.Remaining) / float64(state.Capacity)
+}
+
+// AddDetailed adds to b like Add, also returning the remaining space before the add, to tell
+// a request that barely fit from one with room to spare. An add fits whole or not at all, so
+// that is the space after it plus the amount, or if it failed, the space after it.
+func AddDetailed(b Bucket, amount uint) (uint, BucketState, error) {
+	state, err := b.Add(amount)
+	if err != nil {
+		return state.Remaining, state, err
+	}
+	before := state.Remaining + amount
+	if before > state.Capacity {
+		// The state may be a stale one, such as that of a redis bucket failing open.
+		before = state.Capacity
+	}
+	return before, state, nil
+}
+
+// RetryAfter returns how long to wait before the bucket in state resets, rounded up to whole
+// seconds as for an HTTP Retry-After header. It is zero if the reset time has passed.
+func RetryAfter(state BucketState) time.Duration {
+	return state.RetryAfter(time.Second)
+}
+
+// RetryAfter returns how long to wait before the bucket resets, rounded up to a multiple of
+// round, such as time.Second for an HTTP Retry-After header. A round that isn't positive
+// doesn't round. It is zero if the reset time has passed.
+func (s BucketState) RetryAfter(round time.Duration) time.Duration {
+	return s.retryAfter(time.Now(), round)
+}
+
+func (s BucketState) retryAfter(now time.Time, round time.Duration) time.Duration {
+	wait := s.Reset.Sub(now)
+	if wait <= 0 {
+		return 0
+	}
+	if round <= 0 {
+		return wait
+	}
+	return (wait + round - 1) / round * round
+}
+
+// TokenRate returns the rate at which a bucket of capacity burst drains when it refills at
+// tokensPerSecond, for limits such as 2.5 requests per second that aren't a whole number of
+// tokens per window. It is zero if tokensPerSecond isn't positive.
+func TokenRate(tokensPerSecond float64, burst uint) time.Duration {
+	if tokensPerSecond <= 0 {
+		return 0
+	}
+	return time.Duration(float64(burst) / tokensPerSecond * float64(time.Second))
+}
+
+// JitterRate returns rate shifted by a random amount within plus or minus jitter, so that
+// buckets created at the same time don't all reset at the same instant. The result is at least
+// a millisecond.
+func JitterRate(rate, jitter time.Duration) time.Duration {
+	if jitter <= 0 {
+		return rate
+	}
+	rate += time.Duration(rand.Int63n(int64(2*jitter)+1)) - jitter
+	if rate < time.Millisecond {
+		return time.Millisecond
+	}
+	return rate
+}
+
 // Storage interface for generating buckets keyed by a string.
 type Storage interface {
 	// Create a bucket with a name, capacity, and rate.
 	// rate is how long it takes for full capacity to drain.
 	Create(name string, capacity uint, rate time.Duration) (Bucket, error)
+
+	// Remove the named bucket, so that creating it again starts at full capacity.
+	Remove(name string) error
+}
+
+// Allow creates or gets the named bucket from s and adds 1 to it, reporting whether it fit.
+// A full bucket is reported as not allowed rather than as an error, so that err is only set
+// when creating the bucket or the add fails.
+func Allow(s Storage, name string, capacity uint, rate time.Duration) (bool, BucketState, error) {
+	bucket, err := s.Create(name, capacity, rate)
+	if err != nil {
+		return false, BucketState{}, err
+	}
+	state, ok, err := bucket.TryAdd(1)
+	return ok, state, err
+}
+
+// TryAdd adds amount to b, reporting whether it fit rather than returning ErrorFull. It is meant
+// to be used by leakybucket implementers whose TryAdd is their Add with a full bucket reported
+// as not fitting; any other error, such as ErrorOverCapacity, is returned as it is.
+func TryAdd(b Bucket, amount uint) (BucketState, bool, error) {
+	state, err := b.Add(amount)
+	if errors.Is(err, ErrorFull) {
+		return state, false, nil
+	}
+	return state, err == nil, err
+}
+
+// AddHierarchical adds amount to both parent and child, such as a global bucket and a per-user
+// one, failing if either is full. It adds to the parent first and, if the child's add fails,
+// refunds the parent, so that a rejected add consumes from neither. The buckets may be of
+// different storages; the rollback is a separate request, so a concurrent add to the parent
+// may briefly see the amount. It returns the states of both buckets, and the error of the
+// parent's add, of the child's add, or of the rollback if that fails too.
+func AddHierarchical(parent, child Bucket, amount uint) (BucketState, BucketState, error) {
+	parentState, err := parent.Add(amount)
+	if err != nil {
+		childState := BucketState{Capacity: child.Capacity(), Remaining: child.Remaining(), Reset: child.Reset()}
+		return parentState, childState, err
+	}
+	childState, err := child.Add(amount)
+	if err != nil {
+		refunded, refundErr := parent.Refund(amount)
+		if refundErr != nil {
+			return parentState, childState, refundErr
+		}
+		return refunded, childState, err
+	}
+	return parentState, childState, nil
+}
+
+// Request describes adding Amount to the named bucket, creating it with Capacity and Rate if
+// it doesn't exist yet.
+type Request struct {
+	Name     string
+	Capacity uint
+	Rate     time.Duration
+	Amount   uint
+}
+
+// MultiAdder is implemented by storages that can add to several buckets in one call, such as
+// when enforcing per-user, per-IP and global limits on the same request.
+type MultiAdder interface {
+	// AddMulti adds to each requested bucket. The returned states and errors correspond to
+	// the requests by index.
+	AddMulti([]Request) ([]BucketState, []error)
+}
+
+// BucketSpec describes a bucket to create with Capacity and Rate.
+type BucketSpec struct {
+	Name     string
+	Capacity uint
+	Rate     time.Duration
+}
+
+// MultiCreator is implemented by storages that can create several buckets in one call, such as
+// to load the buckets of a fixed set of tenants at startup rather than on their first request.
+type MultiCreator interface {
+	// CreateMulti creates each specified bucket. The returned buckets and errors correspond to
+	// the specs by index.
+	CreateMulti([]BucketSpec) ([]Bucket, []error)
+}
+
+// CreateMulti creates each specified bucket in s, in one call if s is a MultiCreator and one
+// Create at a time otherwise. The returned buckets and errors correspond to specs by index.
+func CreateMulti(s Storage, specs []BucketSpec) ([]Bucket, []error) {
+	if m, ok := s.(MultiCreator); ok {
+		return m.CreateMulti(specs)
+	}
+	buckets := make([]Bucket, len(specs))
+	errs := make([]error, len(specs))
+	for i, spec := range specs {
+		buckets[i], errs[i] = s.Create(spec.Name, spec.Capacity, spec.Rate)
+	}
+	return buckets, errs
+}
+
+// Migrate copies the state of each specified bucket from one storage to another, such as when
+// switching backends during a deploy, so that the limits don't start over empty and let a burst
+// through. Storages such as redis keep no capacity or rate, so they have to be given, as the
+// clients create the buckets. The bucket in to is drained, then has what the one in from used
+// added to it as of when that one's window started, so that it resets at the same time.
+//
+// It is best effort: each bucket is read from one storage then written to the other, not both
+// at once, so adds to it in between are lost, and migrating a bucket that is still in use on
+// both sides may count some adds twice. Migrate while the old storage gets no more adds, or
+// accept that much slack. It stops at the first error, leaving the buckets before it migrated.
+func Migrate(from, to Storage, specs []BucketSpec) error {
+	for _, spec := range specs {
+		if err := migrate(from, to, spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func migrate(from, to Storage, spec BucketSpec) error {
+	src, err := from.Create(spec.Name, spec.Capacity, spec.Rate)
+	if err != nil {
+		return err
+	}
+	state, err := src.Peek()
+	if err != nil {
+		return err
+	}
+	dst, err := to.Create(spec.Name, spec.Capacity, spec.Rate)
+	if err != nil {
+		return err
+	}
+	if err := dst.Drain(); err != nil {
+		return err
+	}
+	if state.Remaining >= spec.Capacity {
+		return nil
+	}
+	_, err = dst.AddWithTime(spec.Capacity-state.Remaining, state.Reset.Add(-spec.Rate))
+	return err
+}
+
+// PrefixRemover is implemented by storages that can remove every bucket whose name has a given
+// prefix at once, such as to clear the limits of one subsystem during an incident.
+type PrefixRemover interface {
+	Storage
+
+	// RemovePrefix removes every bucket whose name starts with prefix, returning how many it
+	// removed.
+	RemovePrefix(prefix string) (int, error)
+}
+
+// IdempotentAdder is implemented by buckets that can tell the retries of an add apart from new
+// adds, so that a client retrying after a timeout doesn't take the amount twice.
+type IdempotentAdder interface {
+	Bucket
+
+	// AddIdempotent adds amount like Add unless an add with the same idempotency key was
+	// applied recently, returning the bucket's state without adding to it if so.
+	AddIdempotent(key string, amount uint) (BucketState, error)
+}
+
+// Syncer is implemented by buckets that report when their state was last synced with their
+// backend, such as to tell a state that is fresh from one cached since an earlier call when
+// debugging staleness.
+type Syncer interface {
+	Bucket
+
+	// LastSync returns when the state the bucket reports was last read from or written to its
+	// backend, or the zero time if it never was. Buckets whose state lives in the bucket itself,
+	// as in memory, are always in sync and return the current time.
+	LastSync() time.Time
+}
+
+// CapacityAdder is implemented by buckets that can judge a single add against a capacity other
+// than their own, such as to give trusted requests a larger allowance without recreating the
+// bucket.
+type CapacityAdder interface {
+	Bucket
+
+	// AddWithCapacity adds to the bucket like Add, but accepts the amount if it fits in
+	// tempCapacity minus what the bucket has consumed, rather than in its remaining space. The
+	// bucket's capacity is unchanged, and it never records more than its capacity consumed: an
+	// add taking it past that leaves it full, with nothing remaining, until it resets. Below
+	// the bucket's capacity, tempCapacity refuses adds that its remaining space would allow, and
+	// Remaining keeps reporting that space. It returns ErrorOverCapacity if amount exceeds
+	// tempCapacity.
+	AddWithCapacity(amount, tempCapacity uint) (BucketState, error)
 }
@@ -0,0 +1,110 @@
+package leakybucket
+
+import "time"
+
+// maxUint is the largest uint, which is 32 bits on some platforms.
+const maxUint = uint64(^uint(0))
+
+// BucketState64 is a snapshot of the properties of a Bucket64, in its base amounts.
+type BucketState64 struct {
+	Capacity  uint64
+	Remaining uint64
+	Reset     time.Time
+}
+
+// Bucket64 adapts a Bucket to amounts counted in uint64, such as bandwidth quotas in bytes,
+// which overflow uint on 32-bit platforms. The bucket underneath counts whole units of Unit
+// base amounts each, such as a Unit of 1024 to count kilobytes, so that it stays within uint:
+// the capacity is rounded down to a whole number of units, and added or refunded amounts up.
+// With a Unit of 1 on a 64-bit platform it counts exactly.
+//
+// Buckets and storages keep counting in uint. Code scaling its amounts by hand to stay within
+// it can instead create a Bucket64 with CreateBucket64 and pass it the amounts unscaled.
+type Bucket64 struct {
+	Bucket Bucket
+	Unit   uint64
+}
+
+// CreateBucket64 creates the named bucket in s with a capacity of capacity base amounts,
+// counted in units of unit. It returns ErrorInvalidParams if the capacity is less than a unit,
+// or too many units for a uint.
+func CreateBucket64(s Storage, name string, capacity, unit uint64, rate time.Duration) (*Bucket64, error) {
+	if unit == 0 || capacity/unit == 0 || capacity/unit > maxUint {
+		return nil, ErrorInvalidParams
+	}
+	bucket, err := s.Create(name, uint(capacity/unit), rate)
+	if err != nil {
+		return nil, err
+	}
+	return &Bucket64{Bucket: bucket, Unit: unit}, nil
+}
+
+// units returns amount in whole units, rounded up, and whether it fits in a uint.
+func (b *Bucket64) units(amount uint64) (uint, bool) {
+	units := amount / b.Unit
+	if amount%b.Unit != 0 {
+		units++
+	}
+	return uint(units), units <= maxUint
+}
+
+// state returns state in base amounts.
+func (b *Bucket64) state(state BucketState) BucketState64 {
+	return BucketState64{
+		Capacity:  uint64(state.Capacity) * b.Unit,
+		Remaining: uint64(state.Remaining) * b.Unit,
+		Reset:     state.Reset,
+	}
+}
+
+// current returns the last known state of the bucket in base amounts.
+func (b *Bucket64) current() BucketState64 {
+	return b.state(BucketState{Capacity: b.Bucket.Capacity(), Remaining: b.Bucket.Remaining(), Reset: b.Bucket.Reset()})
+}
+
+// Capacity of the bucket in base amounts.
+func (b *Bucket64) Capacity() uint64 {
+	return uint64(b.Bucket.Capacity()) * b.Unit
+}
+
+// Remaining space in the bucket in base amounts.
+func (b *Bucket64) Remaining() uint64 {
+	return uint64(b.Bucket.Remaining()) * b.Unit
+}
+
+// Add amount to the bucket, rounded up to whole units.
+func (b *Bucket64) Add(amount uint64) (BucketState64, error) {
+	units, ok := b.units(amount)
+	if !ok {
+		return b.current(), ErrorOverCapacity
+	}
+	state, err := b.Bucket.Add(units)
+	return b.state(state), err
+}
+
+// TryAdd adds to the bucket like Add, reporting whether the amount fit rather than returning
+// ErrorFull.
+func (b *Bucket64) TryAdd(amount uint64) (BucketState64, bool, error) {
+	units, ok := b.units(amount)
+	if !ok {
+		return b.current(), false, ErrorOverCapacity
+	}
+	state, ok, err := b.Bucket.TryAdd(units)
+	return b.state(state), ok, err
+}
+
+// Refund gives back amount to the bucket, rounded up to whole units like the add it refunds.
+func (b *Bucket64) Refund(amount uint64) (BucketState64, error) {
+	units, ok := b.units(amount)
+	if !ok {
+		units = uint(maxUint)
+	}
+	state, err := b.Bucket.Refund(units)
+	return b.state(state), err
+}
+
+// Peek returns the bucket's current state in base amounts without adding to it.
+func (b *Bucket64) Peek() (BucketState64, error) {
+	state, err := b.Bucket.Peek()
+	return b.state(state), err
+}
@@ -1 +1,216 @@
 package leakybucket
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUtilization(t *testing.T) {
+	for _, test := range []struct {
+		capacity, remaining uint
+		expected            float64
+	}{
+		{10, 10, 0},
+		{10, 7, 0.3},
+		{8, 1, 0.875},
+		{10, 0, 1},
+		{10, 12, 0},
+		{0, 0, 1},
+	} {
+		state := BucketState{Capacity: test.capacity, Remaining: test.remaining}
+		if utilization := Utilization(state); math.Abs(utilization-test.expected) > 1e-9 {
+			t.Fatalf("expected utilization %v of %d remaining of %d, got %v",
+				test.expected, test.remaining, test.capacity, utilization)
+		}
+	}
+}
+
+func TestRemainingAfter(t *testing.T) {
+	for _, test := range []struct {
+		capacity uint
+		used     int64
+		expected uint
+	}{
+		{10, 0, 10},
+		{10, 3, 7},
+		{10, 10, 0},
+		{10, 12, 0},
+		{10, -3, 10},
+		{10, math.MaxInt64, 0},
+		{0, 1, 0},
+	} {
+		if remaining := RemainingAfter(test.capacity, test.used); remaining != test.expected {
+			t.Fatalf("expected %d remaining of %d after %d, got %d",
+				test.expected, test.capacity, test.used, remaining)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	for _, test := range []struct {
+		reset    time.Duration
+		expected time.Duration
+	}{
+		{-time.Minute, 0},
+		{0, 0},
+		{100 * time.Millisecond, time.Second},
+		{1500 * time.Millisecond, 2 * time.Second},
+		{time.Minute - time.Millisecond, time.Minute},
+	} {
+		state := BucketState{Capacity: 10, Reset: time.Now().Add(test.reset)}
+		if retryAfter := RetryAfter(state); retryAfter != test.expected {
+			t.Fatalf("reset in %s: expected %s, got %s", test.reset, test.expected, retryAfter)
+		}
+	}
+}
+
+func TestBucketStateRetryAfter(t *testing.T) {
+	now := time.Now()
+	for _, test := range []struct {
+		reset, round, expected time.Duration
+	}{
+		{-time.Minute, time.Second, 0},
+		{0, time.Second, 0},
+		{0, 0, 0},
+		{time.Nanosecond, time.Second, time.Second},
+		{1500 * time.Millisecond, time.Second, 2 * time.Second},
+		{1500 * time.Millisecond, time.Millisecond, 1500 * time.Millisecond},
+		{1500 * time.Millisecond, 0, 1500 * time.Millisecond},
+		{1234567 * time.Microsecond, 100 * time.Millisecond, 1300 * time.Millisecond},
+		{time.Minute, time.Minute, time.Minute},
+	} {
+		state := BucketState{Capacity: 10, Reset: now.Add(test.reset)}
+		if retryAfter := state.retryAfter(now, test.round); retryAfter != test.expected {
+			t.Fatalf("reset in %s rounded to %s: expected %s, got %s", test.reset, test.round, test.expected, retryAfter)
+		}
+	}
+}
+
+func TestBucketStateString(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 3, 28, 0, time.UTC)
+	for _, test := range []struct {
+		reset    time.Time
+		expected string
+	}{
+		{now.Add(37 * time.Second), "capacity=100 remaining=42 reset=2024-01-02T03:04:05Z (in 37s)"},
+		{now.Add(250 * time.Millisecond), "capacity=100 remaining=42 reset=2024-01-02T03:03:28Z (in 250ms)"},
+		{now.Add(-2 * time.Minute), "capacity=100 remaining=42 reset=2024-01-02T03:01:28Z (2m0s ago)"},
+	} {
+		state := BucketState{Capacity: 100, Remaining: 42, Reset: test.reset}
+		if s := state.string(now); s != test.expected {
+			t.Fatalf("expected %q, got %q", test.expected, s)
+		}
+	}
+	if s := fmt.Sprint(BucketState{Capacity: 1}); !strings.HasPrefix(s, "capacity=1 remaining=0 reset=") {
+		t.Fatalf("expected %%v to use String, got %q", s)
+	}
+}
+
+func TestFullError(t *testing.T) {
+	state := BucketState{Capacity: 10, Remaining: 1, Reset: time.Now().Add(time.Minute)}
+	err := fmt.Errorf("limiting user: %w", NewFullError(state))
+	if !errors.Is(err, ErrorFull) {
+		t.Fatalf("expected %v to be ErrorFull", err)
+	}
+	if errors.Is(err, ErrorOverCapacity) {
+		t.Fatalf("expected %v not to be ErrorOverCapacity", err)
+	}
+	var full *FullError
+	if !errors.As(err, &full) {
+		t.Fatalf("expected %v to be a *FullError", err)
+	}
+	if full.BucketState != state {
+		t.Fatalf("expected state %+v, got %+v", state, full.BucketState)
+	}
+	if full.Error() != ErrorFull.Error() {
+		t.Fatalf("expected the message of ErrorFull, got %q", full.Error())
+	}
+}
+
+func TestLogHooks(t *testing.T) {
+	var lines []string
+	hooks := LogHooks(func(format string, args ...interface{}) {
+		lines = append(lines, fmt.Sprintf(format, args...))
+	})
+	state := BucketState{Capacity: 10, Remaining: 3, Reset: time.Now()}
+	hooks.Observe("api-key-secret", state, nil)
+	hooks.Observe("api-key-secret", state, NewFullError(state))
+	hooks.Observe("api-key-secret", state, errors.New("connection refused"))
+	if len(lines) != 3 {
+		t.Fatalf("expected %d lines logged, got %d", 3, len(lines))
+	}
+	fingerprint := NameFingerprint("api-key-secret")
+	for i, prefix := range []string{"leakybucket: allowed", "leakybucket: rejected", "leakybucket: failed"} {
+		if !strings.HasPrefix(lines[i], prefix) || !strings.Contains(lines[i], fingerprint) {
+			t.Fatalf("expected %q to start with %q and hold %s", lines[i], prefix, fingerprint)
+		}
+		if strings.Contains(lines[i], "secret") {
+			t.Fatalf("expected %q not to hold the bucket name", lines[i])
+		}
+	}
+	if NameFingerprint("other") == fingerprint {
+		t.Fatalf("expected different names to have different fingerprints")
+	}
+}
+
+func TestNotifyExhausted(t *testing.T) {
+	ch := make(chan string, 1)
+	hooks := Hooks{OnExhausted: NotifyExhausted(ch)}
+	hooks.Observe("testbucket", BucketState{Capacity: 3, Remaining: 1}, nil)
+	hooks.Observe("testbucket", BucketState{Capacity: 3, Remaining: 0}, nil)
+	hooks.Observe("testbucket", BucketState{Capacity: 3, Remaining: 0}, NewFullError(BucketState{}))
+	// The channel is full, so the name is dropped rather than blocking the add.
+	hooks.Observe("otherbucket", BucketState{Capacity: 3, Remaining: 0}, nil)
+	if name := <-ch; name != "testbucket" {
+		t.Fatalf("expected testbucket, got %s", name)
+	}
+	select {
+	case name := <-ch:
+		t.Fatalf("expected the name sent to a full channel to be dropped, got %s", name)
+	default:
+	}
+}
+
+func TestTokenRate(t *testing.T) {
+	for _, test := range []struct {
+		tokensPerSecond float64
+		burst           uint
+		expected        time.Duration
+	}{
+		{1, 1, time.Second},
+		{2.5, 5, 2 * time.Second},
+		{2.5, 1, 400 * time.Millisecond},
+		{0.5, 3, 6 * time.Second},
+		{0, 3, 0},
+		{-1, 3, 0},
+	} {
+		if rate := TokenRate(test.tokensPerSecond, test.burst); rate != test.expected {
+			t.Fatalf("%v per second, burst %d: expected %s, got %s", test.tokensPerSecond, test.burst,
+				test.expected, rate)
+		}
+	}
+}
+
+func TestJitterRate(t *testing.T) {
+	if rate := JitterRate(time.Minute, 0); rate != time.Minute {
+		t.Fatalf("expected no jitter, got %s", rate)
+	}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		rate := JitterRate(time.Minute, 10*time.Second)
+		if rate < 50*time.Second || rate > 70*time.Second {
+			t.Fatalf("expected a rate within 10s of a minute, got %s", rate)
+		}
+		seen[rate] = true
+	}
+	if len(seen) < 2 {
+		t.Fatal("expected the jitter to vary")
+	}
+	if rate := JitterRate(time.Millisecond, time.Second); rate < time.Millisecond {
+		t.Fatalf("expected at least a millisecond, got %s", rate)
+	}
+}
@@ -0,0 +1,18 @@
+package leakybucket
+
+import "time"
+
+// Clock tells the current time. Backends read the time through a Clock so that tests can
+// control it instead of sleeping. Times carrying a monotonic clock reading, as those of
+// time.Now do, are compared by it and so are unaffected by changes to the wall clock.
+type Clock interface {
+	Now() time.Time
+}
+
+// RealClock is a Clock backed by the system time.
+type RealClock struct{}
+
+// Now returns time.Now().
+func (RealClock) Now() time.Time {
+	return time.Now()
+}
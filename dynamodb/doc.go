@@ -0,0 +1,21 @@
+// Package dynamodb provides a leaky bucket implementation backed by Amazon DynamoDB, for
+// serverless deployments with no redis to share.
+//
+// Usage:
+//
+//	cfg, err := config.LoadDefaultConfig(ctx)
+//	...
+//	storage := dynamodb.New(awsdynamodb.NewFromConfig(cfg), "leakybucket")
+//
+// Each bucket is an item in the table, whose partition key must be the string attribute
+// "name". The item holds the bucket's count and the end of its window, in milliseconds since
+// the epoch. Adds are conditional updates, so the capacity holds however many clients share
+// the table. Enable Time to Live on the "ttl" attribute to have DynamoDB delete the items of
+// finished windows; it does so lazily, so windows are ended by their reset time, not by the
+// deletion.
+//
+// Buckets read the table with strongly consistent reads, which see every write acknowledged
+// before them in the same region. Global tables replicate between regions asynchronously, so
+// each region counts its own adds until replication catches up, and concurrent adds in two
+// regions may between them exceed the capacity.
+package dynamodb
@@ -0,0 +1,441 @@
+package dynamodb
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/bububa/leakybucket"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// names maps the placeholders of the expressions below to attributes, since COUNT and TTL are
+// reserved words.
+var names = map[string]string{"#count": "count", "#reset": "reset", "#ttl": "ttl"}
+
+// incrementExpression adds :amount to a bucket whose window hasn't ended by :now, if the
+// count is at most :max, that is if the amount fits.
+const (
+	incrementExpression = "ADD #count :amount"
+	incrementCondition  = "#reset > :now AND #count <= :max"
+)
+
+// startExpression starts a new window ending at :reset with a count of :count, if the bucket
+// doesn't exist or its window ended by :now.
+const (
+	startExpression = "SET #count = :count, #reset = :reset, #ttl = :ttl"
+	startCondition  = "attribute_not_exists(#reset) OR #reset <= :now"
+)
+
+// setExpression sets the count of a bucket whose window hasn't ended by :now.
+const (
+	setExpression = "SET #count = :count"
+	setCondition  = "#reset > :now"
+)
+
+// refundExpression takes :amount off the count of a bucket whose window hasn't ended by :now,
+// if the count is at least :amount, that is if it doesn't go negative.
+const (
+	refundExpression = "ADD #count :refund"
+	refundCondition  = "#reset > :now AND #count >= :amount"
+)
+
+type bucket struct {
+	name                string
+	capacity, remaining uint
+	reset               time.Time
+	rate                time.Duration
+	client              *dynamodb.Client
+	table               string
+	clock               leakybucket.Clock
+	hooks               *leakybucket.Hooks
+
+	// mutex guards remaining and reset, which concurrent adds to the bucket update.
+	mutex sync.Mutex
+}
+
+func (b *bucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset
+}
+
+// Rate returns how long it takes for the bucket's full capacity to drain.
+func (b *bucket) Rate() time.Duration {
+	return b.rate
+}
+
+func (b *bucket) State() leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
+// setState records the state of the bucket last read from DynamoDB, returning it.
+func (b *bucket) setState(remaining uint, reset time.Time) leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remaining, b.reset = remaining, reset
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: remaining, Reset: reset}
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(context.Background(), amount, b.clock.Now()))
+}
+
+// TryAdd adds to the bucket, reporting whether the amount fit rather than returning ErrorFull.
+func (b *bucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	return leakybucket.TryAdd(b, amount)
+}
+
+// TakeUpTo adds as much of amount to the bucket as fits, returning how much it added.
+func (b *bucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	state, err := b.Peek()
+	for err == nil {
+		granted := leakybucket.Min(amount, state.Remaining)
+		if granted == 0 {
+			return 0, state, nil
+		}
+		state, err = b.add(context.Background(), granted, b.clock.Now())
+		if err == nil {
+			return granted, state, nil
+		} else if errors.Is(err, leakybucket.ErrorFull) {
+			// Concurrent adds took some of the room since it was read; try again with the rest.
+			err = nil
+		}
+	}
+	return 0, state, err
+}
+
+// AddWithTime adds to the bucket as if at time t.
+func (b *bucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(context.Background(), amount, t))
+}
+
+// AddContext adds to the bucket, bounding the requests to DynamoDB by ctx.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(ctx, amount, b.clock.Now()))
+}
+
+func (b *bucket) add(ctx context.Context, amount uint, now time.Time) (leakybucket.BucketState, error) {
+	if amount == 0 {
+		// Adding nothing is a read.
+		return b.peek(ctx)
+	}
+	if amount > b.capacity {
+		return b.State(), leakybucket.ErrorOverCapacity
+	}
+
+	increment := func() (map[string]types.AttributeValue, error) {
+		return b.update(ctx, incrementExpression, incrementCondition, map[string]types.AttributeValue{
+			":amount": number(int64(amount)),
+			":now":    number(milliseconds(now)),
+			":max":    number(int64(b.capacity - amount)),
+		})
+	}
+	item, err := increment()
+	if conditionFailed(err) {
+		item, err = b.start(ctx, amount, now)
+		if conditionFailed(err) {
+			// Another add started the window first, after which it may still have room.
+			item, err = increment()
+		}
+	}
+	full := false
+	if conditionFailed(err) {
+		// The add didn't fit; read the state it was refused against.
+		full = true
+		item, err = b.get(ctx)
+	}
+	if err != nil {
+		return b.State(), err
+	}
+
+	remaining, reset, _, err := b.parse(item, now)
+	if err != nil {
+		return b.State(), err
+	}
+	state := b.setState(remaining, reset)
+	if full {
+		return state, leakybucket.NewFullError(state)
+	}
+	return state, nil
+}
+
+// start gives the bucket a new window as of now with a count of count, unless its current
+// window hasn't ended.
+func (b *bucket) start(ctx context.Context, count uint, now time.Time) (map[string]types.AttributeValue, error) {
+	reset := now.Add(b.rate)
+	return b.update(ctx, startExpression, startCondition, map[string]types.AttributeValue{
+		":count": number(int64(count)),
+		":reset": number(milliseconds(reset)),
+		":ttl":   number(reset.Unix() + 1),
+		":now":   number(milliseconds(now)),
+	})
+}
+
+// update applies expression to the bucket's item if condition holds, returning the new item.
+func (b *bucket) update(ctx context.Context, expression, condition string, values map[string]types.AttributeValue) (map[string]types.AttributeValue, error) {
+	out, err := b.client.UpdateItem(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(b.table),
+		Key:                       key(b.name),
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String(condition),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+		ReturnValues:              types.ReturnValueAllNew,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Attributes, nil
+}
+
+// get reads the bucket's item, which is nil if there is none.
+func (b *bucket) get(ctx context.Context) (map[string]types.AttributeValue, error) {
+	out, err := b.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(b.table),
+		Key:            key(b.name),
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Item, nil
+}
+
+// parse returns the remaining space and reset time in the bucket's item as of now, and whether
+// there is an item.
+func (b *bucket) parse(item map[string]types.AttributeValue, now time.Time) (uint, time.Time, bool, error) {
+	if item == nil {
+		return b.capacity, now.Add(b.rate), false, nil
+	}
+	count, err := attribute(item, "count")
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	resetMs, err := attribute(item, "reset")
+	if err != nil {
+		return 0, time.Time{}, false, err
+	}
+	reset := time.Unix(0, resetMs*int64(time.Millisecond))
+	if !reset.After(now) {
+		return b.capacity, now.Add(b.rate), true, nil
+	}
+	return leakybucket.RemainingAfter(b.capacity, count), reset, true, nil
+}
+
+// Peek reads the bucket's state from DynamoDB without adding to it.
+func (b *bucket) Peek() (leakybucket.BucketState, error) {
+	return b.peek(context.Background())
+}
+
+func (b *bucket) peek(ctx context.Context) (leakybucket.BucketState, error) {
+	item, err := b.get(ctx)
+	if err != nil {
+		return b.State(), err
+	}
+	remaining, reset, _, err := b.parse(item, b.clock.Now())
+	if err != nil {
+		return b.State(), err
+	}
+	return b.setState(remaining, reset), nil
+}
+
+// WouldAccept reports whether adding amount would fit, reading the bucket's state without
+// adding to it.
+func (b *bucket) WouldAccept(amount uint) (bool, error) {
+	state, err := b.Peek()
+	if err != nil {
+		return false, err
+	}
+	return amount <= state.Remaining, nil
+}
+
+// SetRemaining sets the remaining space in the bucket, up to its capacity, without changing
+// when it resets.
+func (b *bucket) SetRemaining(n uint) error {
+	ctx := context.Background()
+	remaining := leakybucket.Min(n, b.capacity)
+	now := b.clock.Now()
+	set := func() (map[string]types.AttributeValue, error) {
+		return b.update(ctx, setExpression, setCondition, map[string]types.AttributeValue{
+			":count": number(int64(b.capacity - remaining)),
+			":now":   number(milliseconds(now)),
+		})
+	}
+	item, err := set()
+	if conditionFailed(err) {
+		item, err = b.start(ctx, b.capacity-remaining, now)
+		if conditionFailed(err) {
+			item, err = set()
+		}
+	}
+	if err != nil {
+		return err
+	}
+	_, reset, _, err := b.parse(item, now)
+	if err != nil {
+		return err
+	}
+	b.setState(remaining, reset)
+	return nil
+}
+
+// Refund gives back amount to the bucket, up to its capacity, without changing when it resets.
+func (b *bucket) Refund(amount uint) (leakybucket.BucketState, error) {
+	ctx := context.Background()
+	now := b.clock.Now()
+	item, err := b.update(ctx, refundExpression, refundCondition, map[string]types.AttributeValue{
+		":refund": number(-int64(amount)),
+		":amount": number(int64(amount)),
+		":now":    number(milliseconds(now)),
+	})
+	if conditionFailed(err) {
+		// The refund is more than the count, which empties the bucket instead.
+		item, err = b.update(ctx, setExpression, setCondition, map[string]types.AttributeValue{
+			":count": number(0),
+			":now":   number(milliseconds(now)),
+		})
+		if conditionFailed(err) {
+			// The window has ended, so there is nothing to give back.
+			item, err = nil, nil
+		}
+	}
+	if err != nil {
+		return b.State(), err
+	}
+	remaining, reset, _, err := b.parse(item, now)
+	if err != nil {
+		return b.State(), err
+	}
+	return b.setState(remaining, reset), nil
+}
+
+// Drain the bucket by deleting its item.
+func (b *bucket) Drain() error {
+	if err := remove(context.Background(), b.client, b.table, b.name); err != nil {
+		return err
+	}
+	b.setState(b.capacity, b.clock.Now().Add(b.rate))
+	return nil
+}
+
+// Storage is a DynamoDB-based leaky bucket factory.
+type Storage struct {
+	client *dynamodb.Client
+	table  string
+	clock  leakybucket.Clock
+	hooks  *leakybucket.Hooks
+}
+
+// New initializes a storage keeping its buckets in table, which must already exist with the
+// string partition key "name".
+func New(client *dynamodb.Client, table string) *Storage {
+	return &Storage{client: client, table: table, clock: leakybucket.RealClock{}}
+}
+
+// SetClock makes the buckets created by the storage read the time from clock instead of the
+// system clock.
+func (s *Storage) SetClock(clock leakybucket.Clock) {
+	s.clock = clock
+}
+
+// SetHooks makes the buckets created by the storage afterwards call hooks on adds.
+func (s *Storage) SetHooks(hooks leakybucket.Hooks) {
+	s.hooks = &hooks
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, _, err := s.CreateOrGet(name, capacity, rate)
+	return b, err
+}
+
+// CreateOrGet creates a bucket like Create, also reporting whether the bucket is new, that is
+// whether it had no item.
+func (s *Storage) CreateOrGet(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, bool, error) {
+	if err := leakybucket.ValidateParams(capacity, rate); err != nil {
+		return nil, false, err
+	}
+	b := &bucket{
+		name:     name,
+		capacity: capacity,
+		rate:     rate,
+		client:   s.client,
+		table:    s.table,
+		clock:    s.clock,
+		hooks:    s.hooks,
+	}
+	item, err := b.get(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+	remaining, reset, exists, err := b.parse(item, s.clock.Now())
+	if err != nil {
+		return nil, false, err
+	}
+	b.setState(remaining, reset)
+	return b, !exists, nil
+}
+
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *Storage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
+}
+
+// Remove a bucket by deleting its item.
+func (s *Storage) Remove(name string) error {
+	return remove(context.Background(), s.client, s.table, name)
+}
+
+func remove(ctx context.Context, client *dynamodb.Client, table, name string) error {
+	_, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+		TableName: aws.String(table),
+		Key:       key(name),
+	})
+	return err
+}
+
+func key(name string) map[string]types.AttributeValue {
+	return map[string]types.AttributeValue{"name": &types.AttributeValueMemberS{Value: name}}
+}
+
+func number(n int64) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(n, 10)}
+}
+
+// attribute returns the value of the number attribute name of item.
+func attribute(item map[string]types.AttributeValue, name string) (int64, error) {
+	n, ok := item[name].(*types.AttributeValueMemberN)
+	if !ok {
+		return 0, errors.New("dynamodb: item has no number attribute " + name)
+	}
+	return strconv.ParseInt(n.Value, 10, 64)
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
+
+// conditionFailed reports whether err is the failure of an update's condition.
+func conditionFailed(err error) bool {
+	var failed *types.ConditionalCheckFailedException
+	return errors.As(err, &failed)
+}
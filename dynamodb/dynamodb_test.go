@@ -0,0 +1,153 @@
+package dynamodb
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/bububa/leakybucket"
+	"os"
+	"testing"
+)
+
+// getLocalStorage returns a storage on the emptied table DYNAMODB_TABLE, skipping
+// the test if it is not set. Point AWS_ENDPOINT_URL_DYNAMODB at DynamoDB Local to test without
+// an AWS account.
+func getLocalStorage(t *testing.T) *Storage {
+	table := os.Getenv("DYNAMODB_TABLE")
+	if table == "" {
+		t.Skip("DYNAMODB_TABLE is not set")
+	}
+	ctx := context.Background()
+	cfg, err := config.LoadDefaultConfig(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := dynamodb.NewFromConfig(cfg)
+	scan := &dynamodb.ScanInput{TableName: aws.String(table), ProjectionExpression: aws.String("#name"),
+		ExpressionAttributeNames: map[string]string{"#name": "name"}}
+	for {
+		out, err := client.Scan(ctx, scan)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, item := range out.Items {
+			if _, err := client.DeleteItem(ctx, &dynamodb.DeleteItemInput{TableName: scan.TableName, Key: item}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if out.LastEvaluatedKey == nil {
+			break
+		}
+		scan.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+	return New(client, table)
+}
+
+func TestCreate(t *testing.T) {
+	leakybucket.CreateTest(getLocalStorage(t))(t)
+}
+
+func TestCreateMulti(t *testing.T) {
+	leakybucket.CreateMultiTest(getLocalStorage(t))(t)
+}
+
+func TestInvalidParams(t *testing.T) {
+	leakybucket.InvalidParamsTest(getLocalStorage(t))(t)
+}
+
+func TestAdd(t *testing.T) {
+	leakybucket.AddTest(getLocalStorage(t))(t)
+}
+
+func TestAddZero(t *testing.T) {
+	leakybucket.AddZeroTest(getLocalStorage(t))(t)
+}
+
+func TestAddOverCapacity(t *testing.T) {
+	leakybucket.AddOverCapacityTest(getLocalStorage(t))(t)
+}
+
+func TestTryAdd(t *testing.T) {
+	leakybucket.TryAddTest(getLocalStorage(t))(t)
+}
+
+func TestFullError(t *testing.T) {
+	leakybucket.FullErrorTest(getLocalStorage(t))(t)
+}
+
+func TestAddDetailed(t *testing.T) {
+	leakybucket.AddDetailedTest(getLocalStorage(t))(t)
+}
+
+func TestAllow(t *testing.T) {
+	leakybucket.AllowTest(getLocalStorage(t))(t)
+}
+
+func TestTakeUpTo(t *testing.T) {
+	leakybucket.TakeUpToTest(getLocalStorage(t))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	leakybucket.ThreadSafeAddTest(getLocalStorage(t))(t)
+}
+
+func TestConcurrentCapacity(t *testing.T) {
+	leakybucket.ConcurrentCapacityTest(getLocalStorage(t))(t)
+}
+
+func TestReset(t *testing.T) {
+	leakybucket.AddResetTest(getLocalStorage(t))(t)
+}
+
+func TestShortRate(t *testing.T) {
+	leakybucket.ShortRateTest(getLocalStorage(t))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	leakybucket.FindOrCreateTest(getLocalStorage(t))(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	leakybucket.BucketInstanceConsistencyTest(getLocalStorage(t))(t)
+}
+
+func TestAddContext(t *testing.T) {
+	leakybucket.AddContextTest(getLocalStorage(t))(t)
+}
+
+func TestAddWithTime(t *testing.T) {
+	leakybucket.AddWithTimeTest(getLocalStorage(t))(t)
+}
+
+func TestPeek(t *testing.T) {
+	leakybucket.PeekTest(getLocalStorage(t))(t)
+}
+
+func TestWouldAccept(t *testing.T) {
+	leakybucket.WouldAcceptTest(getLocalStorage(t))(t)
+}
+
+func TestHooks(t *testing.T) {
+	leakybucket.HooksTest(getLocalStorage(t))(t)
+}
+
+func TestRemove(t *testing.T) {
+	leakybucket.RemoveTest(getLocalStorage(t))(t)
+}
+
+func TestSetRemaining(t *testing.T) {
+	leakybucket.SetRemainingTest(getLocalStorage(t))(t)
+}
+
+func TestDrain(t *testing.T) {
+	leakybucket.DrainTest(getLocalStorage(t))(t)
+}
+
+func TestRefund(t *testing.T) {
+	leakybucket.RefundTest(getLocalStorage(t))(t)
+}
+
+func TestAddHierarchical(t *testing.T) {
+	leakybucket.AddHierarchicalTest(getLocalStorage(t))(t)
+}
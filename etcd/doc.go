@@ -0,0 +1,20 @@
+// Package etcd provides a leaky bucket implementation backed by etcd, for deployments that
+// already run etcd for coordination and would rather not add redis.
+//
+// Usage:
+//
+//	client, err := clientv3.New(clientv3.Config{Endpoints: []string{"localhost:2379"}})
+//	...
+//	storage := etcd.New(client)
+//
+// Each bucket is a key under "leakybucket/" holding the bucket's count and the end of its
+// window. Adds read the key and write it back in a transaction comparing its revision, retrying
+// if another client wrote it in between, so the capacity holds however many clients share the
+// cluster. Each window's key is attached to a lease that expires shortly after the window ends,
+// so etcd deletes the keys of finished windows; windows are ended by their reset time, not by
+// the deletion.
+//
+// Every add is a write that etcd replicates to a quorum of its members, and concurrent adds to
+// the same bucket retry each other's transactions. etcd is therefore not suited to very high
+// add rates, but is fine for coarse limits such as a few adds per client per second.
+package etcd
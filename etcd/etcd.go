@@ -0,0 +1,357 @@
+package etcd
+
+import (
+	"context"
+	"errors"
+	"github.com/bububa/leakybucket"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keyPrefix is prepended to bucket names to form their keys.
+const keyPrefix = "leakybucket/"
+
+var errMalformed = errors.New("etcd: malformed bucket value")
+
+// window is the state of a bucket as stored in etcd.
+type window struct {
+	count uint
+	reset time.Time
+	// revision is the revision the key was last modified at, or 0 if there is no key.
+	revision int64
+}
+
+// active reports whether the window hasn't ended by now.
+func (w window) active(now time.Time) bool {
+	return w.revision != 0 && w.reset.After(now)
+}
+
+// encode returns the value stored for the window: its count and reset time in milliseconds,
+// separated by a colon.
+func (w window) encode() string {
+	return strconv.FormatUint(uint64(w.count), 10) + ":" + strconv.FormatInt(milliseconds(w.reset), 10)
+}
+
+func decode(value []byte, revision int64) (window, error) {
+	fields := strings.SplitN(string(value), ":", 2)
+	if len(fields) != 2 {
+		return window{}, errMalformed
+	}
+	count, err := strconv.ParseUint(fields[0], 10, 64)
+	if err != nil {
+		return window{}, err
+	}
+	resetMs, err := strconv.ParseInt(fields[1], 10, 64)
+	if err != nil {
+		return window{}, err
+	}
+	return window{
+		count:    uint(count),
+		reset:    time.Unix(0, resetMs*int64(time.Millisecond)),
+		revision: revision,
+	}, nil
+}
+
+type bucket struct {
+	name, key           string
+	capacity, remaining uint
+	reset               time.Time
+	rate                time.Duration
+	client              *clientv3.Client
+	clock               leakybucket.Clock
+	hooks               *leakybucket.Hooks
+
+	// mutex guards remaining and reset, which concurrent adds to the bucket update.
+	mutex sync.Mutex
+}
+
+func (b *bucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset
+}
+
+// Rate returns how long it takes for the bucket's full capacity to drain.
+func (b *bucket) Rate() time.Duration {
+	return b.rate
+}
+
+func (b *bucket) State() leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
+// setState records the state of the bucket last read from etcd, returning it.
+func (b *bucket) setState(remaining uint, reset time.Time) leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remaining, b.reset = remaining, reset
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: remaining, Reset: reset}
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(context.Background(), amount, b.clock.Now()))
+}
+
+// TryAdd adds to the bucket, reporting whether the amount fit rather than returning ErrorFull.
+func (b *bucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	return leakybucket.TryAdd(b, amount)
+}
+
+// TakeUpTo adds as much of amount to the bucket as fits, returning how much it added.
+func (b *bucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	var granted uint
+	state, err := b.modify(context.Background(), b.clock.Now(), func(count uint) (uint, error) {
+		granted = leakybucket.Min(amount, b.capacity-leakybucket.Min(count, b.capacity))
+		return count + granted, nil
+	})
+	if err != nil {
+		return 0, state, err
+	}
+	return granted, state, nil
+}
+
+// AddWithTime adds to the bucket as if at time t.
+func (b *bucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(context.Background(), amount, t))
+}
+
+// AddContext adds to the bucket, bounding the requests to etcd by ctx.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(ctx, amount, b.clock.Now()))
+}
+
+func (b *bucket) add(ctx context.Context, amount uint, now time.Time) (leakybucket.BucketState, error) {
+	if amount == 0 {
+		// Adding nothing is a read.
+		return b.peek(ctx)
+	}
+	if amount > b.capacity {
+		return b.State(), leakybucket.ErrorOverCapacity
+	}
+	state, err := b.modify(ctx, now, func(count uint) (uint, error) {
+		if count+amount > b.capacity {
+			return count, leakybucket.ErrorFull
+		}
+		return count + amount, nil
+	})
+	if errors.Is(err, leakybucket.ErrorFull) {
+		err = leakybucket.NewFullError(state)
+	}
+	return state, err
+}
+
+// modify replaces the count of the bucket's window as of now with the one f returns for the
+// current count, retrying if another client writes the bucket in between. If f returns an
+// error, the bucket is left as it is and modify returns the error with the bucket's state.
+func (b *bucket) modify(ctx context.Context, now time.Time, f func(uint) (uint, error)) (leakybucket.BucketState, error) {
+	for {
+		w, err := b.read(ctx)
+		if err != nil {
+			return b.State(), err
+		}
+		var current uint
+		if w.active(now) {
+			current = w.count
+		}
+		count, err := f(current)
+		if err != nil || (count == current && (count == 0 || w.active(now))) {
+			// Nothing to write.
+			return b.observe(w, now), err
+		}
+		next, ok, err := b.write(ctx, w, count, now)
+		if err != nil {
+			return b.State(), err
+		}
+		if ok {
+			return b.observe(next, now), nil
+		}
+	}
+}
+
+// read returns the bucket's window as stored in etcd.
+func (b *bucket) read(ctx context.Context) (window, error) {
+	resp, err := b.client.Get(ctx, b.key)
+	if err != nil {
+		return window{}, err
+	}
+	if len(resp.Kvs) == 0 {
+		return window{}, nil
+	}
+	kv := resp.Kvs[0]
+	return decode(kv.Value, kv.ModRevision)
+}
+
+// write replaces the window w read from etcd with one of count, starting a new window as of
+// now if w has ended. It reports false if the key has been written since w was read.
+func (b *bucket) write(ctx context.Context, w window, count uint, now time.Time) (window, bool, error) {
+	next := window{count: count, reset: w.reset}
+	option := clientv3.WithIgnoreLease()
+	lease := clientv3.NoLease
+	if !w.active(now) {
+		next.reset = now.Add(b.rate)
+		grant, err := b.client.Grant(ctx, leaseTTL(b.rate))
+		if err != nil {
+			return w, false, err
+		}
+		lease = grant.ID
+		option = clientv3.WithLease(lease)
+	}
+	resp, err := b.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(b.key), "=", w.revision)).
+		Then(clientv3.OpPut(b.key, next.encode(), option)).
+		Commit()
+	if lease != clientv3.NoLease && (err != nil || !resp.Succeeded) {
+		// The lease would expire by itself, but there is no need to keep it until then.
+		b.client.Revoke(ctx, lease)
+	}
+	if err != nil {
+		return w, false, err
+	}
+	return next, resp.Succeeded, nil
+}
+
+// observe updates the bucket's state from its window as of now, returning it.
+func (b *bucket) observe(w window, now time.Time) leakybucket.BucketState {
+	if !w.active(now) {
+		return b.setState(b.capacity, now.Add(b.rate))
+	}
+	return b.setState(b.capacity-leakybucket.Min(w.count, b.capacity), w.reset)
+}
+
+// Peek reads the bucket's state from etcd without adding to it.
+func (b *bucket) Peek() (leakybucket.BucketState, error) {
+	return b.peek(context.Background())
+}
+
+func (b *bucket) peek(ctx context.Context) (leakybucket.BucketState, error) {
+	w, err := b.read(ctx)
+	if err != nil {
+		return b.State(), err
+	}
+	return b.observe(w, b.clock.Now()), nil
+}
+
+// WouldAccept reports whether adding amount would fit, reading the bucket's state without
+// adding to it.
+func (b *bucket) WouldAccept(amount uint) (bool, error) {
+	state, err := b.Peek()
+	if err != nil {
+		return false, err
+	}
+	return amount <= state.Remaining, nil
+}
+
+// SetRemaining sets the remaining space in the bucket, up to its capacity, without changing
+// when it resets.
+func (b *bucket) SetRemaining(n uint) error {
+	_, err := b.modify(context.Background(), b.clock.Now(), func(uint) (uint, error) {
+		return b.capacity - leakybucket.Min(n, b.capacity), nil
+	})
+	return err
+}
+
+// Refund gives back amount to the bucket, up to its capacity, without changing when it resets.
+func (b *bucket) Refund(amount uint) (leakybucket.BucketState, error) {
+	return b.modify(context.Background(), b.clock.Now(), func(count uint) (uint, error) {
+		return count - leakybucket.Min(amount, count), nil
+	})
+}
+
+// Drain the bucket by deleting its key.
+func (b *bucket) Drain() error {
+	if _, err := b.client.Delete(context.Background(), b.key); err != nil {
+		return err
+	}
+	b.setState(b.capacity, b.clock.Now().Add(b.rate))
+	return nil
+}
+
+// Storage is an etcd-based leaky bucket factory.
+type Storage struct {
+	client *clientv3.Client
+	clock  leakybucket.Clock
+	hooks  *leakybucket.Hooks
+}
+
+// New initializes a storage keeping its buckets in etcd through client.
+func New(client *clientv3.Client) *Storage {
+	return &Storage{client: client, clock: leakybucket.RealClock{}}
+}
+
+// SetClock makes the buckets created by the storage read the time from clock instead of the
+// system clock.
+func (s *Storage) SetClock(clock leakybucket.Clock) {
+	s.clock = clock
+}
+
+// SetHooks makes the buckets created by the storage afterwards call hooks on adds.
+func (s *Storage) SetHooks(hooks leakybucket.Hooks) {
+	s.hooks = &hooks
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, _, err := s.CreateOrGet(name, capacity, rate)
+	return b, err
+}
+
+// CreateOrGet creates a bucket like Create, also reporting whether the bucket is new, that is
+// whether it had no key.
+func (s *Storage) CreateOrGet(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, bool, error) {
+	if err := leakybucket.ValidateParams(capacity, rate); err != nil {
+		return nil, false, err
+	}
+	b := &bucket{
+		name:     name,
+		key:      keyPrefix + name,
+		capacity: capacity,
+		rate:     rate,
+		client:   s.client,
+		clock:    s.clock,
+		hooks:    s.hooks,
+	}
+	w, err := b.read(context.Background())
+	if err != nil {
+		return nil, false, err
+	}
+	b.observe(w, s.clock.Now())
+	return b, w.revision == 0, nil
+}
+
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *Storage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
+}
+
+// Remove a bucket by deleting its key.
+func (s *Storage) Remove(name string) error {
+	_, err := s.client.Delete(context.Background(), keyPrefix+name)
+	return err
+}
+
+// leaseTTL returns the TTL in seconds of the lease for a window of rate, which outlives it.
+func leaseTTL(rate time.Duration) int64 {
+	return int64((rate+time.Second-1)/time.Second) + 1
+}
+
+func milliseconds(t time.Time) int64 {
+	return t.UnixNano() / int64(time.Millisecond)
+}
@@ -0,0 +1,171 @@
+package etcd
+
+import (
+	"context"
+	"github.com/bububa/leakybucket"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// getLocalStorage returns a storage on the etcd cluster at the comma-separated ETCD_ENDPOINTS,
+// with its buckets removed, skipping the test if it is not set.
+func getLocalStorage(t *testing.T) *Storage {
+	endpoints := os.Getenv("ETCD_ENDPOINTS")
+	if endpoints == "" {
+		t.Skip("ETCD_ENDPOINTS is not set")
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   strings.Split(endpoints, ","),
+		DialTimeout: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Delete(context.Background(), keyPrefix, clientv3.WithPrefix()); err != nil {
+		t.Fatal(err)
+	}
+	return New(client)
+}
+
+func TestCreate(t *testing.T) {
+	leakybucket.CreateTest(getLocalStorage(t))(t)
+}
+
+func TestCreateMulti(t *testing.T) {
+	leakybucket.CreateMultiTest(getLocalStorage(t))(t)
+}
+
+func TestInvalidParams(t *testing.T) {
+	leakybucket.InvalidParamsTest(getLocalStorage(t))(t)
+}
+
+func TestAdd(t *testing.T) {
+	leakybucket.AddTest(getLocalStorage(t))(t)
+}
+
+func TestAddZero(t *testing.T) {
+	leakybucket.AddZeroTest(getLocalStorage(t))(t)
+}
+
+func TestAddOverCapacity(t *testing.T) {
+	leakybucket.AddOverCapacityTest(getLocalStorage(t))(t)
+}
+
+func TestTryAdd(t *testing.T) {
+	leakybucket.TryAddTest(getLocalStorage(t))(t)
+}
+
+func TestFullError(t *testing.T) {
+	leakybucket.FullErrorTest(getLocalStorage(t))(t)
+}
+
+func TestAddDetailed(t *testing.T) {
+	leakybucket.AddDetailedTest(getLocalStorage(t))(t)
+}
+
+func TestAllow(t *testing.T) {
+	leakybucket.AllowTest(getLocalStorage(t))(t)
+}
+
+func TestTakeUpTo(t *testing.T) {
+	leakybucket.TakeUpToTest(getLocalStorage(t))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	leakybucket.ThreadSafeAddTest(getLocalStorage(t))(t)
+}
+
+func TestConcurrentCapacity(t *testing.T) {
+	leakybucket.ConcurrentCapacityTest(getLocalStorage(t))(t)
+}
+
+func TestReset(t *testing.T) {
+	leakybucket.AddResetTest(getLocalStorage(t))(t)
+}
+
+func TestShortRate(t *testing.T) {
+	leakybucket.ShortRateTest(getLocalStorage(t))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	leakybucket.FindOrCreateTest(getLocalStorage(t))(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	leakybucket.BucketInstanceConsistencyTest(getLocalStorage(t))(t)
+}
+
+func TestAddContext(t *testing.T) {
+	leakybucket.AddContextTest(getLocalStorage(t))(t)
+}
+
+func TestAddWithTime(t *testing.T) {
+	leakybucket.AddWithTimeTest(getLocalStorage(t))(t)
+}
+
+func TestPeek(t *testing.T) {
+	leakybucket.PeekTest(getLocalStorage(t))(t)
+}
+
+func TestWouldAccept(t *testing.T) {
+	leakybucket.WouldAcceptTest(getLocalStorage(t))(t)
+}
+
+func TestHooks(t *testing.T) {
+	leakybucket.HooksTest(getLocalStorage(t))(t)
+}
+
+func TestRemove(t *testing.T) {
+	leakybucket.RemoveTest(getLocalStorage(t))(t)
+}
+
+func TestSetRemaining(t *testing.T) {
+	leakybucket.SetRemainingTest(getLocalStorage(t))(t)
+}
+
+func TestDrain(t *testing.T) {
+	leakybucket.DrainTest(getLocalStorage(t))(t)
+}
+
+func TestRefund(t *testing.T) {
+	leakybucket.RefundTest(getLocalStorage(t))(t)
+}
+
+func TestAddHierarchical(t *testing.T) {
+	leakybucket.AddHierarchicalTest(getLocalStorage(t))(t)
+}
+
+func TestWindow(t *testing.T) {
+	w := window{count: 3, reset: time.Unix(1500000000, 250*int64(time.Millisecond))}
+	if value := w.encode(); value != "3:1500000000250" {
+		t.Fatalf("expected value %q, got %q", "3:1500000000250", value)
+	}
+	decoded, err := decode([]byte(w.encode()), 7)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.count != w.count || !decoded.reset.Equal(w.reset) || decoded.revision != 7 {
+		t.Fatalf("expected %+v at revision 7, got %+v", w, decoded)
+	}
+	for _, value := range []string{"", "3", "x:1", "3:x"} {
+		if _, err := decode([]byte(value), 1); err == nil {
+			t.Fatalf("expected an error decoding %q", value)
+		}
+	}
+}
+
+func TestLeaseTTL(t *testing.T) {
+	for rate, ttl := range map[time.Duration]int64{
+		time.Millisecond:        2,
+		time.Second:             2,
+		1500 * time.Millisecond: 3,
+		time.Minute:             61,
+	} {
+		if actual := leaseTTL(rate); actual != ttl {
+			t.Fatalf("expected a TTL of %d for %s, got %d", ttl, rate, actual)
+		}
+	}
+}
@@ -0,0 +1,11 @@
+// Package grpclimit provides a gRPC server interceptor that rate limits calls with leaky
+// buckets from any leakybucket.Storage, as httplimit does for net/http.
+//
+// Usage:
+//
+//	limit := grpclimit.UnaryServerInterceptor(memory.New(), func(ctx context.Context) string {
+//		p, _ := peer.FromContext(ctx)
+//		return p.Addr.String()
+//	}, 100, time.Minute)
+//	server := grpc.NewServer(grpc.UnaryInterceptor(limit))
+package grpclimit
@@ -0,0 +1,38 @@
+package grpclimit
+
+import (
+	"context"
+	"errors"
+	"github.com/bububa/leakybucket"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"time"
+)
+
+// UnaryServerInterceptor returns an interceptor that adds 1 to the bucket named by keyFunc for
+// each call, which keyFunc typically names after the peer or incoming metadata. Once the bucket
+// is full, calls fail with codes.ResourceExhausted instead, with a RetryInfo detail telling how
+// long until the bucket resets.
+func UnaryServerInterceptor(storage leakybucket.Storage, keyFunc func(context.Context) string, capacity uint, rate time.Duration) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+		bucket, err := storage.Create(keyFunc(ctx), capacity, rate)
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		state, err := bucket.Add(1)
+		if errors.Is(err, leakybucket.ErrorFull) {
+			s := status.New(codes.ResourceExhausted, "rate limit exceeded")
+			retry := &errdetails.RetryInfo{RetryDelay: durationpb.New(leakybucket.RetryAfter(state))}
+			if detailed, err := s.WithDetails(retry); err == nil {
+				s = detailed
+			}
+			return nil, s.Err()
+		} else if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,80 @@
+package grpclimit
+
+import (
+	"context"
+	"errors"
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/leakybucket/memory"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"testing"
+	"time"
+)
+
+type keyType struct{}
+
+func byKey(ctx context.Context) string {
+	return ctx.Value(keyType{}).(string)
+}
+
+func ok(ctx context.Context, req interface{}) (interface{}, error) {
+	return "ok", nil
+}
+
+func call(interceptor grpc.UnaryServerInterceptor, key string) (interface{}, error) {
+	ctx := context.WithValue(context.Background(), keyType{}, key)
+	return interceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/test.Service/Method"}, ok)
+}
+
+func TestUnaryServerInterceptor(t *testing.T) {
+	interceptor := UnaryServerInterceptor(memory.New(), byKey, 2, time.Minute)
+
+	for i := 0; i < 2; i++ {
+		if reply, err := call(interceptor, "user:a"); err != nil {
+			t.Fatal(err)
+		} else if reply != "ok" {
+			t.Fatalf("expected the handler's reply, got %v", reply)
+		}
+	}
+
+	_, err := call(interceptor, "user:a")
+	s, _ := status.FromError(err)
+	if s.Code() != codes.ResourceExhausted {
+		t.Fatalf("expected code %s, got %s", codes.ResourceExhausted, s.Code())
+	}
+	var retry *errdetails.RetryInfo
+	for _, detail := range s.Details() {
+		if info, ok := detail.(*errdetails.RetryInfo); ok {
+			retry = info
+		}
+	}
+	if retry == nil {
+		t.Fatal("expected a RetryInfo detail")
+	} else if delay := retry.GetRetryDelay().AsDuration(); delay < 59*time.Second || delay > time.Minute {
+		t.Fatalf("expected a retry delay of about a minute, got %s", delay)
+	}
+
+	// Other keys have their own bucket.
+	if _, err := call(interceptor, "user:b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type failingStorage struct{}
+
+func (failingStorage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return nil, errors.New("storage is down")
+}
+
+func (failingStorage) Remove(name string) error {
+	return errors.New("storage is down")
+}
+
+func TestUnaryServerInterceptorStorageError(t *testing.T) {
+	_, err := call(UnaryServerInterceptor(failingStorage{}, byKey, 2, time.Minute), "user:a")
+	if code := status.Code(err); code != codes.Internal {
+		t.Fatalf("expected code %s, got %s", codes.Internal, code)
+	}
+}
@@ -0,0 +1,112 @@
+package leakybucket
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+)
+
+// Hooks are functions a storage calls with the outcome of each add to its buckets, such as to
+// start tracing spans or write structured logs without wrapping every call. Any of them may be
+// nil. They run synchronously inside Add, TryAdd, AddContext, AddWithTime and AddWithCapacity,
+// so they should be cheap; TakeUpTo, which adds only what fits, doesn't call them.
+type Hooks struct {
+	// OnAllow is called when an add fits in the bucket.
+	OnAllow func(name string, state BucketState)
+
+	// OnReject is called when an add doesn't fit, with ErrorFull or ErrorOverCapacity.
+	OnReject func(name string, state BucketState)
+
+	// OnError is called when an add fails any other way, such as when the backend can't be
+	// reached. Storages failing open call it with the error they hide from the caller.
+	OnError func(name string, state BucketState, err error)
+
+	// OnExhausted is called after OnAllow when an add fits but leaves nothing remaining, such as
+	// to alert on abuse as it happens. Only the add filling the bucket does, so a window calls it
+	// once however many adds it then rejects. SetRemaining and Drain don't call it.
+	OnExhausted func(name string, state BucketState)
+}
+
+// HookedStorage is implemented by storages that call Hooks on adds to their buckets.
+type HookedStorage interface {
+	Storage
+
+	// SetHooks makes the buckets created by the storage afterwards call hooks.
+	SetHooks(hooks Hooks)
+}
+
+// Observe calls the hook of h matching the outcome of an add to the named bucket. It does
+// nothing on a nil *Hooks, so that backends can call it unconditionally at little cost.
+func (h *Hooks) Observe(name string, state BucketState, err error) {
+	if h == nil {
+		return
+	}
+	switch {
+	case err == nil:
+		if h.OnAllow != nil {
+			h.OnAllow(name, state)
+		}
+		if h.OnExhausted != nil && state.Remaining == 0 {
+			h.OnExhausted(name, state)
+		}
+	case errors.Is(err, ErrorFull), err == ErrorOverCapacity:
+		if h.OnReject != nil {
+			h.OnReject(name, state)
+		}
+	default:
+		if h.OnError != nil {
+			h.OnError(name, state, err)
+		}
+	}
+}
+
+// Notify returns a function calling the hook of h matching the outcome of an add to the named
+// bucket, which it passes through, so that backends can wrap their adds in it:
+//
+//	return b.hooks.Notify(b.name)(b.add(amount))
+func (h *Hooks) Notify(name string) func(BucketState, error) (BucketState, error) {
+	return func(state BucketState, err error) (BucketState, error) {
+		h.Observe(name, state, err)
+		return state, err
+	}
+}
+
+// NotifyExhausted returns an OnExhausted hook sending the names of buckets to ch. The hook runs
+// inside the add, so rather than block it, it drops the names that ch has no room for: give ch
+// a buffer, and a reader that keeps up, to see them all.
+func NotifyExhausted(ch chan<- string) func(name string, state BucketState) {
+	return func(name string, state BucketState) {
+		select {
+		case ch <- name:
+		default:
+		}
+	}
+}
+
+// Logf is a printf-style logging function, such as log.Printf, or a method logging at debug
+// level on the logger of an application.
+type Logf func(format string, args ...interface{})
+
+// LogHooks returns Hooks logging each add with logf, for troubleshooting limit decisions rather
+// than monitoring them. Bucket names often hold user IDs or API keys, so they are logged as
+// their NameFingerprint rather than in the clear.
+func LogHooks(logf Logf) Hooks {
+	return Hooks{
+		OnAllow: func(name string, state BucketState) {
+			logf("leakybucket: allowed bucket=%s %s", NameFingerprint(name), state)
+		},
+		OnReject: func(name string, state BucketState) {
+			logf("leakybucket: rejected bucket=%s %s", NameFingerprint(name), state)
+		},
+		OnError: func(name string, state BucketState, err error) {
+			logf("leakybucket: failed bucket=%s: %v", NameFingerprint(name), err)
+		},
+	}
+}
+
+// NameFingerprint returns a short hash of a bucket name that identifies it in logs without
+// revealing it, so that the logs of a known name can be found by fingerprinting it too.
+func NameFingerprint(name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return hex.EncodeToString(sum[:8])
+}
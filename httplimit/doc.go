@@ -0,0 +1,10 @@
+// Package httplimit provides net/http middleware that rate limits requests with leaky buckets
+// from any leakybucket.Storage.
+//
+// Usage:
+//
+//	limit := httplimit.Middleware(memory.New(), func(r *http.Request) string {
+//		return r.RemoteAddr
+//	}, 100, time.Minute)
+//	http.ListenAndServe(":8080", limit(handler))
+package httplimit
@@ -0,0 +1,42 @@
+package httplimit
+
+import (
+	"errors"
+	"github.com/bububa/leakybucket"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Middleware returns middleware that adds 1 to the bucket named by keyFunc for each request.
+// Requests are passed on with X-RateLimit-Limit, X-RateLimit-Remaining and X-RateLimit-Reset
+// headers set. Once the bucket is full, requests are answered with 429 Too Many Requests and a
+// Retry-After header instead.
+func Middleware(storage leakybucket.Storage, keyFunc func(*http.Request) string, capacity uint, rate time.Duration) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			bucket, err := storage.Create(keyFunc(r), capacity, rate)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			state, err := bucket.Add(1)
+			if err != nil && !errors.Is(err, leakybucket.ErrorFull) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			h := w.Header()
+			h.Set("X-RateLimit-Limit", strconv.FormatUint(uint64(state.Capacity), 10))
+			h.Set("X-RateLimit-Remaining", strconv.FormatUint(uint64(state.Remaining), 10))
+			h.Set("X-RateLimit-Reset", strconv.FormatInt(state.Reset.Unix(), 10))
+			if errors.Is(err, leakybucket.ErrorFull) {
+				retryAfter := leakybucket.RetryAfter(state) / time.Second
+				h.Set("Retry-After", strconv.FormatInt(int64(retryAfter), 10))
+				http.Error(w, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
@@ -0,0 +1,82 @@
+package httplimit
+
+import (
+	"errors"
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/leakybucket/memory"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+var ok = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func byRemoteAddr(r *http.Request) string {
+	return r.RemoteAddr
+}
+
+func serve(h http.Handler, remoteAddr string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = remoteAddr
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestMiddleware(t *testing.T) {
+	h := Middleware(memory.New(), byRemoteAddr, 2, time.Minute)(ok)
+
+	for _, remaining := range []string{"1", "0"} {
+		w := serve(h, "1.2.3.4:1234")
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+		}
+		if limit := w.Header().Get("X-RateLimit-Limit"); limit != "2" {
+			t.Fatalf("expected limit %s, got %s", "2", limit)
+		}
+		if got := w.Header().Get("X-RateLimit-Remaining"); got != remaining {
+			t.Fatalf("expected remaining %s, got %s", remaining, got)
+		}
+		if reset, err := strconv.ParseInt(w.Header().Get("X-RateLimit-Reset"), 10, 64); err != nil {
+			t.Fatal(err)
+		} else if reset < time.Now().Unix() {
+			t.Fatalf("reset time is in the past")
+		}
+	}
+
+	w := serve(h, "1.2.3.4:1234")
+	if w.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected status %d, got %d", http.StatusTooManyRequests, w.Code)
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil {
+		t.Fatal(err)
+	} else if retry < 59 || retry > 60 {
+		t.Fatalf("expected Retry-After of about 60 seconds, got %d", retry)
+	}
+
+	// Other keys have their own bucket.
+	if w := serve(h, "5.6.7.8:1234"); w.Code != http.StatusOK {
+		t.Fatalf("expected status %d, got %d", http.StatusOK, w.Code)
+	}
+}
+
+type failingStorage struct{}
+
+func (failingStorage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return nil, errors.New("storage is down")
+}
+
+func (failingStorage) Remove(name string) error {
+	return errors.New("storage is down")
+}
+
+func TestMiddlewareStorageError(t *testing.T) {
+	h := Middleware(failingStorage{}, byRemoteAddr, 2, time.Minute)(ok)
+	if w := serve(h, "1.2.3.4:1234"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
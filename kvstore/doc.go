@@ -0,0 +1,13 @@
+// Package kvstore provides a leaky bucket implementation on any key-value store with expiring
+// keys and atomic counters, so that supporting a new datastore, such as BadgerDB, bbolt or
+// Consul, takes the five methods of Store rather than a whole leakybucket.Storage.
+//
+// Usage:
+//
+//	storage := kvstore.New(kvstore.NewMemoryStore())
+//
+// Each bucket is two keys: a counter, which adds increment with Incr, and the end of its
+// window, which the add starting the window sets. Both expire with the window. An add that
+// takes a counter over the bucket's capacity decrements it back, so concurrent adds may
+// briefly see each other's refused adds and be refused too, but never exceed the capacity.
+package kvstore
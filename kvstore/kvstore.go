@@ -0,0 +1,372 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"github.com/bububa/leakybucket"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Keys are the bucket name after one of these prefixes, which no counter key shares with a
+// reset key.
+const (
+	countPrefix = "leakybucket/count/"
+	resetPrefix = "leakybucket/reset/"
+)
+
+type bucket struct {
+	name                string
+	capacity, remaining uint
+	reset               time.Time
+	rate                time.Duration
+	store               Store
+	clock               leakybucket.Clock
+	hooks               *leakybucket.Hooks
+
+	// mutex guards remaining and reset, which concurrent adds to the bucket update.
+	mutex sync.Mutex
+}
+
+func (b *bucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset
+}
+
+// Rate returns how long it takes for the bucket's full capacity to drain.
+func (b *bucket) Rate() time.Duration {
+	return b.rate
+}
+
+func (b *bucket) State() leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
+// observe records the state of the bucket given the count of its window and when it resets.
+func (b *bucket) observe(count int64, reset time.Time) leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remaining = leakybucket.RemainingAfter(b.capacity, count)
+	b.reset = reset
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	now := b.clock.Now()
+	return b.hooks.Notify(b.name)(b.add(amount, now.Add(b.rate), b.rate))
+}
+
+// TryAdd adds to the bucket, reporting whether the amount fit rather than returning ErrorFull.
+func (b *bucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	return leakybucket.TryAdd(b, amount)
+}
+
+// TakeUpTo adds as much of amount to the bucket as fits, returning how much it added.
+func (b *bucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	state, err := b.Peek()
+	for err == nil {
+		granted := leakybucket.Min(amount, state.Remaining)
+		if granted == 0 {
+			return 0, state, nil
+		}
+		state, err = b.add(granted, b.clock.Now().Add(b.rate), b.rate)
+		if err == nil {
+			return granted, state, nil
+		} else if errors.Is(err, leakybucket.ErrorFull) {
+			// Concurrent adds took some of the room since it was read; try again with the rest.
+			err = nil
+		}
+	}
+	return 0, state, err
+}
+
+// AddWithTime adds to the bucket as if at time t: a window started by this add ends at t plus
+// the rate, rather than a full rate from now.
+func (b *bucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	reset := t.Add(b.rate)
+	return b.hooks.Notify(b.name)(b.add(amount, reset, ttl(reset, b.clock.Now())))
+}
+
+// AddContext adds to the bucket unless ctx is already done. Store has no way to bound its
+// requests by ctx.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	if err := ctx.Err(); err != nil {
+		return b.hooks.Notify(b.name)(b.State(), err)
+	}
+	return b.Add(amount)
+}
+
+// add increments the counter by amount, taking it back out if it doesn't fit. A window started
+// by the add ends at reset, window from now.
+func (b *bucket) add(amount uint, reset time.Time, window time.Duration) (leakybucket.BucketState, error) {
+	if amount == 0 {
+		// Adding nothing is a read.
+		return b.Peek()
+	}
+	if amount > b.capacity {
+		return b.State(), leakybucket.ErrorOverCapacity
+	}
+	count, err := b.store.Incr(countPrefix+b.name, int64(amount))
+	if err != nil {
+		return b.State(), err
+	}
+	current, ok, err := b.readReset()
+	if err != nil {
+		return b.State(), err
+	}
+	if now := b.clock.Now(); ok && current.After(now) {
+		// The window hasn't ended, even if a refund took the counter back to zero.
+		reset = current
+		if count == int64(amount) {
+			// The add may have recreated a counter that expired just before the reset key,
+			// which must not outlive the window either.
+			if err := b.store.Expire(countPrefix+b.name, ttl(current, now)); err != nil {
+				return b.State(), err
+			}
+		}
+	} else if err := b.start(reset, window); err != nil {
+		// The add created the counter, or found one whose window was never started, such as
+		// by an add that failed halfway.
+		return b.State(), err
+	}
+	if count > int64(b.capacity) {
+		if _, err := b.store.Incr(countPrefix+b.name, -int64(amount)); err != nil {
+			return b.State(), err
+		}
+		state := b.observe(count-int64(amount), reset)
+		return state, leakybucket.NewFullError(state)
+	}
+	return b.observe(count, reset), nil
+}
+
+// start starts a window ending at reset, ttl from now, for the counter.
+func (b *bucket) start(reset time.Time, window time.Duration) error {
+	if err := b.store.Expire(countPrefix+b.name, window); err != nil {
+		return err
+	}
+	value := strconv.FormatInt(reset.UnixNano()/int64(time.Millisecond), 10)
+	return b.store.Set(resetPrefix+b.name, []byte(value), window)
+}
+
+// readReset returns when the bucket's window ends, and whether it has one.
+func (b *bucket) readReset() (time.Time, bool, error) {
+	value, err := b.store.Get(resetPrefix + b.name)
+	if err != nil || value == nil {
+		return time.Time{}, false, err
+	}
+	ms, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.Unix(0, ms*int64(time.Millisecond)), true, nil
+}
+
+// readCount returns the counter of the bucket's window, and whether it has one.
+func (b *bucket) readCount() (int64, bool, error) {
+	value, err := b.store.Get(countPrefix + b.name)
+	if err != nil || value == nil {
+		return 0, false, err
+	}
+	count, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, false, errNotCounter
+	}
+	return count, true, nil
+}
+
+// Peek reads the bucket's state from the store without adding to it.
+func (b *bucket) Peek() (leakybucket.BucketState, error) {
+	state, _, err := b.load()
+	return state, err
+}
+
+// load reads the bucket's state from the store, also reporting whether it has a counter.
+func (b *bucket) load() (leakybucket.BucketState, bool, error) {
+	now := b.clock.Now()
+	count, ok, err := b.readCount()
+	if err != nil {
+		return b.State(), false, err
+	}
+	if !ok {
+		return b.observe(0, now.Add(b.rate)), false, nil
+	}
+	reset, ok, err := b.readReset()
+	if err != nil {
+		return b.State(), true, err
+	} else if !ok {
+		// The add starting the window hasn't recorded when it ends yet.
+		reset = now.Add(b.rate)
+	}
+	return b.observe(count, reset), true, nil
+}
+
+// WouldAccept reports whether adding amount would fit, reading the bucket's state without
+// adding to it.
+func (b *bucket) WouldAccept(amount uint) (bool, error) {
+	state, err := b.Peek()
+	if err != nil {
+		return false, err
+	}
+	return amount <= state.Remaining, nil
+}
+
+// SetRemaining sets the remaining space in the bucket, up to its capacity, without changing
+// when it resets. It overwrites the counter, so it races with concurrent adds.
+func (b *bucket) SetRemaining(n uint) error {
+	now := b.clock.Now()
+	reset, ok, err := b.readReset()
+	if err != nil {
+		return err
+	}
+	if !ok || !reset.After(now) {
+		reset = now.Add(b.rate)
+	}
+	count := b.capacity - leakybucket.Min(n, b.capacity)
+	window := ttl(reset, now)
+	if err := b.store.Set(countPrefix+b.name, []byte(strconv.FormatUint(uint64(count), 10)), window); err != nil {
+		return err
+	}
+	if err := b.start(reset, window); err != nil {
+		return err
+	}
+	b.observe(int64(count), reset)
+	return nil
+}
+
+// Refund gives back amount to the bucket by decrementing its counter, up to its capacity.
+func (b *bucket) Refund(amount uint) (leakybucket.BucketState, error) {
+	now := b.clock.Now()
+	count, ok, err := b.readCount()
+	if err != nil {
+		return b.State(), err
+	}
+	if !ok || count <= 0 {
+		// There is nothing in the bucket to give back.
+		return b.Peek()
+	}
+	refund := int64(leakybucket.Min(amount, uint(count)))
+	if count, err = b.store.Incr(countPrefix+b.name, -refund); err != nil {
+		return b.State(), err
+	}
+	if count == -refund {
+		// The window ended since the counter was read, and decrementing it started another.
+		if err := b.store.Del(countPrefix + b.name); err != nil {
+			return b.State(), err
+		}
+		return b.observe(0, now.Add(b.rate)), nil
+	} else if count < 0 {
+		// Concurrent refunds took the counter below zero.
+		if _, err := b.store.Incr(countPrefix+b.name, -count); err != nil {
+			return b.State(), err
+		}
+	}
+	reset, ok, err := b.readReset()
+	if err != nil {
+		return b.State(), err
+	} else if !ok {
+		reset = now.Add(b.rate)
+	}
+	return b.observe(count, reset), nil
+}
+
+// Drain the bucket by deleting its keys.
+func (b *bucket) Drain() error {
+	if err := remove(b.store, b.name); err != nil {
+		return err
+	}
+	b.observe(0, b.clock.Now().Add(b.rate))
+	return nil
+}
+
+// Storage is a leaky bucket factory keeping its buckets in a Store.
+type Storage struct {
+	store Store
+	clock leakybucket.Clock
+	hooks *leakybucket.Hooks
+}
+
+// New initializes a storage keeping its buckets in store.
+func New(store Store) *Storage {
+	return &Storage{store: store, clock: leakybucket.RealClock{}}
+}
+
+// SetClock makes the buckets created by the storage read the time from clock instead of the
+// system clock. Expiry itself is still tracked by the store.
+func (s *Storage) SetClock(clock leakybucket.Clock) {
+	s.clock = clock
+}
+
+// SetHooks makes the buckets created by the storage afterwards call hooks on adds.
+func (s *Storage) SetHooks(hooks leakybucket.Hooks) {
+	s.hooks = &hooks
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, _, err := s.CreateOrGet(name, capacity, rate)
+	return b, err
+}
+
+// CreateOrGet creates a bucket like Create, also reporting whether the bucket is new, that is
+// whether it had no counter in the store.
+func (s *Storage) CreateOrGet(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, bool, error) {
+	if err := leakybucket.ValidateParams(capacity, rate); err != nil {
+		return nil, false, err
+	}
+	b := &bucket{
+		name:     name,
+		capacity: capacity,
+		rate:     rate,
+		store:    s.store,
+		clock:    s.clock,
+		hooks:    s.hooks,
+	}
+	_, exists, err := b.load()
+	if err != nil {
+		return nil, false, err
+	}
+	return b, !exists, nil
+}
+
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *Storage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
+}
+
+// Remove a bucket by deleting its keys.
+func (s *Storage) Remove(name string) error {
+	return remove(s.store, name)
+}
+
+func remove(store Store, name string) error {
+	if err := store.Del(countPrefix + name); err != nil {
+		return err
+	}
+	return store.Del(resetPrefix + name)
+}
+
+// ttl returns how long from now a window ending at reset has left, at least a millisecond so
+// that a window already over expires right away rather than never.
+func ttl(reset, now time.Time) time.Duration {
+	if d := reset.Sub(now); d >= time.Millisecond {
+		return d
+	}
+	return time.Millisecond
+}
@@ -0,0 +1,141 @@
+package kvstore
+
+import (
+	"github.com/bububa/leakybucket"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	leakybucket.CreateTest(New(NewMemoryStore()))(t)
+}
+
+func TestCreateMulti(t *testing.T) {
+	leakybucket.CreateMultiTest(New(NewMemoryStore()))(t)
+}
+
+func TestInvalidParams(t *testing.T) {
+	leakybucket.InvalidParamsTest(New(NewMemoryStore()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	leakybucket.AddTest(New(NewMemoryStore()))(t)
+}
+
+func TestAddZero(t *testing.T) {
+	leakybucket.AddZeroTest(New(NewMemoryStore()))(t)
+}
+
+func TestAddOverCapacity(t *testing.T) {
+	leakybucket.AddOverCapacityTest(New(NewMemoryStore()))(t)
+}
+
+func TestTryAdd(t *testing.T) {
+	leakybucket.TryAddTest(New(NewMemoryStore()))(t)
+}
+
+func TestFullError(t *testing.T) {
+	leakybucket.FullErrorTest(New(NewMemoryStore()))(t)
+}
+
+func TestAddDetailed(t *testing.T) {
+	leakybucket.AddDetailedTest(New(NewMemoryStore()))(t)
+}
+
+func TestAllow(t *testing.T) {
+	leakybucket.AllowTest(New(NewMemoryStore()))(t)
+}
+
+func TestTakeUpTo(t *testing.T) {
+	leakybucket.TakeUpToTest(New(NewMemoryStore()))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	leakybucket.ThreadSafeAddTest(New(NewMemoryStore()))(t)
+}
+
+func TestConcurrentCapacity(t *testing.T) {
+	leakybucket.ConcurrentCapacityTest(New(NewMemoryStore()))(t)
+}
+
+func TestReset(t *testing.T) {
+	leakybucket.AddResetTest(New(NewMemoryStore()))(t)
+}
+
+func TestShortRate(t *testing.T) {
+	leakybucket.ShortRateTest(New(NewMemoryStore()))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	leakybucket.FindOrCreateTest(New(NewMemoryStore()))(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	leakybucket.BucketInstanceConsistencyTest(New(NewMemoryStore()))(t)
+}
+
+func TestAddContext(t *testing.T) {
+	leakybucket.AddContextTest(New(NewMemoryStore()))(t)
+}
+
+func TestAddWithTime(t *testing.T) {
+	leakybucket.AddWithTimeTest(New(NewMemoryStore()))(t)
+}
+
+func TestPeek(t *testing.T) {
+	leakybucket.PeekTest(New(NewMemoryStore()))(t)
+}
+
+func TestWouldAccept(t *testing.T) {
+	leakybucket.WouldAcceptTest(New(NewMemoryStore()))(t)
+}
+
+func TestHooks(t *testing.T) {
+	leakybucket.HooksTest(New(NewMemoryStore()))(t)
+}
+
+func TestRemove(t *testing.T) {
+	leakybucket.RemoveTest(New(NewMemoryStore()))(t)
+}
+
+func TestSetRemaining(t *testing.T) {
+	leakybucket.SetRemainingTest(New(NewMemoryStore()))(t)
+}
+
+func TestDrain(t *testing.T) {
+	leakybucket.DrainTest(New(NewMemoryStore()))(t)
+}
+
+func TestRefund(t *testing.T) {
+	leakybucket.RefundTest(New(NewMemoryStore()))(t)
+}
+
+func TestAddHierarchical(t *testing.T) {
+	leakybucket.AddHierarchicalTest(New(NewMemoryStore()))(t)
+}
+
+func TestAddAfterRefund(t *testing.T) {
+	bucket, err := New(NewMemoryStore()).Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := bucket.Add(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	// A counter refunded to zero keeps its window rather than starting another on the next add.
+	if _, err := bucket.Refund(2); err != nil {
+		t.Fatal(err)
+	}
+	state, err := bucket.Add(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != 4 {
+		t.Fatalf("expected %d remaining, got %d", 4, state.Remaining)
+	}
+	if state.Reset.After(first.Reset) {
+		t.Fatalf("expected the window to keep its reset at %v, got %v", first.Reset, state.Reset)
+	}
+}
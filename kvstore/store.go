@@ -0,0 +1,115 @@
+package kvstore
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Store is a key-value store that buckets keep their state in. It must be safe for concurrent
+// use, as must be its Incr for each key across every client sharing the store.
+type Store interface {
+	// Get returns the value of key, or nil if it doesn't exist or has expired.
+	Get(key string) ([]byte, error)
+
+	// Set sets the value of key, which expires after ttl, or never if ttl is 0.
+	Set(key string, value []byte, ttl time.Duration) error
+
+	// Incr atomically adds delta to the counter at key, creating it at 0 with no expiry if it
+	// doesn't exist, and returns its new value. Counters are base 10 strings as far as Get and
+	// Set are concerned.
+	Incr(key string, delta int64) (int64, error)
+
+	// Expire makes key expire after ttl. It does nothing if key doesn't exist.
+	Expire(key string, ttl time.Duration) error
+
+	// Del deletes key, if it exists.
+	Del(key string) error
+}
+
+var errNotCounter = errors.New("kvstore: value is not a counter")
+
+type entry struct {
+	value   []byte
+	expires time.Time
+}
+
+// MemoryStore is a Store that keeps its keys in memory, as a reference for implementing Store
+// and for tests.
+type MemoryStore struct {
+	mutex   sync.Mutex
+	entries map[string]entry
+}
+
+// NewMemoryStore returns an empty MemoryStore.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[string]entry)}
+}
+
+// get returns the entry of key, deleting it if it has expired. The caller must hold m.mutex.
+func (m *MemoryStore) get(key string) (entry, bool) {
+	e, ok := m.entries[key]
+	if ok && !e.expires.IsZero() && !time.Now().Before(e.expires) {
+		delete(m.entries, key)
+		return entry{}, false
+	}
+	return e, ok
+}
+
+// Get returns the value of key, or nil if it doesn't exist or has expired.
+func (m *MemoryStore) Get(key string) ([]byte, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, _ := m.get(key)
+	return e.value, nil
+}
+
+// Set sets the value of key, which expires after ttl, or never if ttl is 0.
+func (m *MemoryStore) Set(key string, value []byte, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e := entry{value: value}
+	if ttl != 0 {
+		e.expires = time.Now().Add(ttl)
+	}
+	m.entries[key] = e
+	return nil
+}
+
+// Incr atomically adds delta to the counter at key, creating it if it doesn't exist.
+func (m *MemoryStore) Incr(key string, delta int64) (int64, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	e, ok := m.get(key)
+	var n int64
+	if ok {
+		var err error
+		if n, err = strconv.ParseInt(string(e.value), 10, 64); err != nil {
+			return 0, errNotCounter
+		}
+	}
+	n += delta
+	e.value = []byte(strconv.FormatInt(n, 10))
+	m.entries[key] = e
+	return n, nil
+}
+
+// Expire makes key expire after ttl.
+func (m *MemoryStore) Expire(key string, ttl time.Duration) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if e, ok := m.get(key); ok {
+		e.expires = time.Now().Add(ttl)
+		m.entries[key] = e
+	}
+	return nil
+}
+
+// Del deletes key.
+func (m *MemoryStore) Del(key string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	delete(m.entries, key)
+	return nil
+}
@@ -0,0 +1,80 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMemoryStoreIncr(t *testing.T) {
+	store := NewMemoryStore()
+	for _, test := range []struct {
+		delta, expected int64
+	}{
+		{3, 3},
+		{2, 5},
+		{-6, -1},
+	} {
+		if n, err := store.Incr("counter", test.delta); err != nil {
+			t.Fatal(err)
+		} else if n != test.expected {
+			t.Fatalf("expected %d after adding %d, got %d", test.expected, test.delta, n)
+		}
+	}
+	if value, err := store.Get("counter"); err != nil {
+		t.Fatal(err)
+	} else if string(value) != "-1" {
+		t.Fatalf("expected the counter to read as -1, got %q", value)
+	}
+
+	if err := store.Set("string", []byte("abc"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Incr("string", 1); err != errNotCounter {
+		t.Fatalf("expected errNotCounter incrementing a string, got %v", err)
+	}
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.Set("key", []byte("value"), 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Incr("counter", 1); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Expire("counter", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Expire("missing", 10*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := store.Get("key"); string(value) != "value" {
+		t.Fatalf("expected the key to be set before it expires, got %q", value)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	for _, key := range []string{"key", "counter", "missing"} {
+		if value, _ := store.Get(key); value != nil {
+			t.Fatalf("expected %s to have expired, got %q", key, value)
+		}
+	}
+	if n, _ := store.Incr("counter", 1); n != 1 {
+		t.Fatalf("expected an expired counter to start again at 0, got %d", n)
+	}
+}
+
+func TestMemoryStoreDel(t *testing.T) {
+	store := NewMemoryStore()
+	if err := store.Set("key", []byte("value"), 0); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Del("key"); err != nil {
+		t.Fatal(err)
+	}
+	if value, _ := store.Get("key"); value != nil {
+		t.Fatalf("expected the key to be deleted, got %q", value)
+	}
+	if err := store.Del("key"); err != nil {
+		t.Fatalf("expected deleting a missing key to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,105 @@
+// Package leakybuckettest provides a Storage for testing code that uses leaky buckets without
+// waiting on the real clock: its time only moves when the test advances it.
+package leakybuckettest
+
+import (
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/leakybucket/memory"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Epoch is the time the clocks of New and NewLeaky start at.
+var Epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Clock is a leakybucket.Clock whose time only moves when it is advanced or set. It is safe for
+// concurrent use.
+type Clock struct {
+	mutex sync.Mutex
+	now   time.Time
+}
+
+// NewClock returns a clock stopped at start.
+func NewClock(start time.Time) *Clock {
+	return &Clock{now: start}
+}
+
+// Now returns the clock's time.
+func (c *Clock) Now() time.Time {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.now
+}
+
+// Advance moves the clock forward by d, or back if d is negative.
+func (c *Clock) Advance(d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Set moves the clock to t.
+func (c *Clock) Set(t time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.now = t
+}
+
+// Storage is an in-memory storage whose buckets read the time from Clock alone, so that a
+// test drives their windows with Advance instead of sleeping.
+type Storage struct {
+	*memory.Storage
+	Clock *Clock
+}
+
+// New returns a storage of fixed window buckets whose clock starts at Epoch.
+func New() *Storage {
+	return on(memory.New())
+}
+
+// NewLeaky returns a storage of buckets that drip like those of memory.NewLeaky, whose clock
+// starts at Epoch.
+func NewLeaky() *Storage {
+	return on(memory.NewLeaky())
+}
+
+func on(s *memory.Storage) *Storage {
+	clock := NewClock(Epoch)
+	s.SetClock(clock)
+	return &Storage{Storage: s, Clock: clock}
+}
+
+// Advance moves the storage's clock forward by d.
+func (s *Storage) Advance(d time.Duration) {
+	s.Clock.Advance(d)
+}
+
+// Now returns the time of the storage's clock.
+func (s *Storage) Now() time.Time {
+	return s.Clock.Now()
+}
+
+// AssertRemaining fails t unless bucket has expected remaining, refreshing its state first.
+func AssertRemaining(t testing.TB, bucket leakybucket.Bucket, expected uint) {
+	t.Helper()
+	state, err := bucket.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != expected {
+		t.Fatalf("expected %d remaining, got %d", expected, state.Remaining)
+	}
+}
+
+// AssertReset fails t unless bucket resets at expected, refreshing its state first.
+func AssertReset(t testing.TB, bucket leakybucket.Bucket, expected time.Time) {
+	t.Helper()
+	state, err := bucket.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !state.Reset.Equal(expected) {
+		t.Fatalf("expected reset at %s, got %s", expected, state.Reset)
+	}
+}
@@ -0,0 +1,54 @@
+package leakybuckettest
+
+import (
+	"errors"
+	"github.com/bububa/leakybucket"
+	"testing"
+	"time"
+)
+
+func TestStorage(t *testing.T) {
+	s := New()
+	bucket, err := s.Create("testbucket", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	AssertReset(t, bucket, Epoch.Add(time.Minute))
+	if _, err := bucket.Add(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+	s.Advance(59 * time.Second)
+	AssertRemaining(t, bucket, 0)
+	s.Advance(2 * time.Second)
+	AssertRemaining(t, bucket, 2)
+	AssertReset(t, bucket, s.Now().Add(time.Minute))
+}
+
+func TestLeakyStorage(t *testing.T) {
+	s := NewLeaky()
+	bucket, err := s.Create("testbucket", 10, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(10); err != nil {
+		t.Fatal(err)
+	}
+	s.Advance(3 * time.Second)
+	AssertRemaining(t, bucket, 3)
+	AssertReset(t, bucket, Epoch.Add(10*time.Second))
+}
+
+func TestClock(t *testing.T) {
+	clock := NewClock(Epoch)
+	clock.Advance(time.Hour)
+	if now := clock.Now(); !now.Equal(Epoch.Add(time.Hour)) {
+		t.Fatalf("expected %s, got %s", Epoch.Add(time.Hour), now)
+	}
+	clock.Set(Epoch)
+	if now := clock.Now(); !now.Equal(Epoch) {
+		t.Fatalf("expected %s, got %s", Epoch, now)
+	}
+}
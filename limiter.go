@@ -0,0 +1,119 @@
+package leakybucket
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultCacheSize is how many buckets a RateLimiter keeps handles to, unless changed with
+// SetCacheSize.
+const DefaultCacheSize = 1024
+
+// RateLimiter limits named keys, such as user IDs or client addresses, to the same capacity
+// per rate, creating the bucket of each key in its storage as needed. It is the simplest way to
+// use the package: limiting a request takes a single call with its key.
+//
+// It keeps the handles of the buckets it created, up to its cache size, so that it doesn't
+// create a bucket on every call. Handles share the state of their bucket in the storage, but a
+// bucket removed from the storage by other means than Remove, such as by memory.Storage's
+// Clean, is only forgotten by the limiter once its cache fills up. A RateLimiter is safe for
+// concurrent use.
+type RateLimiter struct {
+	storage   Storage
+	capacity  uint
+	rate      time.Duration
+	cacheSize int
+
+	// mutex guards buckets.
+	mutex   sync.Mutex
+	buckets map[string]Bucket
+}
+
+// NewRateLimiter returns a limiter of keys to capacity per rate, keeping their buckets in s.
+// It returns ErrorInvalidParams if buckets of capacity and rate would always be full.
+func NewRateLimiter(s Storage, capacity uint, rate time.Duration) (*RateLimiter, error) {
+	if err := ValidateParams(capacity, rate); err != nil {
+		return nil, err
+	}
+	return &RateLimiter{
+		storage:   s,
+		capacity:  capacity,
+		rate:      rate,
+		cacheSize: DefaultCacheSize,
+		buckets:   make(map[string]Bucket),
+	}, nil
+}
+
+// SetCacheSize changes how many bucket handles the limiter keeps. Once that many are kept, it
+// drops them all and starts over. A size that isn't positive keeps none.
+func (l *RateLimiter) SetCacheSize(size int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.cacheSize = size
+	if len(l.buckets) > size {
+		l.buckets = make(map[string]Bucket)
+	}
+}
+
+// Allow reports whether a request of key fits in its bucket, consuming 1 from it if so.
+func (l *RateLimiter) Allow(key string) bool {
+	return l.AllowN(key, 1)
+}
+
+// AllowN reports whether n fits in the bucket of key, consuming it if so. It fails closed: an
+// error of the storage is reported as a rejection. Use Take to tell them apart.
+func (l *RateLimiter) AllowN(key string, n uint) bool {
+	ok, _, err := l.Take(key, n)
+	return ok && err == nil
+}
+
+// Take adds n to the bucket of key, reporting whether it fit along with the bucket's state,
+// which tells a rejected request when to retry. A full bucket is not an error: err is only set
+// when the storage fails or n is over the capacity.
+func (l *RateLimiter) Take(key string, n uint) (bool, BucketState, error) {
+	bucket, err := l.bucket(key)
+	if err != nil {
+		return false, BucketState{}, err
+	}
+	state, ok, err := bucket.TryAdd(n)
+	return ok, state, err
+}
+
+// Remove removes the bucket of key from the limiter and its storage, so that its next request
+// starts at full capacity.
+func (l *RateLimiter) Remove(key string) error {
+	l.mutex.Lock()
+	delete(l.buckets, key)
+	l.mutex.Unlock()
+	return l.storage.Remove(key)
+}
+
+// bucket returns the kept handle to the bucket of key, creating it if there is none.
+func (l *RateLimiter) bucket(key string) (Bucket, error) {
+	l.mutex.Lock()
+	bucket, ok := l.buckets[key]
+	l.mutex.Unlock()
+	if ok {
+		return bucket, nil
+	}
+
+	// Create the bucket without holding the mutex, so that a slow storage doesn't hold up the
+	// requests of other keys.
+	bucket, err := l.storage.Create(key, l.capacity, l.rate)
+	if err != nil {
+		return nil, err
+	}
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if kept, ok := l.buckets[key]; ok {
+		// A concurrent request created it first.
+		return kept, nil
+	}
+	if l.cacheSize > 0 {
+		if len(l.buckets) >= l.cacheSize {
+			l.buckets = make(map[string]Bucket)
+		}
+		l.buckets[key] = bucket
+	}
+	return bucket, nil
+}
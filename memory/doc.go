@@ -1,4 +1,21 @@
 // Package memory provides a leaky bucket implementation backed by an in-memory data store.
 //
-// Usage: TODO
+// A Storage made by New holds fixed window counters: each bucket accepts up to its capacity
+// until its reset, a rate after its window started, then refills all at once. A burst arriving
+// at the end of one window and another at the start of the next can therefore take twice the
+// capacity within a rate.
+//
+// For a limit of a burst followed by a steady rate, such as a burst of 50 then 10 per second,
+// create a token bucket with CreateRate:
+//
+//	bucket, err := memory.New().CreateRate("user1", 10, 50)
+//
+// It starts full with 50 tokens, and as adds take them, drips them back at 10 per second, a
+// fraction of a token at a time, up to 50 again. An idle client may then burst 50 requests at
+// once, but a busy one gets no more than 10 per second. A Storage made by NewLeaky creates such
+// buckets from Create, with capacity as the burst and rate as the time to drip all of it back.
+//
+// For a minimum interval between requests rather than a count, create a cooldown with
+// CreateCooldown, which accepts an add only once interval has passed since the last one it
+// accepted.
 package memory
@@ -0,0 +1,57 @@
+package memory
+
+import (
+	"math"
+	"time"
+)
+
+// leak credits back the tokens that have dripped out of a leaky bucket since it last leaked.
+func (b *bucket) leak(now time.Time) {
+	if now.Before(b.leaked) {
+		// The clock stepped back; drip from now rather than once it catches up again.
+		b.leaked = now
+		b.reset = b.drainedAt()
+		return
+	}
+	if !now.After(b.leaked) {
+		return
+	}
+	if b.remaining >= b.capacity || now.Sub(b.leaked) >= b.rate {
+		b.remaining = b.capacity
+		b.leaked = now
+	} else {
+		tokens := uint(float64(now.Sub(b.leaked)) / float64(b.rate) * float64(b.capacity))
+		if tokens == 0 {
+			return
+		}
+		b.remaining = min(b.remaining+tokens, b.capacity)
+		if b.remaining == b.capacity {
+			b.leaked = now
+		} else {
+			// Only advance by the time the credited tokens took, so partial drips carry over.
+			b.leaked = b.leaked.Add(b.dripTime(tokens))
+		}
+	}
+	b.reset = b.drainedAt()
+}
+
+// dripTime returns how long n tokens take to drip out of the bucket.
+func (b *bucket) dripTime(n uint) time.Duration {
+	return time.Duration(float64(b.rate) * float64(n) / float64(b.capacity))
+}
+
+// dripWait returns how long from now until n more tokens will have dripped out of a leaky bucket
+// that has just leaked, counting the partial drip it carries over.
+func (b *bucket) dripWait(n uint, now time.Time) time.Duration {
+	// Round up, since leak rounds the tokens dripped down.
+	drip := time.Duration(math.Ceil(float64(b.rate) * float64(n) / float64(b.capacity)))
+	return b.leaked.Add(drip).Sub(now)
+}
+
+// drainedAt returns when a leaky bucket will have dripped back to full.
+func (b *bucket) drainedAt() time.Time {
+	if b.remaining >= b.capacity {
+		return b.leaked
+	}
+	return b.leaked.Add(b.dripTime(b.capacity - b.remaining))
+}
@@ -0,0 +1,57 @@
+package memory
+
+import (
+	"container/list"
+	"sync"
+)
+
+// lru orders bucket names from most to least recently updated. Its mutex is only ever taken
+// innermost, so buckets may touch it while holding their own lock.
+type lru struct {
+	mutex    sync.Mutex
+	order    *list.List
+	elements map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{
+		order:    list.New(),
+		elements: make(map[string]*list.Element),
+	}
+}
+
+// push records a new name as the most recently updated.
+func (l *lru) push(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.elements[name] = l.order.PushFront(name)
+}
+
+// touch marks name as the most recently updated, if it is still tracked.
+func (l *lru) touch(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if e, ok := l.elements[name]; ok {
+		l.order.MoveToFront(e)
+	}
+}
+
+func (l *lru) remove(name string) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if e, ok := l.elements[name]; ok {
+		l.order.Remove(e)
+		delete(l.elements, name)
+	}
+}
+
+// oldest returns the least recently updated name.
+func (l *lru) oldest() (string, bool) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	e := l.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
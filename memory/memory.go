@@ -1,95 +1,767 @@
 package memory
 
 import (
+	"context"
+	"errors"
 	"github.com/bububa/leakybucket"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type bucket struct {
+	name      string
 	capacity  uint
 	remaining uint
 	reset     time.Time
 	rate      time.Duration
 	updated   time.Time
+	clock     leakybucket.Clock
+	mutex     sync.Mutex
+
+	// leaky buckets drip tokens back continuously instead of refilling at reset.
+	leaky  bool
+	leaked time.Time
+
+	// lru is the storage's recency list, if it bounds the number of buckets.
+	lru *lru
+
+	hooks *leakybucket.Hooks
 }
 
 func (b *bucket) Capacity() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.capacity
 }
 
+// Name returns the name the bucket was created with.
+func (b *bucket) Name() string {
+	return b.name
+}
+
 // Remaining space in the bucket.
 func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.remaining
 }
 
 // Reset returns when the bucket will be drained.
 func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.reset
 }
 
+// Rate returns how long it takes for the bucket's full capacity to drain.
+func (b *bucket) Rate() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.rate
+}
+
+// WindowStart returns when the bucket's current window started, its reset minus its rate, so
+// that callers can align their own logic to the same window edges. The buckets of NewLeaky and
+// CreateRate drip continuously rather than have windows, so theirs is only when a bucket
+// dripping since would be full again by its reset.
+func (b *bucket) WindowStart() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset.Add(-b.rate)
+}
+
+// LastSync returns the current time: the bucket is its own store, so its state is never stale.
+func (b *bucket) LastSync() time.Time {
+	return b.clock.Now()
+}
+
+func (b *bucket) state() leakybucket.BucketState {
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
 // Add to the bucket.
 func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
-	b.updated = time.Now()
-	if time.Now().After(b.reset) {
-		b.reset = time.Now().Add(b.rate)
+	b.mutex.Lock()
+	state, err := b.add(amount)
+	b.mutex.Unlock()
+	// Call the hooks without holding the mutex, so that they may use the bucket.
+	b.hooks.Observe(b.name, state, err)
+	return state, err
+}
+
+// refresh starts a new window if the current one is over. A window never ends more than its
+// rate after now, so that if the clock steps back, such as for an NTP correction, the window
+// still ends within its rate rather than once the clock catches up again.
+func (b *bucket) refresh(now time.Time) {
+	if b.leaky {
+		b.leak(now)
+		return
+	}
+	if now.After(b.reset) {
+		b.reset = now.Add(b.rate)
 		b.remaining = b.capacity
+	} else if b.reset.Sub(now) > b.rate {
+		b.reset = now.Add(b.rate)
+	}
+}
+
+// touch records that the bucket was updated at now.
+func (b *bucket) touch(now time.Time) {
+	b.updated = now
+	if b.lru != nil {
+		b.lru.touch(b.name)
+	}
+}
+
+func (b *bucket) add(amount uint) (leakybucket.BucketState, error) {
+	now := b.clock.Now()
+	if amount == 0 {
+		// Adding nothing is a read: refresh the bucket as Peek does, without it counting as an
+		// update.
+		b.refresh(now)
+		return b.state(), nil
+	}
+	b.touch(now)
+	b.refresh(now)
+	return b.take(amount)
+}
+
+// take removes amount from the remaining space, if it fits.
+func (b *bucket) take(amount uint) (leakybucket.BucketState, error) {
+	if amount > b.capacity {
+		return b.state(), leakybucket.ErrorOverCapacity
 	}
 	if amount > b.remaining {
-		return leakybucket.BucketState{b.capacity, b.remaining, b.reset}, leakybucket.ErrorFull
+		return b.state(), leakybucket.NewFullError(b.state())
 	}
 	b.remaining -= amount
-	return leakybucket.BucketState{b.capacity, b.remaining, b.reset}, nil
+	if b.leaky {
+		b.reset = b.drainedAt()
+	}
+	return b.state(), nil
+}
+
+// AddWithCapacity adds to the bucket, accepting the amount if it fits in tempCapacity minus
+// what the bucket has consumed.
+func (b *bucket) AddWithCapacity(amount, tempCapacity uint) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	var state leakybucket.BucketState
+	var err error
+	if now := b.clock.Now(); amount == 0 {
+		// Adding nothing is a read, as for Add.
+		b.refresh(now)
+		state = b.state()
+	} else {
+		b.touch(now)
+		b.refresh(now)
+		state, err = b.takeWithCapacity(amount, tempCapacity)
+	}
+	b.mutex.Unlock()
+	b.hooks.Observe(b.name, state, err)
+	return state, err
+}
+
+// takeWithCapacity removes amount from the remaining space, down to none, if it fits in
+// tempCapacity minus what has been consumed.
+func (b *bucket) takeWithCapacity(amount, tempCapacity uint) (leakybucket.BucketState, error) {
+	if amount > tempCapacity {
+		return b.state(), leakybucket.ErrorOverCapacity
+	}
+	consumed := b.capacity - b.remaining
+	if consumed > tempCapacity-amount {
+		return b.state(), leakybucket.NewFullError(b.state())
+	}
+	b.remaining -= min(amount, b.remaining)
+	if b.leaky {
+		b.reset = b.drainedAt()
+	}
+	return b.state(), nil
+}
+
+// TryAdd adds to the bucket, reporting whether the amount fit rather than returning ErrorFull.
+func (b *bucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	return leakybucket.TryAdd(b, amount)
+}
+
+// TakeUpTo adds as much of amount to the bucket as fits, returning how much it added.
+func (b *bucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.clock.Now()
+	b.touch(now)
+	b.refresh(now)
+	granted := min(amount, b.remaining)
+	state, err := b.take(granted)
+	return granted, state, err
+}
+
+// AddContext adds to the bucket unless ctx is already done.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	state, err := b.addContext(ctx, amount)
+	b.mutex.Unlock()
+	b.hooks.Observe(b.name, state, err)
+	return state, err
+}
+
+func (b *bucket) addContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	if err := ctx.Err(); err != nil {
+		return b.state(), err
+	}
+	return b.add(amount)
 }
 
 func (b *bucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
-	b.updated = time.Now()
+	b.mutex.Lock()
+	state, err := b.addWithTime(amount, t)
+	b.mutex.Unlock()
+	b.hooks.Observe(b.name, state, err)
+	return state, err
+}
+
+// addWithTime adds to the bucket as if at t. Adds may come with their times out of order, such
+// as when replaying events, so one from before the current window counts against it rather
+// than rewinding its reset, unless nothing was added in the window yet.
+func (b *bucket) addWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	now := b.clock.Now()
+	b.touch(now)
+	if b.leaky {
+		// Dripping from a time before the last drip would credit back its tokens twice.
+		if t.After(b.leaked) {
+			b.leak(t)
+		}
+		return b.take(amount)
+	}
+	b.refresh(now)
 	if t.After(b.reset) {
 		b.reset = t.Add(b.rate)
 		b.remaining = b.capacity
-	}
-	if t.Before(b.reset.Add(-1 * b.rate)) {
+	} else if t.Before(b.reset.Add(-b.rate)) && b.remaining == b.capacity && t.Add(b.rate).After(now) {
+		// The window is untouched, so start it at t instead, as long as that one isn't over.
 		b.reset = t.Add(b.rate)
 	}
-	if amount > b.remaining {
-		return leakybucket.BucketState{b.capacity, b.remaining, b.reset}, leakybucket.ErrorFull
+	return b.take(amount)
+}
+
+// Peek returns the bucket's state without adding to it.
+func (b *bucket) Peek() (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.refresh(b.clock.Now())
+	return b.state(), nil
+}
+
+// WouldAccept reports whether adding amount would fit, without adding it.
+func (b *bucket) WouldAccept(amount uint) (bool, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return amount <= b.refreshed(b.clock.Now()).remaining, nil
+}
+
+// TimeToAvailable returns how long until adding amount would fit, or zero if it would fit now,
+// so that a client can schedule its retry rather than poll. A leaky bucket waits for the tokens
+// it is missing to drip back, and any other bucket for its reset. An amount over the capacity
+// never fits, so it gets the time until the bucket is back to full.
+func (b *bucket) TimeToAvailable(amount uint) time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.clock.Now()
+	c := b.refreshed(now)
+	if amount <= c.remaining {
+		return 0
 	}
-	b.remaining -= amount
-	return leakybucket.BucketState{b.capacity, b.remaining, b.reset}, nil
+	wait := c.reset.Sub(now)
+	if c.leaky && amount <= c.capacity {
+		wait = c.dripWait(amount-c.remaining, now)
+	}
+	if wait < 0 {
+		return 0
+	}
+	return wait
+}
+
+// refreshed returns a copy of the bucket refreshed at now, so that reading it doesn't count as
+// an update. The caller must hold b.mutex.
+func (b *bucket) refreshed(now time.Time) *bucket {
+	c := &bucket{
+		capacity:  b.capacity,
+		remaining: b.remaining,
+		reset:     b.reset,
+		rate:      b.rate,
+		leaky:     b.leaky,
+		leaked:    b.leaked,
+	}
+	c.refresh(now)
+	return c
 }
 
-// Storage is a non thread-safe in-memory leaky bucket factory.
+// SetRemaining sets the remaining space in the bucket, up to its capacity.
+func (b *bucket) SetRemaining(n uint) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.clock.Now()
+	b.touch(now)
+	b.refresh(now)
+	b.remaining = min(n, b.capacity)
+	if b.leaky {
+		b.reset = b.drainedAt()
+	}
+	return nil
+}
+
+// Refund gives back amount to the bucket, up to its capacity.
+func (b *bucket) Refund(amount uint) (leakybucket.BucketState, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.clock.Now()
+	b.touch(now)
+	b.refresh(now)
+	b.remaining += min(amount, b.capacity-b.remaining)
+	if b.leaky {
+		b.reset = b.drainedAt()
+	}
+	return b.state(), nil
+}
+
+// Drain the bucket.
+func (b *bucket) Drain() error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.touch(b.clock.Now())
+	b.reset = b.updated.Add(b.rate)
+	b.remaining = b.capacity
+	if b.leaky {
+		b.leaked = b.updated
+		b.reset = b.updated
+	}
+	return nil
+}
+
+func (b *bucket) lastUpdated() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.updated
+}
+
+// Storage is a thread-safe in-memory leaky bucket factory.
 type Storage struct {
 	buckets map[string]*bucket
+	clock   leakybucket.Clock
+	mutex   sync.Mutex
+	leaky   bool
+
+	// maxIdle is how long a bucket may go without updates before it is cleaned.
+	maxIdle time.Duration
+
+	// jitter randomizes the rate of each bucket created, within plus or minus it.
+	jitter time.Duration
+
+	// maxBuckets bounds len(buckets) if it is positive, evicting by lru.
+	maxBuckets int
+	lru        *lru
+
+	hooks *leakybucket.Hooks
+
+	// onEvict is called with the buckets that Clean, CleanExpired and lru evict, if it is set.
+	onEvict func(name string, final leakybucket.BucketState)
 }
 
+// DefaultMaxIdle is how long a bucket may go without updates before Clean removes it, unless
+// changed with SetMaxIdle.
+const DefaultMaxIdle = time.Hour
+
 // New initializes the in-memory bucket store.
 func New() *Storage {
 	return &Storage{
 		buckets: make(map[string]*bucket),
+		clock:   leakybucket.RealClock{},
+		maxIdle: DefaultMaxIdle,
 	}
 }
 
+// NewLeaky initializes an in-memory store of true leaky buckets. Rather than refilling all at
+// once when the reset time passes, each bucket drips capacity tokens back evenly over every
+// rate, and its reset time is when it will have dripped back to full.
+func NewLeaky() *Storage {
+	s := New()
+	s.leaky = true
+	return s
+}
+
+// NewWithMaxBuckets initializes an in-memory bucket store that holds at most n buckets. Creating
+// a bucket beyond that evicts the least recently updated one.
+func NewWithMaxBuckets(n int) *Storage {
+	s := New()
+	s.maxBuckets = n
+	s.lru = newLRU()
+	return s
+}
+
+// SetClock makes the storage and the buckets it creates read the time from clock instead of
+// the system clock. Call it before creating any buckets.
+func (s *Storage) SetClock(clock leakybucket.Clock) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.clock = clock
+}
+
+// SetHooks makes the buckets created by the storage afterwards call hooks on adds.
+func (s *Storage) SetHooks(hooks leakybucket.Hooks) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.hooks = &hooks
+}
+
+// SetOnEvict makes the storage call onEvict with the name and final state of each bucket it
+// evicts: those that Clean, CleanExpired and the background cleaner remove for being idle, and
+// those that creating or importing a bucket pushes out of a storage of NewWithMaxBuckets. It can
+// persist their state to a cold store, say, or count them. Remove and RemovePrefix don't call
+// it. It is called after the storage is unlocked, so it may use the storage, but the bucket may
+// then be created again before it has run. Nil, the default, calls nothing.
+func (s *Storage) SetOnEvict(onEvict func(name string, final leakybucket.BucketState)) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.onEvict = onEvict
+}
+
+// SetMaxIdle sets how long a bucket may go without updates before Clean, CleanExpired and the
+// background cleaner remove it.
+func (s *Storage) SetMaxIdle(maxIdle time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.maxIdle = maxIdle
+}
+
+// SetJitter makes each bucket created afterwards get a window length chosen at random within
+// its rate plus or minus jitter, so that buckets created in a burst don't all reset at once.
+// It doesn't apply to the buckets of NewLeaky, which refill continuously.
+func (s *Storage) SetJitter(jitter time.Duration) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.jitter = jitter
+}
+
 // Create a bucket.
 func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, _, err := s.CreateOrGet(name, capacity, rate)
+	return b, err
+}
+
+// CreateOrGet creates a bucket like Create, also reporting whether the bucket is new.
+func (s *Storage) CreateOrGet(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, bool, error) {
+	return s.createOrGet(name, capacity, rate, s.leaky)
+}
+
+var errTokensPerSecond = errors.New("tokens per second must be positive")
+
+// CreateRate creates a token bucket that holds up to burst tokens and refills continuously at
+// tokensPerSecond, which may be fractional, such as 2.5 per second. Partial tokens accumulate
+// between adds. The bucket drips like those of NewLeaky, whatever kind of storage s is, so it
+// allows a burst then a steady rate, as the package documentation describes.
+func (s *Storage) CreateRate(name string, tokensPerSecond float64, burst uint) (leakybucket.Bucket, error) {
+	if tokensPerSecond <= 0 {
+		return nil, errTokensPerSecond
+	}
+	b, _, err := s.createOrGet(name, burst, leakybucket.TokenRate(tokensPerSecond, burst), true)
+	return b, err
+}
+
+// CreateCooldown creates a bucket accepting at most one add per interval, such as one request
+// every 30 seconds per key. Unlike a bucket of capacity 1 from Create, whose window starts when
+// it is created, it rejects any add within interval of the last one it accepted, reporting that
+// plus interval as its Reset. It drips like those of NewLeaky, whatever kind of storage s is.
+func (s *Storage) CreateCooldown(name string, interval time.Duration) (leakybucket.Bucket, error) {
+	b, _, err := s.createOrGet(name, 1, interval, true)
+	return b, err
+}
+
+func (s *Storage) createOrGet(name string, capacity uint, rate time.Duration, leaky bool) (leakybucket.Bucket, bool, error) {
+	if err := leakybucket.ValidateParams(capacity, rate); err != nil {
+		return nil, false, err
+	}
+	var evicted []*bucket
+	var onEvict func(string, leakybucket.BucketState)
+	defer func() { notifyEvicted(onEvict, evicted) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	onEvict = s.onEvict
 	b, ok := s.buckets[name]
 	if ok {
-		return b, nil
+		return b, false, nil
+	}
+	now := s.clock.Now()
+	if !leaky {
+		rate = leakybucket.JitterRate(rate, s.jitter)
 	}
 	b = &bucket{
 		capacity:  capacity,
 		remaining: capacity,
-		reset:     time.Now().Add(rate),
+		reset:     now.Add(rate),
 		rate:      rate,
-		updated:   time.Now(),
+		updated:   now,
+		clock:     s.clock,
+		leaky:     leaky,
+		leaked:    now,
+		name:      name,
+		lru:       s.lru,
+		hooks:     s.hooks,
+	}
+	if b.leaky {
+		b.reset = now
+	}
+	evicted = s.insert(b)
+	return b, true, nil
+}
+
+// insert adds a bucket, evicting the least recently updated ones if that puts the storage over
+// its maximum, and returns those. The caller must hold s.mutex.
+func (s *Storage) insert(b *bucket) []*bucket {
+	s.buckets[b.name] = b
+	var evicted []*bucket
+	if s.lru != nil {
+		s.lru.push(b.name)
+		for len(s.buckets) > s.maxBuckets {
+			oldest, ok := s.lru.oldest()
+			if !ok {
+				break
+			}
+			evicted = s.evict(oldest, evicted)
+		}
+	}
+	return evicted
+}
+
+// evict removes the named bucket, appending it to evicted. The caller must hold s.mutex.
+func (s *Storage) evict(name string, evicted []*bucket) []*bucket {
+	if b, ok := s.buckets[name]; ok {
+		evicted = append(evicted, b)
 	}
-	s.buckets[name] = b
-	return b, nil
+	s.remove(name)
+	return evicted
 }
 
+// notifyEvicted calls onEvict, unless it is nil, with each evicted bucket and its state. The
+// caller must not hold the storage's mutex, so that onEvict can use the storage.
+func notifyEvicted(onEvict func(string, leakybucket.BucketState), evicted []*bucket) {
+	if onEvict == nil {
+		return
+	}
+	for _, b := range evicted {
+		state, _ := b.Peek()
+		onEvict(b.name, state)
+	}
+}
+
+// Update changes the capacity and rate of the named bucket, creating it if it doesn't exist.
+// The amount already consumed in the current window is kept, so growing the capacity adds
+// remaining space and shrinking it takes space away, down to none. The current window keeps
+// its start but is stretched or shortened to the new rate.
+//
+// Shrinking the capacity below the amount consumed clamps the consumption to the new capacity:
+// the bucket is full until its window ends, and the excess is forgotten rather than carried
+// over, so growing the capacity again doesn't bring it back. UpdateClamping reports when this
+// happens.
+func (s *Storage) Update(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, _, err := s.UpdateClamping(name, capacity, rate)
+	return b, err
+}
+
+// UpdateClamping updates a bucket like Update, also reporting whether the new capacity was
+// below the amount the bucket had consumed, so that the consumption was clamped to it. A
+// capacity just equal to it leaves the bucket full without clamping anything.
+func (s *Storage) UpdateClamping(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, bool, error) {
+	b, created, err := s.CreateOrGet(name, capacity, rate)
+	if err != nil || created {
+		return b, false, err
+	}
+	return b, b.(*bucket).update(capacity, rate), nil
+}
+
+// update changes the bucket's capacity and rate, reporting whether its consumption was clamped.
+func (b *bucket) update(capacity uint, rate time.Duration) bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	now := b.clock.Now()
+	b.touch(now)
+	b.refresh(now)
+	consumed := b.capacity - b.remaining
+	b.remaining = capacity - min(consumed, capacity)
+	b.capacity = capacity
+	if b.leaky {
+		b.rate = rate
+		b.reset = b.drainedAt()
+	} else {
+		b.reset = b.reset.Add(rate - b.rate)
+		b.rate = rate
+	}
+	return consumed > capacity
+}
+
+// remove deletes a bucket. The caller must hold s.mutex.
+func (s *Storage) remove(name string) {
+	delete(s.buckets, name)
+	if s.lru != nil {
+		s.lru.remove(name)
+	}
+}
+
+// AddMulti adds to several buckets, creating them as needed. The returned states and errors
+// correspond to requests by index.
+func (s *Storage) AddMulti(requests []leakybucket.Request) ([]leakybucket.BucketState, []error) {
+	states := make([]leakybucket.BucketState, len(requests))
+	errs := make([]error, len(requests))
+	for i, r := range requests {
+		b, err := s.Create(r.Name, r.Capacity, r.Rate)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		states[i], errs[i] = b.Add(r.Amount)
+	}
+	return states, errs
+}
+
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *Storage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
+}
+
+// Remove a bucket.
+func (s *Storage) Remove(name string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.remove(name)
+	return nil
+}
+
+// RemovePrefix removes every bucket whose name starts with prefix, returning how many it
+// removed.
+func (s *Storage) RemovePrefix(prefix string) (int, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	removed := 0
+	for name := range s.buckets {
+		if strings.HasPrefix(name, prefix) {
+			s.remove(name)
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// Len returns how many buckets the storage holds, including any idle ones not yet cleaned.
+func (s *Storage) Len() int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return len(s.buckets)
+}
+
+// Names returns the names of the buckets the storage holds, sorted.
+func (s *Storage) Names() []string {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	names := make([]string, 0, len(s.buckets))
+	for name := range s.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Range calls fn with the name and state of each bucket the storage holds, in order of name,
+// until fn returns false, such as to list the limits on an admin page. Buckets whose window is
+// over count as refilled, without being read counting as an update to them. The states are all
+// read under the storage's lock before fn is first called, so fn may use the storage, but sees
+// the buckets as they were when Range was called.
+func (s *Storage) Range(fn func(name string, state leakybucket.BucketState) bool) {
+	s.mutex.Lock()
+	names := make([]string, 0, len(s.buckets))
+	states := make(map[string]leakybucket.BucketState, len(s.buckets))
+	for name, b := range s.buckets {
+		b.mutex.Lock()
+		states[name] = b.refreshed(b.clock.Now()).state()
+		b.mutex.Unlock()
+		names = append(names, name)
+	}
+	s.mutex.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		if !fn(name, states[name]) {
+			return
+		}
+	}
+}
+
+// FullBuckets returns the names of the buckets that have nothing remaining, sorted, such as to
+// tell which tenants are being limited during an incident. Buckets whose window is over count
+// as refilled, without the check counting as an update to them.
+func (s *Storage) FullBuckets() ([]string, error) {
+	var names []string
+	s.Range(func(name string, state leakybucket.BucketState) bool {
+		if state.Remaining == 0 {
+			names = append(names, name)
+		}
+		return true
+	})
+	return names, nil
+}
+
+func (b *bucket) stale(maxIdle time.Duration) bool {
+	return b.lastUpdated().Before(b.clock.Now().Add(-1 * maxIdle))
+}
+
+// Clean removes the named bucket if it has been idle for longer than the max idle duration.
 func (s *Storage) Clean(name string) {
+	var evicted []*bucket
+	s.mutex.Lock()
+	if b, ok := s.buckets[name]; ok && b.stale(s.maxIdle) {
+		evicted = s.evict(name, evicted)
+	}
+	onEvict := s.onEvict
+	s.mutex.Unlock()
+	notifyEvicted(onEvict, evicted)
+}
+
+// CleanExpired removes every bucket that has been idle for longer than the max idle duration.
+func (s *Storage) CleanExpired() {
+	var evicted []*bucket
+	s.mutex.Lock()
 	for name, b := range s.buckets {
-		if b.updated.Before(time.Now().Add(-1 * time.Hour)) {
-			delete(s.buckets, name)
+		if b.stale(s.maxIdle) {
+			evicted = s.evict(name, evicted)
+		}
+	}
+	onEvict := s.onEvict
+	s.mutex.Unlock()
+	notifyEvicted(onEvict, evicted)
+}
+
+// StartCleaner starts a goroutine that calls CleanExpired every interval. The returned stop
+// function halts the goroutine and waits for it to exit; call it when done with the storage,
+// e.g. at the end of a test, so the goroutine doesn't leak.
+func (s *Storage) StartCleaner(interval time.Duration) (stop func()) {
+	ticker := time.NewTicker(interval)
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-ticker.C:
+				s.CleanExpired()
+			case <-done:
+				return
+			}
 		}
+	}()
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-stopped
+		})
 	}
 }
@@ -1,26 +1,85 @@
 package memory
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
 	"github.com/bububa/leakybucket"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func TestCreate(t *testing.T) {
 	leakybucket.CreateTest(New())(t)
 }
 
+func TestCreateMulti(t *testing.T) {
+	leakybucket.CreateMultiTest(New())(t)
+}
+
+func TestInvalidParams(t *testing.T) {
+	leakybucket.InvalidParamsTest(New())(t)
+}
+
 func TestAdd(t *testing.T) {
 	leakybucket.AddTest(New())(t)
 }
 
+func TestAddZero(t *testing.T) {
+	leakybucket.AddZeroTest(New())(t)
+}
+
+func TestAddOverCapacity(t *testing.T) {
+	leakybucket.AddOverCapacityTest(New())(t)
+}
+
+func TestTryAdd(t *testing.T) {
+	leakybucket.TryAddTest(New())(t)
+}
+
+func TestAddWithCapacity(t *testing.T) {
+	leakybucket.AddWithCapacityTest(New())(t)
+}
+
+func TestFullError(t *testing.T) {
+	leakybucket.FullErrorTest(New())(t)
+}
+
+func TestAddDetailed(t *testing.T) {
+	leakybucket.AddDetailedTest(New())(t)
+}
+
+func TestAllow(t *testing.T) {
+	leakybucket.AllowTest(New())(t)
+}
+
+func TestTakeUpTo(t *testing.T) {
+	leakybucket.TakeUpToTest(New())(t)
+}
+
+func TestAddMulti(t *testing.T) {
+	leakybucket.AddMultiTest(New())(t)
+}
+
 func TestThreadSafeAdd(t *testing.T) {
 	leakybucket.ThreadSafeAddTest(New())(t)
 }
 
+func TestConcurrentCapacity(t *testing.T) {
+	leakybucket.ConcurrentCapacityTest(New())(t)
+}
+
 func TestReset(t *testing.T) {
 	leakybucket.AddResetTest(New())(t)
 }
 
+func TestShortRate(t *testing.T) {
+	leakybucket.ShortRateTest(New())(t)
+}
+
 func TestFindOrCreate(t *testing.T) {
 	leakybucket.FindOrCreateTest(New())(t)
 }
@@ -28,3 +87,1147 @@ func TestFindOrCreate(t *testing.T) {
 func TestBucketInstanceConsistencyTest(t *testing.T) {
 	leakybucket.BucketInstanceConsistencyTest(New())(t)
 }
+
+func TestAddContext(t *testing.T) {
+	leakybucket.AddContextTest(New())(t)
+}
+
+func TestAddWithTime(t *testing.T) {
+	leakybucket.AddWithTimeTest(New())(t)
+}
+
+func TestPeek(t *testing.T) {
+	leakybucket.PeekTest(New())(t)
+}
+
+func TestWouldAccept(t *testing.T) {
+	leakybucket.WouldAcceptTest(New())(t)
+}
+
+func TestHooks(t *testing.T) {
+	leakybucket.HooksTest(New())(t)
+}
+
+func TestRemove(t *testing.T) {
+	leakybucket.RemoveTest(New())(t)
+}
+
+func TestRemovePrefix(t *testing.T) {
+	leakybucket.RemovePrefixTest(New())(t)
+}
+
+func TestSetRemaining(t *testing.T) {
+	leakybucket.SetRemainingTest(New())(t)
+}
+
+func TestDrain(t *testing.T) {
+	leakybucket.DrainTest(New())(t)
+}
+
+func TestRefund(t *testing.T) {
+	leakybucket.RefundTest(New())(t)
+}
+
+func TestAddHierarchical(t *testing.T) {
+	leakybucket.AddHierarchicalTest(New())(t)
+}
+
+func TestName(t *testing.T) {
+	s := New()
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := bucket.(interface{ Name() string }).Name(); name != "testbucket" {
+		t.Fatalf("expected name %q, got %q", "testbucket", name)
+	}
+	if bucket, err = s.CreateRate("ratebucket", 1, 10); err != nil {
+		t.Fatal(err)
+	}
+	if name := bucket.(interface{ Name() string }).Name(); name != "ratebucket" {
+		t.Fatalf("expected name %q, got %q", "ratebucket", name)
+	}
+}
+
+func TestAddWithTimeOutOfOrder(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := clock.now
+	var last time.Time
+	add := func(elapsed, at time.Duration, remaining uint) {
+		t.Helper()
+		clock.now = start.Add(elapsed)
+		state, err := bucket.AddWithTime(1, start.Add(at))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Remaining != remaining {
+			t.Fatalf("expected %d remaining, got %d", remaining, state.Remaining)
+		}
+		if !state.Reset.After(clock.now) {
+			t.Fatalf("expected a reset after now, got %v before it", clock.now.Sub(state.Reset))
+		}
+		if state.Reset.Before(last) {
+			t.Fatalf("expected the reset not to move back, got %v before the last one", last.Sub(state.Reset))
+		}
+		last = state.Reset
+	}
+	add(0, 0, 9)
+	// Adds from before the window, however old, count against it.
+	add(10*time.Second, -30*time.Second, 8)
+	add(10*time.Second, -2*time.Hour, 7)
+	// Once the window is over, an add from it starts a fresh window at its time.
+	add(70*time.Second, 50*time.Second, 9)
+	if !last.Equal(start.Add(110 * time.Second)) {
+		t.Fatalf("expected the window to start at the add, got a reset %v after the start", last.Sub(start))
+	}
+	add(75*time.Second, 40*time.Second, 8)
+	add(75*time.Second, 65*time.Second, 7)
+}
+
+func TestLeakyAddWithTimeOutOfOrder(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := NewLeaky()
+	s.SetClock(clock)
+	bucket, err := s.Create("testbucket", 2, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.AddWithTime(1, clock.now.Add(-time.Hour)); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+	// The old add didn't make the bucket drip from an hour ago.
+	if state, err := bucket.Peek(); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := clock.now
+	windowStart := func() time.Time {
+		return bucket.(interface{ WindowStart() time.Time }).WindowStart()
+	}
+	if !windowStart().Equal(start) {
+		t.Fatalf("expected the window to start at creation, got %v", windowStart().Sub(start))
+	}
+	clock.now = start.Add(90 * time.Second)
+	if _, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	}
+	if !windowStart().Equal(clock.now) {
+		t.Fatalf("expected the next window to start at the add, got %v", windowStart().Sub(clock.now))
+	}
+}
+
+func TestCreateOrGet(t *testing.T) {
+	s := New()
+	if _, created, err := s.CreateOrGet("testbucket", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if !created {
+		t.Fatal("expected first CreateOrGet to create the bucket")
+	}
+	if _, created, err := s.CreateOrGet("testbucket", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if created {
+		t.Fatal("expected second CreateOrGet to get the existing bucket")
+	}
+}
+
+func TestConcurrentCreateAndClean(t *testing.T) {
+	s := New()
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			bucket, err := s.Create(fmt.Sprintf("testbucket%d", i%5), 10, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := bucket.Add(1); err != nil && !errors.Is(err, leakybucket.ErrorFull) {
+				t.Error(err)
+			}
+			bucket.Remaining()
+			bucket.Reset()
+			s.CleanExpired()
+		}(i)
+	}
+	wg.Wait()
+}
+
+func createStale(t *testing.T, s *Storage, name string) {
+	b, err := s.Create(name, 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.(*bucket).mutex.Lock()
+	defer b.(*bucket).mutex.Unlock()
+	b.(*bucket).updated = time.Now().Add(-2 * time.Hour)
+}
+
+func TestAddZeroNotAnUpdate(t *testing.T) {
+	s := New()
+	createStale(t, s, "stale")
+	b, err := s.Create("stale", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := b.Add(0); err != nil {
+		t.Fatal(err)
+	}
+	s.Clean("stale")
+	if _, ok := s.buckets["stale"]; ok {
+		t.Fatal("expected adding nothing not to keep the bucket from being cleaned")
+	}
+}
+
+func TestCleanOnlyNamed(t *testing.T) {
+	s := New()
+	createStale(t, s, "stale1")
+	createStale(t, s, "stale2")
+	if _, err := s.Create("fresh", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	s.Clean("stale1")
+	if _, ok := s.buckets["stale1"]; ok {
+		t.Fatal("expected stale1 to be cleaned")
+	}
+	if _, ok := s.buckets["stale2"]; !ok {
+		t.Fatal("expected stale2 to be kept")
+	}
+
+	s.Clean("fresh")
+	if _, ok := s.buckets["fresh"]; !ok {
+		t.Fatal("expected fresh bucket to be kept")
+	}
+}
+
+func TestCleanExpired(t *testing.T) {
+	s := New()
+	createStale(t, s, "stale1")
+	createStale(t, s, "stale2")
+	if _, err := s.Create("fresh", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	s.CleanExpired()
+	if len(s.buckets) != 1 {
+		t.Fatalf("expected 1 bucket after cleaning, got %d", len(s.buckets))
+	}
+	if _, ok := s.buckets["fresh"]; !ok {
+		t.Fatal("expected fresh bucket to be kept")
+	}
+}
+
+func TestLenAndNames(t *testing.T) {
+	s := New()
+	if s.Len() != 0 || len(s.Names()) != 0 {
+		t.Fatalf("expected no buckets, got %d: %v", s.Len(), s.Names())
+	}
+	for _, name := range []string{"b", "c", "a", "b"} {
+		if _, err := s.Create(name, 10, time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if s.Len() != 3 {
+		t.Fatalf("expected %d buckets, got %d", 3, s.Len())
+	}
+	if names := s.Names(); fmt.Sprint(names) != "[a b c]" {
+		t.Fatalf("expected names [a b c], got %v", names)
+	}
+	if err := s.Remove("b"); err != nil {
+		t.Fatal(err)
+	}
+	if names := s.Names(); s.Len() != 2 || fmt.Sprint(names) != "[a c]" {
+		t.Fatalf("expected names [a c] after removing b, got %d: %v", s.Len(), names)
+	}
+}
+
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func TestClockReset(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	bucket, err := s.Create("testbucket", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bucket.Reset().Equal(clock.now.Add(time.Minute)) {
+		t.Fatalf("expected reset at %s, got %s", clock.now.Add(time.Minute), bucket.Reset())
+	}
+	if _, err := bucket.Add(2); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(30 * time.Second)
+	if _, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+	clock.now = clock.now.Add(31 * time.Second)
+	if state, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 1 {
+		t.Fatalf("expected %d remaining, got %d", 1, state.Remaining)
+	} else if !state.Reset.Equal(clock.now.Add(time.Minute)) {
+		t.Fatalf("expected reset at %s, got %s", clock.now.Add(time.Minute), state.Reset)
+	}
+}
+
+func TestClockStepBack(t *testing.T) {
+	for _, s := range []*Storage{New(), NewLeaky()} {
+		clock := &fakeClock{now: time.Now()}
+		s.SetClock(clock)
+		bucket, err := s.Create("testbucket", 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(2); err != nil {
+			t.Fatal(err)
+		}
+		clock.now = clock.now.Add(-time.Hour)
+		if state, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+			t.Fatalf("expected ErrorFull after the clock stepped back, received %v", err)
+		} else if state.Reset.After(clock.now.Add(time.Minute)) {
+			t.Fatalf("expected reset by %s, got %s", clock.now.Add(time.Minute), state.Reset)
+		}
+		clock.now = clock.now.Add(time.Minute + time.Millisecond)
+		if _, err := bucket.Add(1); err != nil {
+			t.Fatalf("expected the bucket to have room a minute after the step, received %v", err)
+		}
+	}
+}
+
+func TestLeakyAdd(t *testing.T) {
+	leakybucket.AddTest(NewLeaky())(t)
+}
+
+func TestLeakyThreadSafeAdd(t *testing.T) {
+	leakybucket.ThreadSafeAddTest(NewLeaky())(t)
+}
+
+func TestLeakyPeek(t *testing.T) {
+	leakybucket.PeekTest(NewLeaky())(t)
+}
+
+func TestLeakyWouldAccept(t *testing.T) {
+	leakybucket.WouldAcceptTest(NewLeaky())(t)
+}
+
+func TestLeakyDrain(t *testing.T) {
+	leakybucket.DrainTest(NewLeaky())(t)
+}
+
+func TestCreateRate(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	if _, err := s.CreateRate("testbucket", 0, 5); err == nil {
+		t.Fatal("expected an error creating a bucket with no rate")
+	}
+	bucket, err := s.CreateRate("testbucket", 2.5, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := clock.now
+	if _, err := bucket.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+
+	expectRemaining := func(remaining uint) {
+		if state, err := bucket.Peek(); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != remaining {
+			t.Fatalf("expected %d remaining, got %d", remaining, state.Remaining)
+		}
+	}
+	// 2.5 tokens per second is a token every 400ms, with the half tokens carried over.
+	clock.now = start.Add(300 * time.Millisecond)
+	expectRemaining(0)
+	clock.now = start.Add(time.Second)
+	expectRemaining(2)
+	clock.now = start.Add(1200 * time.Millisecond)
+	expectRemaining(3)
+	clock.now = start.Add(time.Minute)
+	expectRemaining(5)
+}
+
+// A burst of 50 then a steady 10 per second.
+func TestCreateRateBurstThenSteady(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	bucket, err := s.CreateRate("testbucket", 10, 50)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := clock.now
+	for i := 0; i < 50; i++ {
+		if _, err := bucket.Add(1); err != nil {
+			t.Fatalf("burst request %d: %v", i+1, err)
+		}
+	}
+	if _, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull after the burst, received %v", err)
+	}
+	accepted := 0
+	for clock.now = start; clock.now.Before(start.Add(10 * time.Second)); clock.now = clock.now.Add(10 * time.Millisecond) {
+		if _, ok, err := bucket.TryAdd(1); err != nil {
+			t.Fatal(err)
+		} else if ok {
+			accepted++
+		}
+	}
+	if accepted < 99 || accepted > 100 {
+		t.Fatalf("expected 10 per second over 10s after the burst, accepted %d", accepted)
+	}
+}
+
+func TestCreateCooldown(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	bucket, err := s.CreateCooldown("testbucket", 30*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := clock.now
+	expectReset := func(state leakybucket.BucketState, reset time.Duration) {
+		t.Helper()
+		if !state.Reset.Equal(start.Add(reset)) {
+			t.Fatalf("expected reset %v after the start, got %v", reset, state.Reset.Sub(start))
+		}
+	}
+	// The cooldown starts from the first add rather than from when the bucket was created.
+	clock.now = start.Add(20 * time.Second)
+	state, err := bucket.Add(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectReset(state, 50*time.Second)
+	for _, elapsed := range []time.Duration{20 * time.Second, 35 * time.Second, 49 * time.Second} {
+		clock.now = start.Add(elapsed)
+		state, err := bucket.Add(1)
+		if !errors.Is(err, leakybucket.ErrorFull) {
+			t.Fatalf("expected ErrorFull %v after the start, received %v", elapsed, err)
+		}
+		// Rejected adds don't push the cooldown back.
+		expectReset(state, 50*time.Second)
+	}
+	clock.now = start.Add(50 * time.Second)
+	if state, err = bucket.Add(1); err != nil {
+		t.Fatal(err)
+	}
+	expectReset(state, 80*time.Second)
+}
+
+func TestExportImport(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	for name, amount := range map[string]uint{"used": 3, "full": 5} {
+		bucket, err := s.Create(name, 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.now = clock.now.Add(30 * time.Second)
+	if _, err := s.Create("short", 5, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := s.Export(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.now = clock.now.Add(10 * time.Second)
+	restored := New()
+	restored.SetClock(clock)
+	if err := restored.Import(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := restored.buckets["short"]; ok {
+		t.Fatal("expected the bucket that has since reset to be dropped")
+	}
+	for name, remaining := range map[string]uint{"used": 2, "full": 0} {
+		bucket, created, err := restored.CreateOrGet(name, 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if created {
+			t.Fatalf("expected %s to be restored", name)
+		}
+		if bucket.Remaining() != remaining {
+			t.Fatalf("%s: expected %d remaining, got %d", name, remaining, bucket.Remaining())
+		}
+		original, _ := s.Create(name, 5, time.Minute)
+		if !bucket.Reset().Equal(original.Reset()) {
+			t.Fatalf("%s: expected reset at %s, got %s", name, original.Reset(), bucket.Reset())
+		}
+	}
+}
+
+func TestImportInvalid(t *testing.T) {
+	s := New()
+	if _, err := s.Create("existing", 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	reset := time.Now().Add(time.Minute).Format(time.RFC3339Nano)
+	for _, export := range []string{
+		`[{"name":"valid","capacity":5,"remaining":5,"reset":"` + reset + `","rate":60000000000},
+		  {"name":"existing","capacity":0,"remaining":0,"reset":"` + reset + `","rate":60000000000}]`,
+		`[{"name":"existing","capacity":5,"remaining":5,"reset":"` + reset + `","rate":0}]`,
+	} {
+		if err := s.Import(strings.NewReader(export)); err != leakybucket.ErrorInvalidParams {
+			t.Fatalf("expected ErrorInvalidParams importing %s, received %v", export, err)
+		}
+	}
+	if _, ok := s.buckets["valid"]; ok {
+		t.Fatal("expected an invalid export to restore none of its buckets")
+	}
+	if b := s.buckets["existing"]; b == nil || b.capacity != 5 {
+		t.Fatal("expected an invalid export to leave the existing buckets")
+	}
+}
+
+func TestJitter(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	s.SetJitter(10 * time.Second)
+	resets := make(map[time.Time]bool)
+	for i := 0; i < 20; i++ {
+		bucket, err := s.Create(fmt.Sprintf("testbucket%d", i), 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		reset := bucket.Reset()
+		if reset.Before(clock.now.Add(50*time.Second)) || reset.After(clock.now.Add(70*time.Second)) {
+			t.Fatalf("expected a reset within 10s of a minute from now, got %s", reset.Sub(clock.now))
+		}
+		resets[reset] = true
+	}
+	if len(resets) < 2 {
+		t.Fatal("expected buckets created together to reset at different times")
+	}
+}
+
+func TestLeakyDrip(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := NewLeaky()
+	s.SetClock(clock)
+	bucket, err := s.Create("testbucket", 10, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := clock.now
+	if _, err := bucket.Add(10); err != nil {
+		t.Fatal(err)
+	}
+	if !bucket.Reset().Equal(start.Add(10 * time.Second)) {
+		t.Fatalf("expected reset at %s, got %s", start.Add(10*time.Second), bucket.Reset())
+	}
+
+	expectRemaining := func(remaining uint) {
+		if state, err := bucket.Peek(); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != remaining {
+			t.Fatalf("expected %d remaining, got %d", remaining, state.Remaining)
+		}
+	}
+	clock.now = start.Add(3 * time.Second)
+	expectRemaining(3)
+	// Partial drips are not lost between refreshes.
+	clock.now = start.Add(3500 * time.Millisecond)
+	expectRemaining(3)
+	clock.now = start.Add(4 * time.Second)
+	expectRemaining(4)
+
+	if _, err := bucket.Add(5); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+	if state, err := bucket.Add(4); err != nil {
+		t.Fatal(err)
+	} else if !state.Reset.Equal(start.Add(14 * time.Second)) {
+		t.Fatalf("expected reset at %s, got %s", start.Add(14*time.Second), state.Reset)
+	}
+
+	clock.now = start.Add(time.Minute)
+	expectRemaining(10)
+}
+
+func TestTimeToAvailable(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := NewLeaky()
+	s.SetClock(clock)
+	b, err := s.Create("testbucket", 10, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaky := b.(*bucket)
+	start := clock.now
+	if _, err := leaky.Add(10); err != nil {
+		t.Fatal(err)
+	}
+	for _, test := range []struct {
+		after  time.Duration
+		amount uint
+		wait   time.Duration
+	}{
+		{0, 0, 0},
+		{0, 3, 3 * time.Second},
+		{2500 * time.Millisecond, 3, 500 * time.Millisecond},
+		{2500 * time.Millisecond, 2, 0},
+		{2500 * time.Millisecond, 11, 7500 * time.Millisecond},
+	} {
+		clock.now = start.Add(test.after)
+		if wait := leaky.TimeToAvailable(test.amount); wait != test.wait {
+			t.Fatalf("%d after %s: expected a wait of %s, got %s", test.amount, test.after, test.wait, wait)
+		}
+	}
+
+	// Asking doesn't count as an update.
+	if updated := leaky.lastUpdated(); !updated.Equal(start) {
+		t.Fatalf("expected the bucket last updated at %s, got %s", start, updated)
+	}
+
+	fixed := New()
+	fixed.SetClock(clock)
+	w, err := fixed.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Add(8); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(20 * time.Second)
+	if wait := w.(*bucket).TimeToAvailable(3); wait != 40*time.Second {
+		t.Fatalf("expected a wait of %s until the reset, got %s", 40*time.Second, wait)
+	}
+}
+
+func TestMaxBuckets(t *testing.T) {
+	s := NewWithMaxBuckets(2)
+	a, err := s.Create("a", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("b", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := a.Add(1); err != nil {
+		t.Fatal(err)
+	}
+
+	// b is now the least recently updated, so it makes room for c.
+	if _, err := s.Create("c", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.buckets) != 2 {
+		t.Fatalf("expected %d buckets, got %d", 2, len(s.buckets))
+	}
+	if _, ok := s.buckets["b"]; ok {
+		t.Fatal("expected b to be evicted")
+	}
+	if _, ok := s.buckets["a"]; !ok {
+		t.Fatal("expected a to be kept")
+	}
+
+	// Removed buckets don't linger in the recency order.
+	if err := s.Remove("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("d", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.buckets) != 2 || s.buckets["c"] == nil || s.buckets["d"] == nil {
+		t.Fatalf("expected buckets c and d, got %v", s.buckets)
+	}
+}
+
+func TestMaxBucketsThreadSafeAdd(t *testing.T) {
+	leakybucket.ThreadSafeAddTest(NewWithMaxBuckets(10))(t)
+}
+
+func TestStartCleaner(t *testing.T) {
+	s := New()
+	stop := s.StartCleaner(time.Millisecond)
+	defer stop()
+	createStale(t, s, "stale")
+	if _, err := s.Create("fresh", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second)
+	for {
+		s.mutex.Lock()
+		_, stale := s.buckets["stale"]
+		_, fresh := s.buckets["fresh"]
+		s.mutex.Unlock()
+		if !fresh {
+			t.Fatal("expected fresh bucket to be kept")
+		}
+		if !stale {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("expected cleaner to remove the stale bucket")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	stop()
+	stop() // stopping twice is harmless
+	createStale(t, s, "stale")
+	time.Sleep(5 * time.Millisecond)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if _, ok := s.buckets["stale"]; !ok {
+		t.Fatal("expected stopped cleaner to leave buckets alone")
+	}
+}
+
+func TestSetMaxIdle(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	s.SetMaxIdle(time.Second)
+	if _, err := s.Create("idle", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(500 * time.Millisecond)
+	if _, err := s.Create("active", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.now = clock.now.Add(600 * time.Millisecond)
+	s.CleanExpired()
+	if _, ok := s.buckets["idle"]; ok {
+		t.Fatal("expected idle bucket to be cleaned")
+	}
+	if _, ok := s.buckets["active"]; !ok {
+		t.Fatal("expected active bucket to be kept")
+	}
+}
+
+func TestOnEvict(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := NewWithMaxBuckets(2)
+	s.SetClock(clock)
+	s.SetMaxIdle(time.Second)
+	evicted := map[string]uint{}
+	s.SetOnEvict(func(name string, final leakybucket.BucketState) {
+		// The storage is unlocked, so the callback can use it.
+		if s.Len() > 2 {
+			t.Errorf("expected at most 2 buckets, got %d", s.Len())
+		}
+		evicted[name] = final.Remaining
+	})
+	for i, name := range []string{"first", "second", "third"} {
+		bucket, err := s.Create(name, 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(uint(i + 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if fmt.Sprint(evicted) != "map[first:9]" {
+		t.Fatalf("expected the least recently updated bucket to be evicted, got %v", evicted)
+	}
+
+	clock.now = clock.now.Add(2 * time.Second)
+	s.Clean("second")
+	s.CleanExpired()
+	if fmt.Sprint(evicted) != "map[first:9 second:8 third:7]" {
+		t.Fatalf("expected the idle buckets to be evicted, got %v", evicted)
+	}
+
+	// Removing a bucket isn't an eviction.
+	if _, err := s.Create("removed", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Remove("removed"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := evicted["removed"]; ok {
+		t.Fatal("expected Remove not to call OnEvict")
+	}
+}
+
+func TestUpdate(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	start := clock.now
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(6); err != nil {
+		t.Fatal(err)
+	}
+
+	expect := func(capacity, remaining uint, reset time.Time) {
+		if bucket.Capacity() != capacity {
+			t.Fatalf("expected capacity %d, got %d", capacity, bucket.Capacity())
+		}
+		if bucket.Remaining() != remaining {
+			t.Fatalf("expected %d remaining, got %d", remaining, bucket.Remaining())
+		}
+		if !bucket.Reset().Equal(reset) {
+			t.Fatalf("expected reset at %s, got %s", reset, bucket.Reset())
+		}
+	}
+
+	// Growing keeps the 6 consumed.
+	if _, err := s.Update("testbucket", 20, 2*time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expect(20, 14, start.Add(2*time.Minute))
+
+	// Shrinking below the consumed amount leaves nothing remaining.
+	if _, err := s.Update("testbucket", 4, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expect(4, 0, start.Add(time.Minute))
+	if _, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+
+	// Updating a bucket that doesn't exist creates it.
+	other, err := s.Update("otherbucket", 3, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Capacity() != 3 || other.Remaining() != 3 {
+		t.Fatalf("expected a fresh bucket of 3, got %d of %d remaining", other.Remaining(), other.Capacity())
+	}
+}
+
+func TestUpdateClamping(t *testing.T) {
+	for _, newStorage := range []func() *Storage{New, NewLeaky} {
+		clock := &fakeClock{now: time.Now()}
+		s := newStorage()
+		s.SetClock(clock)
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(6); err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range []struct {
+			capacity, remaining uint
+			clamped             bool
+		}{
+			{8, 2, false},
+			// Exactly the consumed amount leaves the bucket full, without clamping.
+			{6, 0, false},
+			// Below it, the 6 consumed are clamped to 4.
+			{4, 0, true},
+			// Growing again keeps the 4 left consumed by clamping, not the original 6.
+			{10, 6, false},
+		} {
+			updated, clamped, err := s.UpdateClamping("testbucket", test.capacity, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if clamped != test.clamped {
+				t.Fatalf("updating to %d: expected clamped %v, got %v", test.capacity, test.clamped, clamped)
+			}
+			if updated.Capacity() != test.capacity || updated.Remaining() != test.remaining {
+				t.Fatalf("updating to %d: expected %d of %d remaining, got %d of %d", test.capacity,
+					test.remaining, test.capacity, updated.Remaining(), updated.Capacity())
+			}
+		}
+
+		// A new bucket is never clamped.
+		if _, clamped, err := s.UpdateClamping("otherbucket", 1, time.Minute); err != nil {
+			t.Fatal(err)
+		} else if clamped {
+			t.Fatal("expected creating a bucket not to clamp it")
+		}
+	}
+}
+
+func TestHooksError(t *testing.T) {
+	s := New()
+	var names []string
+	s.SetHooks(leakybucket.Hooks{
+		OnError: func(name string, state leakybucket.BucketState, err error) {
+			if err != context.Canceled {
+				t.Errorf("expected context.Canceled, got %v", err)
+			}
+			names = append(names, name)
+		},
+	})
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bucket.AddContext(ctx, 1); err != context.Canceled {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if len(names) != 1 || names[0] != "testbucket" {
+		t.Fatalf("expected OnError for testbucket, got %v", names)
+	}
+
+	// A hook may use the bucket it is called for.
+	s.SetHooks(leakybucket.Hooks{
+		OnAllow: func(name string, state leakybucket.BucketState) {
+			if b, err := s.Create(name, 5, time.Minute); err != nil {
+				t.Error(err)
+			} else if _, err := b.Peek(); err != nil {
+				t.Error(err)
+			}
+		},
+	})
+	other, err := s.Create("otherbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := other.Add(1); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBucket64(t *testing.T) {
+	const kb = 1 << 10
+	bucket, err := leakybucket.CreateBucket64(New(), "testbucket", 10*kb+100, kb, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if capacity := bucket.Capacity(); capacity != 10*kb {
+		t.Fatalf("expected the capacity rounded down to %d, got %d", 10*kb, capacity)
+	}
+	if state, err := bucket.Add(kb + 1); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 8*kb {
+		t.Fatalf("expected the add rounded up, leaving %d remaining, got %d", 8*kb, state.Remaining)
+	}
+	if state, ok, err := bucket.TryAdd(8*kb + 1); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatalf("expected the add not to fit, with %d remaining", state.Remaining)
+	}
+	if state, err := bucket.Refund(kb + 1); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 10*kb {
+		t.Fatalf("expected %d remaining after the refund, got %d", 10*kb, state.Remaining)
+	}
+	if _, err := bucket.Add(^uint64(0)); !errors.Is(err, leakybucket.ErrorOverCapacity) {
+		t.Fatalf("expected ErrorOverCapacity, received %v", err)
+	}
+	if _, err := leakybucket.CreateBucket64(New(), "testbucket", 100, kb, time.Minute); err != leakybucket.ErrorInvalidParams {
+		t.Fatalf("expected ErrorInvalidParams for a capacity under a unit, received %v", err)
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	s := New()
+	limiter, err := leakybucket.NewRateLimiter(s, 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if !limiter.Allow("user1") {
+			t.Fatalf("expected request %d to be allowed", i+1)
+		}
+	}
+	if limiter.Allow("user1") {
+		t.Fatal("expected the fourth request to be rejected")
+	}
+	if !limiter.AllowN("user2", 3) {
+		t.Fatal("expected another key to have its own bucket")
+	}
+	if ok, state, err := limiter.Take("user2", 1); err != nil {
+		t.Fatal(err)
+	} else if ok || !state.Reset.After(time.Now()) {
+		t.Fatalf("expected a rejection with a reset in the future, got %v at %s", ok, state.Reset)
+	}
+	if ok, _, err := limiter.Take("user3", 4); ok || err != leakybucket.ErrorOverCapacity {
+		t.Fatalf("expected ErrorOverCapacity, received %v", err)
+	}
+
+	// The limiter shares the buckets of its storage.
+	bucket, err := s.Create("user1", 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := bucket.Remaining(); remaining != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, remaining)
+	}
+	if err := limiter.Remove("user1"); err != nil {
+		t.Fatal(err)
+	}
+	if !limiter.Allow("user1") {
+		t.Fatal("expected a removed key to start at full capacity")
+	}
+
+	limiter.SetCacheSize(0)
+	if !limiter.Allow("user4") || !limiter.Allow("user4") {
+		t.Fatal("expected requests to be allowed without caching")
+	}
+	if _, err := leakybucket.NewRateLimiter(s, 0, time.Minute); err != leakybucket.ErrorInvalidParams {
+		t.Fatalf("expected ErrorInvalidParams, received %v", err)
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	from, to := New(), New()
+	from.SetClock(clock)
+	to.SetClock(clock)
+	specs := []leakybucket.BucketSpec{
+		{Name: "used", Capacity: 10, Rate: time.Minute},
+		{Name: "full", Capacity: 5, Rate: time.Minute},
+		{Name: "empty", Capacity: 10, Rate: time.Minute},
+	}
+	start := clock.now
+	for i, amount := range []uint{3, 5} {
+		bucket, err := from.Create(specs[i].Name, specs[i].Capacity, specs[i].Rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The buckets in the new storage already used some, which the migration replaces.
+	if bucket, err := to.Create("empty", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if _, err := bucket.Add(4); err != nil {
+		t.Fatal(err)
+	}
+
+	clock.now = start.Add(20 * time.Second)
+	if err := leakybucket.Migrate(from, to, specs); err != nil {
+		t.Fatal(err)
+	}
+	for i, remaining := range []uint{7, 0, 10} {
+		name := specs[i].Name
+		bucket, err := to.Create(name, specs[i].Capacity, specs[i].Rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := bucket.Peek()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Remaining != remaining {
+			t.Fatalf("expected %d remaining in %s, got %d", remaining, name, state.Remaining)
+		}
+		if name != "empty" && !state.Reset.Equal(start.Add(time.Minute)) {
+			t.Fatalf("expected %s to keep its reset, got %v after the start", name, state.Reset.Sub(start))
+		}
+	}
+}
+
+func TestLastSync(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.now = clock.now.Add(time.Hour)
+	if synced := bucket.(leakybucket.Syncer).LastSync(); !synced.Equal(clock.now) {
+		t.Fatalf("expected a memory bucket to be always in sync, last synced at %s", synced)
+	}
+}
+
+func TestRange(t *testing.T) {
+	s := New()
+	for i, name := range []string{"c", "a", "b"} {
+		bucket, err := s.Create(name, 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(uint(i + 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var seen []string
+	s.Range(func(name string, state leakybucket.BucketState) bool {
+		seen = append(seen, fmt.Sprintf("%s:%d", name, state.Remaining))
+		// The callback can use the storage.
+		s.Len()
+		return true
+	})
+	if fmt.Sprint(seen) != "[a:3 b:2 c:4]" {
+		t.Fatalf("expected every bucket in order of name, got %v", seen)
+	}
+	seen = nil
+	s.Range(func(name string, state leakybucket.BucketState) bool {
+		seen = append(seen, name)
+		return false
+	})
+	if fmt.Sprint(seen) != "[a]" {
+		t.Fatalf("expected Range to stop once the callback returns false, got %v", seen)
+	}
+}
+
+func TestFullBuckets(t *testing.T) {
+	clock := &fakeClock{now: time.Now()}
+	s := New()
+	s.SetClock(clock)
+	for _, name := range []string{"c", "a", "b"} {
+		bucket, err := s.Create(name, 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amount := uint(2)
+		if name == "b" {
+			amount = 1
+		}
+		if _, err := bucket.Add(amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if full, err := s.FullBuckets(); err != nil {
+		t.Fatal(err)
+	} else if len(full) != 2 || full[0] != "a" || full[1] != "c" {
+		t.Fatalf("expected buckets a and c full, got %v", full)
+	}
+	clock.now = clock.now.Add(2 * time.Minute)
+	if full, err := s.FullBuckets(); err != nil {
+		t.Fatal(err)
+	} else if len(full) != 0 {
+		t.Fatalf("expected no bucket full once their windows are over, got %v", full)
+	}
+}
@@ -0,0 +1,84 @@
+package memory
+
+import (
+	"encoding/json"
+	"github.com/bububa/leakybucket"
+	"io"
+	"time"
+)
+
+// snapshot is the serialized form of a bucket.
+type snapshot struct {
+	Name      string        `json:"name"`
+	Capacity  uint          `json:"capacity"`
+	Remaining uint          `json:"remaining"`
+	Reset     time.Time     `json:"reset"`
+	Rate      time.Duration `json:"rate"`
+	Leaky     bool          `json:"leaky,omitempty"`
+	Leaked    time.Time     `json:"leaked,omitempty"`
+}
+
+// Export writes the state of every bucket to w as JSON, for Import to restore after a restart.
+func (s *Storage) Export(w io.Writer) error {
+	s.mutex.Lock()
+	snapshots := make([]snapshot, 0, len(s.buckets))
+	for _, b := range s.buckets {
+		b.mutex.Lock()
+		snapshots = append(snapshots, snapshot{
+			Name:      b.name,
+			Capacity:  b.capacity,
+			Remaining: b.remaining,
+			Reset:     b.reset,
+			Rate:      b.rate,
+			Leaky:     b.leaky,
+			Leaked:    b.leaked,
+		})
+		b.mutex.Unlock()
+	}
+	s.mutex.Unlock()
+	return json.NewEncoder(w).Encode(snapshots)
+}
+
+// Import restores the buckets written by Export from r, replacing any of the same name.
+// Buckets that have reset since they were exported are dropped, since creating them again
+// gives the same full bucket. It returns ErrorInvalidParams, restoring none of the buckets, if
+// one has a capacity or rate that Create would refuse, such as in a corrupt export.
+func (s *Storage) Import(r io.Reader) error {
+	var snapshots []snapshot
+	if err := json.NewDecoder(r).Decode(&snapshots); err != nil {
+		return err
+	}
+	for _, snap := range snapshots {
+		if err := leakybucket.ValidateParams(snap.Capacity, snap.Rate); err != nil {
+			return err
+		}
+	}
+
+	var evicted []*bucket
+	var onEvict func(string, leakybucket.BucketState)
+	defer func() { notifyEvicted(onEvict, evicted) }()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	onEvict = s.onEvict
+	now := s.clock.Now()
+	for _, snap := range snapshots {
+		if !snap.Reset.After(now) {
+			continue
+		}
+		s.remove(snap.Name)
+		evicted = append(evicted, s.insert(&bucket{
+			name:      snap.Name,
+			capacity:  snap.Capacity,
+			remaining: min(snap.Remaining, snap.Capacity),
+			reset:     snap.Reset,
+			rate:      snap.Rate,
+			updated:   now,
+			clock:     s.clock,
+			leaky:     snap.Leaky,
+			leaked:    snap.Leaked,
+			lru:       s.lru,
+			hooks:     s.hooks,
+		})...)
+	}
+	return nil
+}
@@ -0,0 +1,11 @@
+// Package metrics counts leaky bucket activity with Prometheus.
+//
+// Usage:
+//
+//	collector := metrics.NewCollector(nil)
+//	prometheus.MustRegister(collector)
+//	storage := collector.Wrap(memory.New())
+//
+// Buckets created through the wrapped storage count their adds, ErrorFull rejections and
+// backend errors, labeled by the prefix of the bucket name.
+package metrics
@@ -0,0 +1,154 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"github.com/bububa/leakybucket"
+	"github.com/prometheus/client_golang/prometheus"
+	"strings"
+	"time"
+)
+
+// DefaultPrefix labels a bucket by the part of its name before the first colon, so that
+// "user:123" and "user:456" are counted together as "user".
+func DefaultPrefix(name string) string {
+	if i := strings.Index(name, ":"); i >= 0 {
+		return name[:i]
+	}
+	return name
+}
+
+// Collector is a prometheus.Collector of counters for the buckets of the storages it wraps.
+type Collector struct {
+	prefix     func(name string) string
+	adds       *prometheus.CounterVec
+	rejections *prometheus.CounterVec
+	errors     *prometheus.CounterVec
+}
+
+// NewCollector returns a Collector labeling buckets by prefix(name). A nil prefix means
+// DefaultPrefix. The label should have few distinct values; don't label by full bucket names
+// such as per-user or per-IP keys.
+func NewCollector(prefix func(name string) string) *Collector {
+	if prefix == nil {
+		prefix = DefaultPrefix
+	}
+	labels := []string{"prefix"}
+	return &Collector{
+		prefix: prefix,
+		adds: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "leakybucket",
+			Name:      "adds_total",
+			Help:      "Number of adds to buckets.",
+		}, labels),
+		rejections: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "leakybucket",
+			Name:      "rejections_total",
+			Help:      "Number of adds rejected because the bucket was full.",
+		}, labels),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "leakybucket",
+			Name:      "errors_total",
+			Help:      "Number of adds that failed with an error other than a full bucket.",
+		}, labels),
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.adds.Describe(ch)
+	c.rejections.Describe(ch)
+	c.errors.Describe(ch)
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.adds.Collect(ch)
+	c.rejections.Collect(ch)
+	c.errors.Collect(ch)
+}
+
+// Wrap returns a storage whose buckets are counted by the collector.
+func (c *Collector) Wrap(storage leakybucket.Storage) leakybucket.Storage {
+	return &Storage{storage: storage, collector: c}
+}
+
+func (c *Collector) record(prefix string, err error) {
+	c.adds.WithLabelValues(prefix).Inc()
+	if errors.Is(err, leakybucket.ErrorFull) {
+		c.rejections.WithLabelValues(prefix).Inc()
+	} else if err != nil {
+		c.errors.WithLabelValues(prefix).Inc()
+	}
+}
+
+// Storage is a leakybucket.Storage whose buckets are counted by a Collector.
+type Storage struct {
+	storage   leakybucket.Storage
+	collector *Collector
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, err := s.storage.Create(name, capacity, rate)
+	if err != nil {
+		s.collector.errors.WithLabelValues(s.collector.prefix(name)).Inc()
+		return nil, err
+	}
+	return &bucket{Bucket: b, prefix: s.collector.prefix(name), collector: s.collector}, nil
+}
+
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *Storage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
+}
+
+// Remove a bucket.
+func (s *Storage) Remove(name string) error {
+	return s.storage.Remove(name)
+}
+
+// bucket counts the adds of the bucket it embeds.
+type bucket struct {
+	leakybucket.Bucket
+	prefix    string
+	collector *Collector
+}
+
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	state, err := b.Bucket.Add(amount)
+	b.collector.record(b.prefix, err)
+	return state, err
+}
+
+func (b *bucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	state, ok, err := b.Bucket.TryAdd(amount)
+	if err == nil && !ok {
+		b.collector.record(b.prefix, leakybucket.ErrorFull)
+	} else {
+		b.collector.record(b.prefix, err)
+	}
+	return state, ok, err
+}
+
+func (b *bucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	granted, state, err := b.Bucket.TakeUpTo(amount)
+	if err == nil && granted < amount {
+		b.collector.record(b.prefix, leakybucket.ErrorFull)
+	} else {
+		b.collector.record(b.prefix, err)
+	}
+	return granted, state, err
+}
+
+func (b *bucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	state, err := b.Bucket.AddWithTime(amount, t)
+	b.collector.record(b.prefix, err)
+	return state, err
+}
+
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	state, err := b.Bucket.AddContext(ctx, amount)
+	b.collector.record(b.prefix, err)
+	return state, err
+}
@@ -0,0 +1,85 @@
+package metrics
+
+import (
+	"errors"
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/leakybucket/memory"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"testing"
+	"time"
+)
+
+func TestCreate(t *testing.T) {
+	leakybucket.CreateTest(NewCollector(nil).Wrap(memory.New()))(t)
+}
+
+func TestAdd(t *testing.T) {
+	leakybucket.AddTest(NewCollector(nil).Wrap(memory.New()))(t)
+}
+
+func TestTryAdd(t *testing.T) {
+	leakybucket.TryAddTest(NewCollector(nil).Wrap(memory.New()))(t)
+}
+
+func TestRemove(t *testing.T) {
+	leakybucket.RemoveTest(NewCollector(nil).Wrap(memory.New()))(t)
+}
+
+func TestDefaultPrefix(t *testing.T) {
+	for name, prefix := range map[string]string{
+		"user:123":     "user",
+		"ip:1.2.3.4:0": "ip",
+		"global":       "global",
+	} {
+		if got := DefaultPrefix(name); got != prefix {
+			t.Fatalf("expected prefix %q of %q, got %q", prefix, name, got)
+		}
+	}
+}
+
+func TestCounters(t *testing.T) {
+	c := NewCollector(nil)
+	s := c.Wrap(memory.New())
+	a, err := s.Create("user:a", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := s.Create("user:b", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.Add(2)
+	a.Add(1)
+	b.TryAdd(3)
+	b.TryAdd(2)
+	b.TryAdd(1)
+
+	expect := func(name string, got, expected float64) {
+		if got != expected {
+			t.Fatalf("expected %s of %v, got %v", name, expected, got)
+		}
+	}
+	expect("adds", testutil.ToFloat64(c.adds.WithLabelValues("user")), 5)
+	expect("rejections", testutil.ToFloat64(c.rejections.WithLabelValues("user")), 2)
+	expect("errors", testutil.ToFloat64(c.errors.WithLabelValues("user")), 1)
+}
+
+type failingStorage struct{}
+
+func (failingStorage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	return nil, errors.New("storage is down")
+}
+
+func (failingStorage) Remove(name string) error {
+	return errors.New("storage is down")
+}
+
+func TestCreateError(t *testing.T) {
+	c := NewCollector(func(name string) string { return "all" })
+	if _, err := c.Wrap(failingStorage{}).Create("user:a", 2, time.Minute); err == nil {
+		t.Fatal("expected an error")
+	}
+	if errors := testutil.ToFloat64(c.errors.WithLabelValues("all")); errors != 1 {
+		t.Fatalf("expected %v errors, got %v", 1, errors)
+	}
+}
@@ -0,0 +1,112 @@
+package leakybucket
+
+import (
+	"context"
+	"time"
+)
+
+// NopStorage is a Storage whose buckets accept every add, such as to turn rate limiting off in
+// development or tests without changing the code using the storage. Its buckets always have
+// all of their capacity remaining, and reset a rate from their last read.
+type NopStorage struct{}
+
+// Create a bucket that accepts every add.
+func (NopStorage) Create(name string, capacity uint, rate time.Duration) (Bucket, error) {
+	if err := ValidateParams(capacity, rate); err != nil {
+		return nil, err
+	}
+	return nopBucket{name: name, capacity: capacity, rate: rate}, nil
+}
+
+// Remove does nothing, since the buckets have no state.
+func (NopStorage) Remove(name string) error {
+	return nil
+}
+
+// Allow reports that the add fit.
+func (s NopStorage) Allow(name string, capacity uint, rate time.Duration) (bool, BucketState, error) {
+	return Allow(s, name, capacity, rate)
+}
+
+type nopBucket struct {
+	name     string
+	capacity uint
+	rate     time.Duration
+}
+
+// Name returns the name the bucket was created with.
+func (b nopBucket) Name() string {
+	return b.name
+}
+
+func (b nopBucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket, which is always its capacity.
+func (b nopBucket) Remaining() uint {
+	return b.capacity
+}
+
+// Reset returns a rate from now.
+func (b nopBucket) Reset() time.Time {
+	return time.Now().Add(b.rate)
+}
+
+func (b nopBucket) Rate() time.Duration {
+	return b.rate
+}
+
+func (b nopBucket) State() BucketState {
+	return BucketState{Capacity: b.capacity, Remaining: b.capacity, Reset: b.Reset()}
+}
+
+// Add accepts any amount, even one above the capacity.
+func (b nopBucket) Add(amount uint) (BucketState, error) {
+	return b.State(), nil
+}
+
+func (b nopBucket) TryAdd(amount uint) (BucketState, bool, error) {
+	return b.State(), true, nil
+}
+
+// TakeUpTo grants all of amount.
+func (b nopBucket) TakeUpTo(amount uint) (uint, BucketState, error) {
+	return amount, b.State(), nil
+}
+
+// AddWithTime accepts any amount, resetting a rate after t.
+func (b nopBucket) AddWithTime(amount uint, t time.Time) (BucketState, error) {
+	state := b.State()
+	state.Reset = t.Add(b.rate)
+	return state, nil
+}
+
+// AddContext accepts any amount unless ctx is already done.
+func (b nopBucket) AddContext(ctx context.Context, amount uint) (BucketState, error) {
+	if err := ctx.Err(); err != nil {
+		return b.State(), err
+	}
+	return b.State(), nil
+}
+
+func (b nopBucket) Peek() (BucketState, error) {
+	return b.State(), nil
+}
+
+func (b nopBucket) WouldAccept(amount uint) (bool, error) {
+	return true, nil
+}
+
+// SetRemaining does nothing, since the bucket always has all of its capacity remaining.
+func (b nopBucket) SetRemaining(n uint) error {
+	return nil
+}
+
+func (b nopBucket) Refund(amount uint) (BucketState, error) {
+	return b.State(), nil
+}
+
+func (b nopBucket) Drain() error {
+	return nil
+}
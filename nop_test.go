@@ -0,0 +1,35 @@
+package leakybucket
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNopStorage(t *testing.T) {
+	var s Storage = NopStorage{}
+	bucket, err := s.Create("testbucket", 2, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if state, err := bucket.Add(2); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 2 {
+			t.Fatalf("expected %d remaining, got %d", 2, state.Remaining)
+		}
+	}
+	if _, err := bucket.Add(3); err != nil {
+		t.Fatalf("expected an add over capacity to fit, received %v", err)
+	}
+	if granted, _, err := bucket.TakeUpTo(5); err != nil {
+		t.Fatal(err)
+	} else if granted != 5 {
+		t.Fatalf("expected %d granted, got %d", 5, granted)
+	}
+	if reset := bucket.Reset(); reset.Before(time.Now().Add(59 * time.Second)) {
+		t.Fatalf("expected reset a minute from now, got %s", reset)
+	}
+	if _, err := s.Create("testbucket", 0, time.Minute); err != ErrorInvalidParams {
+		t.Fatalf("expected ErrorInvalidParams, received %v", err)
+	}
+}
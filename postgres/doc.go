@@ -0,0 +1,11 @@
+// Package postgres provides a leaky bucket implementation backed by PostgreSQL, for limits that
+// must survive restarts.
+//
+// Usage:
+//
+//	db, err := sql.Open("postgres", "postgres://localhost/app")
+//	...
+//	storage, err := postgres.New(db)
+//
+// Each bucket is a row in the leakybucket table, which New creates if it doesn't exist.
+package postgres
@@ -0,0 +1,311 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"github.com/bububa/leakybucket"
+	"sync"
+	"time"
+)
+
+const schema = `CREATE TABLE IF NOT EXISTS leakybucket (
+	name  text PRIMARY KEY,
+	count bigint NOT NULL,
+	reset timestamptz NOT NULL
+)`
+
+// addQuery adds $2 to the bucket named $1, starting a new window ending at $3 if the bucket
+// doesn't exist or its window ended by $4. It returns no row if the add exceeds capacity $5.
+const addQuery = `INSERT INTO leakybucket AS b (name, count, reset) VALUES ($1, $2, $3)
+ON CONFLICT (name) DO UPDATE SET
+	count = CASE WHEN b.reset <= $4 THEN EXCLUDED.count ELSE b.count + EXCLUDED.count END,
+	reset = CASE WHEN b.reset <= $4 THEN EXCLUDED.reset ELSE b.reset END
+WHERE b.reset <= $4 OR b.count + EXCLUDED.count <= $5
+RETURNING count, reset`
+
+// setQuery sets the count of the bucket named $1 to $2, starting a new window ending at $3 if
+// the bucket doesn't exist or its window ended by $4.
+const setQuery = `INSERT INTO leakybucket AS b (name, count, reset) VALUES ($1, $2, $3)
+ON CONFLICT (name) DO UPDATE SET
+	count = EXCLUDED.count,
+	reset = CASE WHEN b.reset <= $4 THEN EXCLUDED.reset ELSE b.reset END
+RETURNING reset`
+
+// refundQuery takes up to $2 off the count of the bucket named $1, if its window hasn't ended
+// by $3. It returns no row otherwise.
+const refundQuery = `UPDATE leakybucket SET count = GREATEST(count - $2, 0)
+WHERE name = $1 AND reset > $3
+RETURNING count, reset`
+
+const selectQuery = `SELECT count, reset FROM leakybucket WHERE name = $1`
+
+const deleteQuery = `DELETE FROM leakybucket WHERE name = $1`
+
+type bucket struct {
+	name                string
+	capacity, remaining uint
+	reset               time.Time
+	rate                time.Duration
+	db                  *sql.DB
+	clock               leakybucket.Clock
+	hooks               *leakybucket.Hooks
+
+	// mutex guards remaining and reset, which concurrent adds to the bucket update.
+	mutex sync.Mutex
+}
+
+func (b *bucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.remaining
+}
+
+// Reset returns when the bucket will be drained.
+func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset
+}
+
+// Rate returns how long it takes for the bucket's full capacity to drain.
+func (b *bucket) Rate() time.Duration {
+	return b.rate
+}
+
+func (b *bucket) State() leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
+// setState records the state of the bucket last read from the database, returning it.
+func (b *bucket) setState(remaining uint, reset time.Time) leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remaining, b.reset = remaining, reset
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: remaining, Reset: reset}
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(context.Background(), amount, b.clock.Now()))
+}
+
+// TryAdd adds to the bucket, reporting whether the amount fit rather than returning ErrorFull.
+func (b *bucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	return leakybucket.TryAdd(b, amount)
+}
+
+// TakeUpTo adds as much of amount to the bucket as fits, returning how much it added.
+func (b *bucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	state, err := b.Peek()
+	for err == nil {
+		granted := leakybucket.Min(amount, state.Remaining)
+		if granted == 0 {
+			return 0, state, nil
+		}
+		state, err = b.add(context.Background(), granted, b.clock.Now())
+		if err == nil {
+			return granted, state, nil
+		} else if errors.Is(err, leakybucket.ErrorFull) {
+			// Concurrent adds took some of the room since it was read; try again with the rest.
+			err = nil
+		}
+	}
+	return 0, state, err
+}
+
+// AddWithTime adds to the bucket as if at time t.
+func (b *bucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(context.Background(), amount, t))
+}
+
+// AddContext adds to the bucket, bounding the queries by ctx.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	return b.hooks.Notify(b.name)(b.add(ctx, amount, b.clock.Now()))
+}
+
+func (b *bucket) add(ctx context.Context, amount uint, now time.Time) (leakybucket.BucketState, error) {
+	if amount == 0 {
+		// Adding nothing is a read.
+		return b.peek(ctx)
+	}
+	if amount > b.capacity {
+		return b.State(), leakybucket.ErrorOverCapacity
+	}
+
+	tx, err := b.db.BeginTx(ctx, nil)
+	if err != nil {
+		return b.State(), err
+	}
+	defer tx.Rollback()
+
+	var count int64
+	var reset time.Time
+	full := false
+	err = tx.QueryRowContext(ctx, addQuery, b.name, amount, now.Add(b.rate), now, b.capacity).Scan(&count, &reset)
+	if err == sql.ErrNoRows {
+		// The add didn't fit; read the state it was refused against.
+		full = true
+		err = tx.QueryRowContext(ctx, selectQuery, b.name).Scan(&count, &reset)
+	}
+	if err != nil {
+		return b.State(), err
+	}
+	if err := tx.Commit(); err != nil {
+		return b.State(), err
+	}
+
+	state := b.setState(leakybucket.RemainingAfter(b.capacity, count), reset)
+	if full {
+		return state, leakybucket.NewFullError(state)
+	}
+	return state, nil
+}
+
+// Peek reads the bucket's state from database without adding to it.
+func (b *bucket) Peek() (leakybucket.BucketState, error) {
+	return b.peek(context.Background())
+}
+
+func (b *bucket) peek(ctx context.Context) (leakybucket.BucketState, error) {
+	remaining, reset, _, err := read(ctx, b.db, b.name, b.capacity, b.rate, b.clock.Now())
+	if err != nil {
+		return b.State(), err
+	}
+	return b.setState(remaining, reset), nil
+}
+
+// WouldAccept reports whether adding amount would fit, reading the bucket's state without
+// adding to it.
+func (b *bucket) WouldAccept(amount uint) (bool, error) {
+	state, err := b.Peek()
+	if err != nil {
+		return false, err
+	}
+	return amount <= state.Remaining, nil
+}
+
+// SetRemaining sets the remaining space in the bucket, up to its capacity, without changing
+// when it resets.
+func (b *bucket) SetRemaining(n uint) error {
+	remaining := leakybucket.Min(n, b.capacity)
+	now := b.clock.Now()
+	var reset time.Time
+	if err := b.db.QueryRow(setQuery, b.name, b.capacity-remaining, now.Add(b.rate), now).Scan(&reset); err != nil {
+		return err
+	}
+	b.setState(remaining, reset)
+	return nil
+}
+
+// Refund gives back amount to the bucket, up to its capacity, without changing when it resets.
+func (b *bucket) Refund(amount uint) (leakybucket.BucketState, error) {
+	now := b.clock.Now()
+	var count int64
+	var reset time.Time
+	err := b.db.QueryRow(refundQuery, b.name, int64(amount), now).Scan(&count, &reset)
+	if err == sql.ErrNoRows {
+		// There is nothing in the bucket to give back.
+		return b.setState(b.capacity, now.Add(b.rate)), nil
+	} else if err != nil {
+		return b.State(), err
+	}
+	return b.setState(leakybucket.RemainingAfter(b.capacity, count), reset), nil
+}
+
+// Drain the bucket by deleting its row.
+func (b *bucket) Drain() error {
+	if _, err := b.db.Exec(deleteQuery, b.name); err != nil {
+		return err
+	}
+	b.setState(b.capacity, b.clock.Now().Add(b.rate))
+	return nil
+}
+
+// read returns the remaining space and reset time of the named bucket as of now, and whether
+// it has a row.
+func read(ctx context.Context, db *sql.DB, name string, capacity uint, rate time.Duration, now time.Time) (uint, time.Time, bool, error) {
+	var count int64
+	var reset time.Time
+	err := db.QueryRowContext(ctx, selectQuery, name).Scan(&count, &reset)
+	if err == sql.ErrNoRows {
+		return capacity, now.Add(rate), false, nil
+	} else if err != nil {
+		return 0, time.Time{}, false, err
+	} else if !reset.After(now) {
+		return capacity, now.Add(rate), true, nil
+	}
+	return leakybucket.RemainingAfter(capacity, count), reset, true, nil
+}
+
+// Storage is a PostgreSQL-based leaky bucket factory.
+type Storage struct {
+	db    *sql.DB
+	clock leakybucket.Clock
+	hooks *leakybucket.Hooks
+}
+
+// New initializes a storage on db, creating the leakybucket table if needed.
+func New(db *sql.DB) (*Storage, error) {
+	if _, err := db.Exec(schema); err != nil {
+		return nil, err
+	}
+	return &Storage{db: db, clock: leakybucket.RealClock{}}, nil
+}
+
+// SetClock makes the buckets created by the storage read the time from clock instead of the
+// system clock.
+func (s *Storage) SetClock(clock leakybucket.Clock) {
+	s.clock = clock
+}
+
+// SetHooks makes the buckets created by the storage afterwards call hooks on adds.
+func (s *Storage) SetHooks(hooks leakybucket.Hooks) {
+	s.hooks = &hooks
+}
+
+// Create a bucket.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, _, err := s.CreateOrGet(name, capacity, rate)
+	return b, err
+}
+
+// CreateOrGet creates a bucket like Create, also reporting whether the bucket is new, that is
+// whether it had no row.
+func (s *Storage) CreateOrGet(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, bool, error) {
+	if err := leakybucket.ValidateParams(capacity, rate); err != nil {
+		return nil, false, err
+	}
+	remaining, reset, exists, err := read(context.Background(), s.db, name, capacity, rate, s.clock.Now())
+	if err != nil {
+		return nil, false, err
+	}
+	return &bucket{
+		name:      name,
+		capacity:  capacity,
+		remaining: remaining,
+		reset:     reset,
+		rate:      rate,
+		db:        s.db,
+		clock:     s.clock,
+		hooks:     s.hooks,
+	}, !exists, nil
+}
+
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *Storage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
+}
+
+// Remove a bucket by deleting its row.
+func (s *Storage) Remove(name string) error {
+	_, err := s.db.Exec(deleteQuery, name)
+	return err
+}
@@ -0,0 +1,138 @@
+package postgres
+
+import (
+	"database/sql"
+	"github.com/bububa/leakybucket"
+	_ "github.com/lib/pq"
+	"os"
+	"testing"
+)
+
+// getLocalStorage returns a storage on an emptied table in the database at POSTGRES_URL,
+// skipping the test if there is none.
+func getLocalStorage(t *testing.T) *Storage {
+	url := os.Getenv("POSTGRES_URL")
+	if url == "" {
+		t.Skip("POSTGRES_URL is not set")
+	}
+	db, err := sql.Open("postgres", url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage, err := New(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Exec("TRUNCATE leakybucket"); err != nil {
+		t.Fatal(err)
+	}
+	return storage
+}
+
+func TestCreate(t *testing.T) {
+	leakybucket.CreateTest(getLocalStorage(t))(t)
+}
+
+func TestCreateMulti(t *testing.T) {
+	leakybucket.CreateMultiTest(getLocalStorage(t))(t)
+}
+
+func TestInvalidParams(t *testing.T) {
+	leakybucket.InvalidParamsTest(getLocalStorage(t))(t)
+}
+
+func TestAdd(t *testing.T) {
+	leakybucket.AddTest(getLocalStorage(t))(t)
+}
+
+func TestAddZero(t *testing.T) {
+	leakybucket.AddZeroTest(getLocalStorage(t))(t)
+}
+
+func TestAddOverCapacity(t *testing.T) {
+	leakybucket.AddOverCapacityTest(getLocalStorage(t))(t)
+}
+
+func TestTryAdd(t *testing.T) {
+	leakybucket.TryAddTest(getLocalStorage(t))(t)
+}
+
+func TestFullError(t *testing.T) {
+	leakybucket.FullErrorTest(getLocalStorage(t))(t)
+}
+
+func TestAddDetailed(t *testing.T) {
+	leakybucket.AddDetailedTest(getLocalStorage(t))(t)
+}
+
+func TestAllow(t *testing.T) {
+	leakybucket.AllowTest(getLocalStorage(t))(t)
+}
+
+func TestTakeUpTo(t *testing.T) {
+	leakybucket.TakeUpToTest(getLocalStorage(t))(t)
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	leakybucket.ThreadSafeAddTest(getLocalStorage(t))(t)
+}
+
+func TestConcurrentCapacity(t *testing.T) {
+	leakybucket.ConcurrentCapacityTest(getLocalStorage(t))(t)
+}
+
+func TestReset(t *testing.T) {
+	leakybucket.AddResetTest(getLocalStorage(t))(t)
+}
+
+func TestShortRate(t *testing.T) {
+	leakybucket.ShortRateTest(getLocalStorage(t))(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	leakybucket.FindOrCreateTest(getLocalStorage(t))(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	leakybucket.BucketInstanceConsistencyTest(getLocalStorage(t))(t)
+}
+
+func TestAddContext(t *testing.T) {
+	leakybucket.AddContextTest(getLocalStorage(t))(t)
+}
+
+func TestAddWithTime(t *testing.T) {
+	leakybucket.AddWithTimeTest(getLocalStorage(t))(t)
+}
+
+func TestPeek(t *testing.T) {
+	leakybucket.PeekTest(getLocalStorage(t))(t)
+}
+
+func TestWouldAccept(t *testing.T) {
+	leakybucket.WouldAcceptTest(getLocalStorage(t))(t)
+}
+
+func TestHooks(t *testing.T) {
+	leakybucket.HooksTest(getLocalStorage(t))(t)
+}
+
+func TestRemove(t *testing.T) {
+	leakybucket.RemoveTest(getLocalStorage(t))(t)
+}
+
+func TestSetRemaining(t *testing.T) {
+	leakybucket.SetRemainingTest(getLocalStorage(t))(t)
+}
+
+func TestDrain(t *testing.T) {
+	leakybucket.DrainTest(getLocalStorage(t))(t)
+}
+
+func TestRefund(t *testing.T) {
+	leakybucket.RefundTest(getLocalStorage(t))(t)
+}
+
+func TestAddHierarchical(t *testing.T) {
+	leakybucket.AddHierarchicalTest(getLocalStorage(t))(t)
+}
@@ -0,0 +1,441 @@
+package redis
+
+import (
+	"context"
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/redigo/redis"
+	"sync"
+	"time"
+)
+
+// approxRotate is Lua shared by the scripts below that reads the hash at KEYS[1] as of time
+// ARGV[1], with windows ARGV[2] long: start is when its current window started, now if it has
+// none, and current and previous the amounts added in that window and the one before. A
+// current window that has ended becomes the previous one, and both are dropped once the next
+// has ended too. used is then the amount in the window sliding up to now, estimated by
+// weighting the previous window by how much of it the sliding window still overlaps, rounded
+// down.
+const approxRotate = `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local fields = redis.call("HMGET", KEYS[1], "start", "current", "previous")
+local start = tonumber(fields[1]) or now
+local current = tonumber(fields[2]) or 0
+local previous = tonumber(fields[3]) or 0
+if now >= start + 2 * window then
+	start, current, previous = now, 0, 0
+elseif now >= start + window then
+	start, current, previous = start + window, 0, current
+end
+local elapsed = math.max(now - start, 0)
+local used = current + math.floor(previous * (window - elapsed) / window)
+`
+
+// approxWrite is Lua shared by the scripts below that writes start, current and previous back
+// to the hash at KEYS[1], expiring it when the previous window no longer counts.
+const approxWrite = `
+redis.call("HMSET", KEYS[1], "start", start, "current", current, "previous", previous)
+redis.call("PEXPIRE", KEYS[1], start + 2 * window - now)
+`
+
+// approxScript records an add of ARGV[3] to the current window if it fits in capacity ARGV[4],
+// or if ARGV[5] is 1, of as much of it as fits. It returns the estimated amount in the sliding
+// window, when the current window started, 1 if the amount was added or 0 if the bucket was
+// full, and the amount added. An amount of 0 only reads the hash, and is never refused, even
+// when the estimate is over the capacity.
+var approxScript = redis.NewScript(1, approxRotate+`
+local amount = tonumber(ARGV[3])
+local capacity = tonumber(ARGV[4])
+if ARGV[5] == "1" then
+	amount = math.min(amount, math.max(capacity - used, 0))
+elseif amount > 0 and used + amount > capacity then
+	return {used, start, 0, 0}
+end
+if amount > 0 then
+	current = current + amount
+	`+approxWrite+`
+end
+return {used + amount, start, 1, amount}
+`)
+
+// approxSetScript sets the amount in the current window to ARGV[3] and drops the previous one,
+// keeping when the current window started, which it returns.
+var approxSetScript = redis.NewScript(1, approxRotate+`
+current, previous = tonumber(ARGV[3]), 0
+`+approxWrite+`
+return start
+`)
+
+// approxRefundScript takes up to ARGV[3] back from the current window, then from the previous
+// one. It returns the estimated amount left in the sliding window and when the current window
+// started.
+var approxRefundScript = redis.NewScript(1, approxRotate+`
+local refund = math.min(tonumber(ARGV[3]), current)
+current = current - refund
+previous = math.max(previous - (tonumber(ARGV[3]) - refund), 0)
+if fields[1] then
+	`+approxWrite+`
+end
+return {current + math.floor(previous * (window - elapsed) / window), start}
+`)
+
+type approxBucket struct {
+	name, key           string
+	capacity, remaining uint
+	reset               time.Time
+	synced              time.Time
+	rate                time.Duration
+	getConn             ConnFunc
+	getReplicaConn      ConnFunc
+	clock               leakybucket.Clock
+	failOpen            failOpen
+	hooks               *leakybucket.Hooks
+
+	// mutex guards remaining, reset and synced, which concurrent commands on the bucket update.
+	mutex sync.Mutex
+}
+
+// Name returns the name the bucket was created with.
+func (b *approxBucket) Name() string {
+	return b.name
+}
+
+// Key returns the redis key holding the bucket's windows: its name, hashed by any NameHash,
+// after any KeyPrefix.
+func (b *approxBucket) Key() string {
+	return b.key
+}
+
+func (b *approxBucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *approxBucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.remaining
+}
+
+// Reset returns when the current window ends, after which the adds in it count for less and
+// less as the next window passes.
+func (b *approxBucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset
+}
+
+// Rate returns the length of the bucket's windows.
+func (b *approxBucket) Rate() time.Duration {
+	return b.rate
+}
+
+func (b *approxBucket) State() leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
+// setState records the state of the bucket last read from redis.
+func (b *approxBucket) setState(remaining uint, reset time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remaining, b.reset = remaining, reset
+	b.synced = b.clock.Now()
+}
+
+// LastSync returns when the bucket's state was last read from redis, or the zero time if it
+// never was, such as when creating it failed open.
+func (b *approxBucket) LastSync() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.synced
+}
+
+// observe records the state of the bucket given the estimated amount in its sliding window and
+// when its current window started, returning it.
+func (b *approxBucket) observe(used, start int64) leakybucket.BucketState {
+	state := b.State()
+	state.Remaining = leakybucket.RemainingAfter(b.capacity, used)
+	state.Reset = fromMilliseconds(start).Add(b.rate)
+	b.setState(state.Remaining, state.Reset)
+	return state
+}
+
+// conn returns a connection for commands on the bucket's key.
+func (b *approxBucket) conn(ctx context.Context) (redis.Conn, error) {
+	return b.getConn(ctx, b.key)
+}
+
+// Add to the bucket.
+func (b *approxBucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// TryAdd adds to the bucket, reporting whether the amount fit rather than returning ErrorFull.
+func (b *approxBucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	return leakybucket.TryAdd(b, amount)
+}
+
+// AddWithTime adds to the bucket as if at time t.
+func (b *approxBucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.State(), err))
+	}
+	defer conn.Close()
+	return b.failOpen.filter(b.hooks.Notify(b.name)(b.add(context.Background(), conn, amount, t)))
+}
+
+// AddContext adds to the bucket, bounding the redis commands by ctx.
+func (b *approxBucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.State(), err))
+	}
+	defer conn.Close()
+	return b.failOpen.filter(b.hooks.Notify(b.name)(b.add(ctx, conn, amount, b.clock.Now())))
+}
+
+func (b *approxBucket) add(ctx context.Context, conn redis.Conn, amount uint, now time.Time) (leakybucket.BucketState, error) {
+	if amount > b.capacity {
+		return b.State(), leakybucket.ErrorOverCapacity
+	}
+	_, state, err := b.run(ctx, conn, amount, now, false)
+	return state, err
+}
+
+// TakeUpTo adds as much of amount to the bucket as fits, returning how much it added.
+func (b *approxBucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	var granted uint
+	state := b.State()
+	conn, err := b.conn(context.Background())
+	if err == nil {
+		defer conn.Close()
+		granted, state, err = b.run(context.Background(), conn, amount, b.clock.Now(), true)
+	}
+	if err != nil {
+		state, err = b.failOpen.filter(state, err)
+		if err != nil {
+			return 0, state, err
+		}
+		return amount, state, nil
+	}
+	return granted, state, nil
+}
+
+// run runs approxScript, adding as much of amount as fits if partial is set, and returns the
+// amount added.
+func (b *approxBucket) run(ctx context.Context, conn redis.Conn, amount uint, now time.Time, partial bool) (uint, leakybucket.BucketState, error) {
+	flag := 0
+	if partial {
+		flag = 1
+	}
+	reply, err := redis.Values(approxScript.DoContext(ctx, conn, b.key, unixMilliseconds(now),
+		expiryMilliseconds(b.rate), amount, b.capacity, flag))
+	if err != nil {
+		return 0, b.State(), err
+	}
+	var used, start, added, granted int64
+	if _, err := redis.Scan(reply, &used, &start, &added, &granted); err != nil {
+		return 0, b.State(), err
+	}
+	state := b.observe(used, start)
+	if added == 0 {
+		return 0, state, leakybucket.NewFullError(state)
+	}
+	return uint(granted), state, nil
+}
+
+// Peek refreshes the bucket's state from redis without adding to it, from the storage's
+// replica if it has one: approxScript makes no write for an amount of 0.
+func (b *approxBucket) Peek() (leakybucket.BucketState, error) {
+	getConn := b.getConn
+	if b.getReplicaConn != nil {
+		getConn = b.getReplicaConn
+	}
+	conn, err := getConn(context.Background(), b.key)
+	if err != nil {
+		return b.State(), err
+	}
+	defer conn.Close()
+	return b.add(context.Background(), conn, 0, b.clock.Now())
+}
+
+// WouldAccept reports whether adding amount would fit, reading the bucket's state without
+// adding to it. When redis fails, a bucket failing open reports that it would.
+func (b *approxBucket) WouldAccept(amount uint) (bool, error) {
+	state, err := b.Peek()
+	if err != nil {
+		_, err = b.failOpen.filter(state, err)
+		return err == nil, err
+	}
+	return amount <= state.Remaining, nil
+}
+
+// SetRemaining sets the remaining space in the bucket, up to its capacity, by setting the
+// amount in the current window and dropping the previous one.
+func (b *approxBucket) SetRemaining(n uint) error {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	remaining := leakybucket.Min(n, b.capacity)
+	start, err := redis.Int64(approxSetScript.Do(conn, b.key, unixMilliseconds(b.clock.Now()),
+		expiryMilliseconds(b.rate), b.capacity-remaining))
+	if err != nil {
+		return err
+	}
+	b.setState(remaining, fromMilliseconds(start).Add(b.rate))
+	return nil
+}
+
+// Refund gives back amount to the bucket by taking it off its current window first.
+func (b *approxBucket) Refund(amount uint) (leakybucket.BucketState, error) {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.State(), err
+	}
+	defer conn.Close()
+
+	reply, err := redis.Values(approxRefundScript.Do(conn, b.key, unixMilliseconds(b.clock.Now()),
+		expiryMilliseconds(b.rate), amount))
+	if err != nil {
+		return b.State(), err
+	}
+	var used, start int64
+	if _, err := redis.Scan(reply, &used, &start); err != nil {
+		return b.State(), err
+	}
+	return b.observe(used, start), nil
+}
+
+// Drain the bucket by deleting its key.
+func (b *approxBucket) Drain() error {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", b.key); err != nil {
+		return err
+	}
+	b.setState(b.capacity, b.clock.Now().Add(b.rate))
+	return nil
+}
+
+// ApproxSlidingWindowStorage is a redis-based factory of buckets approximating a sliding window
+// with two fixed ones. Each bucket counts the adds in its current window and in the one before,
+// and estimates the adds over the preceding rate as those of the current window plus those of
+// the previous one weighted by how much of it that span still overlaps, as if they had been
+// spread evenly over it.
+//
+// This is a middle ground between Storage and SlidingWindowStorage: like the former, each
+// bucket is a constant size hash of three integers whatever its capacity, and like the latter,
+// it doesn't let twice the capacity through around the boundary of two windows. The estimate
+// can be off when the adds of the previous window were unevenly spread. Windows are measured
+// with the clients' clocks, so they should be in sync.
+type ApproxSlidingWindowStorage struct {
+	pool      *redis.Pool
+	replica   *redis.Pool
+	getConn   ConnFunc
+	clock     leakybucket.Clock
+	failOpen  failOpen
+	keyPrefix string
+	nameHash  func(string) string
+	hooks     *leakybucket.Hooks
+}
+
+// NewApproxSlidingWindow initializes the connection to redis for approximate sliding window
+// buckets, configured by any opts like New.
+func NewApproxSlidingWindow(network, address string, opts ...Option) (*ApproxSlidingWindowStorage, error) {
+	o := newOptions(opts)
+	pool, replica, err := newPools(network, address, o)
+	if err != nil {
+		return nil, err
+	}
+	return &ApproxSlidingWindowStorage{
+		pool:      pool,
+		replica:   replica,
+		getConn:   poolConn(pool),
+		clock:     leakybucket.RealClock{},
+		failOpen:  failOpen(o.FailOpen),
+		keyPrefix: o.KeyPrefix,
+		nameHash:  o.NameHash,
+	}, nil
+}
+
+// SetClock makes the buckets created by the storage read the time from clock instead of the
+// system clock.
+func (s *ApproxSlidingWindowStorage) SetClock(clock leakybucket.Clock) {
+	s.clock = clock
+}
+
+// SetHooks makes the buckets created by the storage afterwards call hooks on adds.
+func (s *ApproxSlidingWindowStorage) SetHooks(hooks leakybucket.Hooks) {
+	s.hooks = &hooks
+}
+
+// Create a bucket whose windows are rate long.
+func (s *ApproxSlidingWindowStorage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	if err := leakybucket.ValidateParams(capacity, rate); err != nil {
+		return nil, err
+	}
+	b := &approxBucket{
+		name:           name,
+		key:            s.key(name),
+		capacity:       capacity,
+		remaining:      capacity,
+		reset:          s.clock.Now().Add(rate),
+		rate:           rate,
+		getConn:        s.getConn,
+		getReplicaConn: replicaConn(s.replica),
+		clock:          s.clock,
+		failOpen:       s.failOpen,
+		hooks:          s.hooks,
+	}
+	if _, err := b.Peek(); err != nil && !s.failOpen {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *ApproxSlidingWindowStorage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
+}
+
+// Remove a bucket by deleting its key.
+func (s *ApproxSlidingWindowStorage) Remove(name string) error {
+	key := s.key(name)
+	conn, err := s.getConn(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", key)
+	return err
+}
+
+// key returns the redis key of the named bucket.
+func (s *ApproxSlidingWindowStorage) key(name string) string {
+	return bucketKey(s.keyPrefix, s.nameHash, name)
+}
+
+// RemovePrefix removes every bucket whose name starts with prefix, returning how many it
+// removed. With NameHash set, only the empty prefix, removing every bucket, is supported.
+func (s *ApproxSlidingWindowStorage) RemovePrefix(prefix string) (int, error) {
+	if s.nameHash != nil && prefix != "" {
+		return 0, errHashedPrefix
+	}
+	conn, err := s.getConn(context.Background(), "")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return removePrefix(conn, s.keyPrefix+prefix, false)
+}
@@ -0,0 +1,222 @@
+package redis
+
+import (
+	"errors"
+	"github.com/bububa/leakybucket"
+	"os"
+	"testing"
+	"time"
+)
+
+func getLocalApproxSlidingWindowStorage() *ApproxSlidingWindowStorage {
+	storage, err := NewApproxSlidingWindow("tcp", os.Getenv("REDIS_URL"))
+	if err != nil {
+		panic(err)
+	}
+	return storage
+}
+
+func TestApproxSlidingWindowCreate(t *testing.T) {
+	flushDb()
+	leakybucket.CreateTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowCreateMulti(t *testing.T) {
+	flushDb()
+	leakybucket.CreateMultiTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowInvalidParams(t *testing.T) {
+	flushDb()
+	leakybucket.InvalidParamsTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowAdd(t *testing.T) {
+	flushDb()
+	leakybucket.AddTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowAddZero(t *testing.T) {
+	flushDb()
+	leakybucket.AddZeroTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowAddOverCapacity(t *testing.T) {
+	flushDb()
+	leakybucket.AddOverCapacityTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowTryAdd(t *testing.T) {
+	flushDb()
+	leakybucket.TryAddTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowFullError(t *testing.T) {
+	flushDb()
+	leakybucket.FullErrorTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowAddDetailed(t *testing.T) {
+	flushDb()
+	leakybucket.AddDetailedTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowAllow(t *testing.T) {
+	flushDb()
+	leakybucket.AllowTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowTakeUpTo(t *testing.T) {
+	flushDb()
+	leakybucket.TakeUpToTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowThreadSafeAdd(t *testing.T) {
+	flushDb()
+	leakybucket.ThreadSafeAddTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowConcurrentCapacity(t *testing.T) {
+	flushDb()
+	leakybucket.ConcurrentCapacityTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowReset(t *testing.T) {
+	flushDb()
+	leakybucket.AddResetTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowShortRate(t *testing.T) {
+	flushDb()
+	leakybucket.ShortRateTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+// FindOrCreateTest doesn't apply: the window is given by the rate of each bucket instance
+// rather than fixed when its key was created.
+
+func TestApproxSlidingWindowBucketInstanceConsistencyTest(t *testing.T) {
+	flushDb()
+	leakybucket.BucketInstanceConsistencyTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowAddContext(t *testing.T) {
+	flushDb()
+	leakybucket.AddContextTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowAddWithTime(t *testing.T) {
+	flushDb()
+	leakybucket.AddWithTimeTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowPeek(t *testing.T) {
+	flushDb()
+	leakybucket.PeekTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowWouldAccept(t *testing.T) {
+	flushDb()
+	leakybucket.WouldAcceptTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowHooks(t *testing.T) {
+	flushDb()
+	leakybucket.HooksTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowRemove(t *testing.T) {
+	flushDb()
+	leakybucket.RemoveTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowSetRemaining(t *testing.T) {
+	flushDb()
+	leakybucket.SetRemainingTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowDrain(t *testing.T) {
+	flushDb()
+	leakybucket.DrainTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowRefund(t *testing.T) {
+	flushDb()
+	leakybucket.RefundTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowAddHierarchical(t *testing.T) {
+	flushDb()
+	leakybucket.AddHierarchicalTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+func TestApproxSlidingWindowRemovePrefix(t *testing.T) {
+	flushDb()
+	leakybucket.RemovePrefixTest(getLocalApproxSlidingWindowStorage())(t)
+}
+
+// Right after a window ends, the adds in it still count in full.
+func TestApproxSlidingWindowBoundaryBurst(t *testing.T) {
+	flushDb()
+	bucket, err := getLocalApproxSlidingWindowStorage().Create("testbucket", 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := bucket.AddWithTime(10, start); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.AddWithTime(1, start.Add(time.Second)); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull at the start of the next window, received %v", err)
+	}
+}
+
+// Halfway through a window, half the adds of the previous one still count.
+func TestApproxSlidingWindowWeighting(t *testing.T) {
+	flushDb()
+	bucket, err := getLocalApproxSlidingWindowStorage().Create("testbucket", 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := bucket.AddWithTime(10, start); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucket.AddWithTime(5, start.Add(1500*time.Millisecond)); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+	} else if !state.Reset.Equal(fromMilliseconds(unixMilliseconds(start)).Add(2 * time.Second)) {
+		t.Fatalf("expected reset at the end of the second window, got %s", state.Reset)
+	}
+	if _, err := bucket.AddWithTime(1, start.Add(1500*time.Millisecond)); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+}
+
+// TestApproxSlidingWindowReplica checks that peeking from a replica, here the primary itself,
+// reads the same windows as the adds.
+func TestApproxSlidingWindowReplica(t *testing.T) {
+	flushDb()
+	s := getLocalApproxSlidingWindowStorage()
+	s.replica = s.pool
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := bucket.Add(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := bucket.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != 7 || !state.Reset.Equal(added.Reset) {
+		t.Fatalf("expected %d remaining until %v, got %d until %v", 7, added.Reset, state.Remaining, state.Reset)
+	}
+}
+
+func TestApproxSlidingWindowPeekOverCapacity(t *testing.T) {
+	flushDb()
+	peekOverCapacityTest(getLocalApproxSlidingWindowStorage())(t)
+}
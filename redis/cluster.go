@@ -0,0 +1,276 @@
+package redis
+
+import (
+	"context"
+	"errors"
+	"github.com/bububa/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// slotCount is the number of hash slots a Redis Cluster shards keys across.
+const slotCount = 16384
+
+// maxRedirects bounds how many MOVED or ASK redirections a command follows before giving up.
+const maxRedirects = 5
+
+var errNoNodes = errors.New("redis: no cluster node could be reached")
+
+// cluster routes commands to the nodes of a Redis Cluster by the hash slots of their keys. It
+// learns which node serves each slot with CLUSTER SLOTS, and follows the MOVED and ASK
+// redirections of slots that have since moved.
+type cluster struct {
+	addrs   []string
+	newPool func(address string) *redis.Pool
+
+	mutex sync.RWMutex
+	slots [slotCount]string
+	pools map[string]*redis.Pool
+}
+
+func newCluster(addrs []string, opts Options) *cluster {
+	return &cluster{
+		addrs: addrs,
+		newPool: func(address string) *redis.Pool {
+			return poolFor("tcp", address, opts)
+		},
+		pools: make(map[string]*redis.Pool),
+	}
+}
+
+// slot returns the hash slot of key, which is that of its hash tag if it has one: the part
+// between the first "{" and the next "}", if not empty.
+func slot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % slotCount
+}
+
+// crc16 is the CRC-16/XMODEM checksum Redis Cluster hashes keys with.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for bit := 0; bit < 8; bit++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
+
+// pool returns the pool of connections to the node at address.
+func (c *cluster) pool(address string) *redis.Pool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	p, ok := c.pools[address]
+	if !ok {
+		p = c.newPool(address)
+		c.pools[address] = p
+	}
+	return p
+}
+
+// refresh reads which node serves each slot from the first startup node that answers.
+func (c *cluster) refresh() error {
+	err := errNoNodes
+	for _, address := range c.addrs {
+		conn := c.pool(address).Get()
+		err = c.readSlots(conn, address)
+		conn.Close()
+		if err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// readSlots updates the slots from the CLUSTER SLOTS reply of the node at address.
+func (c *cluster) readSlots(conn redis.Conn, address string) error {
+	ranges, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+	if err != nil {
+		return err
+	}
+	var slots [slotCount]string
+	for _, r := range ranges {
+		fields, err := redis.Values(r, nil)
+		if err != nil {
+			return err
+		}
+		if len(fields) < 3 {
+			return errors.New("redis: malformed CLUSTER SLOTS reply")
+		}
+		start, err := redis.Int(fields[0], nil)
+		if err != nil {
+			return err
+		}
+		end, err := redis.Int(fields[1], nil)
+		if err != nil {
+			return err
+		}
+		node, err := redis.Values(fields[2], nil)
+		if err != nil {
+			return err
+		}
+		var host string
+		var port int
+		if _, err := redis.Scan(node, &host, &port); err != nil {
+			return err
+		}
+		if host == "" {
+			// The node serving the range is the one that answered.
+			host, _, _ = net.SplitHostPort(address)
+		}
+		for s := start; s <= end && s < slotCount; s++ {
+			slots[s] = net.JoinHostPort(host, strconv.Itoa(port))
+		}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.slots = slots
+	return nil
+}
+
+// node returns the address of the node serving slot s, or of a startup node if it is unknown,
+// which will redirect to the right one.
+func (c *cluster) node(s int) string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	if address := c.slots[s]; address != "" {
+		return address
+	}
+	return c.addrs[0]
+}
+
+func (c *cluster) move(s int, address string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.slots[s] = address
+}
+
+// primaries returns the addresses of the nodes serving slots.
+func (c *cluster) primaries() []string {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	seen := make(map[string]bool)
+	var addresses []string
+	for _, address := range c.slots {
+		if address != "" && !seen[address] {
+			seen[address] = true
+			addresses = append(addresses, address)
+		}
+	}
+	return addresses
+}
+
+// get returns a connection for commands on key.
+func (c *cluster) get(ctx context.Context, key string) (redis.Conn, error) {
+	s := slot(key)
+	conn, err := c.pool(c.node(s)).GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &clusterConn{Conn: conn, cluster: c, slot: s, ctx: ctx}, nil
+}
+
+// removePrefix deletes the keys starting with prefix from every node, returning how many of
+// them were counters.
+func (c *cluster) removePrefix(prefix string) (int, error) {
+	removed := 0
+	for _, address := range c.primaries() {
+		conn := c.pool(address).Get()
+		n, err := removePrefix(conn, prefix, true)
+		conn.Close()
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+	return removed, nil
+}
+
+// scanCounters calls visit with the counters starting with prefix on every node, until visit
+// returns false.
+func (c *cluster) scanCounters(prefix string, visit func(key string, count, ttl int64) bool) error {
+	for _, address := range c.primaries() {
+		conn := c.pool(address).Get()
+		more, err := scanCounters(conn, prefix, visit)
+		conn.Close()
+		if err != nil || !more {
+			return err
+		}
+	}
+	return nil
+}
+
+// clusterConn is a connection to the node serving a slot. Commands sent with Do follow the
+// redirections of the slot to other nodes, leaving a moved slot's new node known for the next
+// connection. Pipelined commands don't: they fail on a redirection, and leave the slot where it
+// was, so the buckets' commands are each sent with Do.
+type clusterConn struct {
+	redis.Conn
+	cluster *cluster
+	slot    int
+	ctx     context.Context
+}
+
+func (c *clusterConn) Do(command string, args ...interface{}) (interface{}, error) {
+	return c.follow(func(conn redis.Conn) (interface{}, error) {
+		return conn.Do(command, args...)
+	})
+}
+
+func (c *clusterConn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	return c.follow(func(conn redis.Conn) (interface{}, error) {
+		return redis.DoContext(conn, ctx, command, args...)
+	})
+}
+
+// follow runs do on the connection, then on the nodes it is redirected to.
+func (c *clusterConn) follow(do func(redis.Conn) (interface{}, error)) (interface{}, error) {
+	reply, err := do(c.Conn)
+	for i := 0; i < maxRedirects; i++ {
+		ask, address, ok := redirection(err)
+		if !ok {
+			break
+		}
+		next, dialErr := c.cluster.pool(address).GetContext(c.ctx)
+		if dialErr != nil {
+			return nil, dialErr
+		}
+		if ask {
+			// The slot is being migrated; only this command goes to the importing node.
+			next.Send("ASKING")
+			reply, err = do(next)
+			next.Close()
+			continue
+		}
+		c.cluster.move(c.slot, address)
+		c.Conn.Close()
+		c.Conn = next
+		reply, err = do(c.Conn)
+	}
+	return reply, err
+}
+
+// redirection parses a MOVED or ASK error, reporting whether it is ASK and the address of the
+// node to redirect to.
+func redirection(err error) (bool, string, bool) {
+	e, ok := err.(redis.Error)
+	if !ok {
+		return false, "", false
+	}
+	fields := strings.Fields(string(e))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return false, "", false
+	}
+	return fields[0] == "ASK", fields[2], true
+}
@@ -0,0 +1,102 @@
+package redis
+
+import (
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/redigo/redis"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestSlot(t *testing.T) {
+	if crc := crc16("123456789"); crc != 0x31c3 {
+		t.Fatalf("expected checksum 0x31c3, got %#x", crc)
+	}
+	for _, test := range []struct {
+		key  string
+		slot int
+	}{
+		{"foo", 12182},
+		{"bar", 5061},
+		// Only the hash tag is hashed.
+		{"{foo}.limit", 12182},
+		{"prefix:{bar}", 5061},
+		// Only the first hash tag counts.
+		{"{bar}{foo}", 5061},
+	} {
+		if s := slot(test.key); s != test.slot {
+			t.Fatalf("%s: expected slot %d, got %d", test.key, test.slot, s)
+		}
+	}
+	// An empty hash tag doesn't count, so the whole key is hashed.
+	if slot("foo{}{bar}") == slot("bar") {
+		t.Fatal("expected an empty hash tag to be ignored")
+	}
+}
+
+func TestRedirection(t *testing.T) {
+	for _, test := range []struct {
+		err      error
+		ask      bool
+		address  string
+		redirect bool
+	}{
+		{redis.Error("MOVED 3999 127.0.0.1:6381"), false, "127.0.0.1:6381", true},
+		{redis.Error("ASK 3999 127.0.0.1:6381"), true, "127.0.0.1:6381", true},
+		{redis.Error("ERR unknown command"), false, "", false},
+		{nil, false, "", false},
+	} {
+		ask, address, redirect := redirection(test.err)
+		if ask != test.ask || address != test.address || redirect != test.redirect {
+			t.Fatalf("%v: expected %v %q %v, got %v %q %v", test.err, test.ask, test.address,
+				test.redirect, ask, address, redirect)
+		}
+	}
+}
+
+// getLocalClusterStorage returns a storage on the emptied Redis Cluster whose nodes are listed,
+// comma-separated, in REDIS_CLUSTER_ADDRS, skipping the test if it is not set.
+func getLocalClusterStorage(t *testing.T) *Storage {
+	addrs := os.Getenv("REDIS_CLUSTER_ADDRS")
+	if addrs == "" {
+		t.Skip("REDIS_CLUSTER_ADDRS is not set")
+	}
+	s, err := NewCluster(strings.Split(addrs, ","))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.RemovePrefix(""); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestClusterAdd(t *testing.T) {
+	leakybucket.AddTest(getLocalClusterStorage(t))(t)
+}
+
+func TestClusterAddMulti(t *testing.T) {
+	leakybucket.AddMultiTest(getLocalClusterStorage(t))(t)
+}
+
+func TestClusterAddContext(t *testing.T) {
+	leakybucket.AddContextTest(getLocalClusterStorage(t))(t)
+}
+
+func TestClusterTakeUpTo(t *testing.T) {
+	leakybucket.TakeUpToTest(getLocalClusterStorage(t))(t)
+}
+
+func TestClusterPeek(t *testing.T) {
+	leakybucket.PeekTest(getLocalClusterStorage(t))(t)
+}
+
+func TestClusterRemovePrefix(t *testing.T) {
+	leakybucket.RemovePrefixTest(getLocalClusterStorage(t))(t)
+}
+
+func TestInvalidCluster(t *testing.T) {
+	if _, err := NewCluster([]string{"localhost:6378"}); err == nil {
+		t.Fatalf("expected error connecting to invalid cluster")
+	}
+}
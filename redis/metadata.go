@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"context"
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/redigo/redis"
+	"time"
+)
+
+// metadataSuffix follows the key of a bucket in the key of the hash holding its metadata. A hash
+// isn't a string, so the scans of Range don't take it for a counter.
+const metadataSuffix = ":metadata"
+
+// minMetadataExpiry is how long metadata outlives the last Create storing it, at least. Clients
+// that keep their buckets rather than create them for each add may not create them again for a
+// long time, while their counters are still in use.
+const minMetadataExpiry = 24 * time.Hour
+
+// metadataScript atomically stores capacity ARGV[1] and rate ARGV[2], in milliseconds, in the
+// hash at KEYS[1], giving it the expiry ARGV[3]. It returns the capacity and rate it held before,
+// or nils if it didn't exist.
+var metadataScript = redis.NewScript(1, `
+local stored = redis.call("HMGET", KEYS[1], "capacity", "rate")
+redis.call("HSET", KEYS[1], "capacity", ARGV[1], "rate", ARGV[2])
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return stored
+`)
+
+// storeMetadata stores the capacity and rate of spec as the metadata of its bucket, calling the
+// storage's OnMetadataMismatch if they differ from those stored before.
+func (s *Storage) storeMetadata(spec leakybucket.BucketSpec) error {
+	key := s.key(spec.Name) + metadataSuffix
+	conn, err := s.getConn(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	expiry := spec.Rate
+	if expiry < minMetadataExpiry {
+		expiry = minMetadataExpiry
+	}
+	reply, err := metadataScript.Do(conn, key, spec.Capacity, expiryMilliseconds(spec.Rate), expiryMilliseconds(expiry))
+	stored, ok, err := metadataReply(spec.Name, reply, err)
+	if err != nil || !ok {
+		return err
+	}
+	if s.onMismatch != nil && (stored.Capacity != spec.Capacity ||
+		expiryMilliseconds(stored.Rate) != expiryMilliseconds(spec.Rate)) {
+		s.onMismatch(spec.Name, stored, spec)
+	}
+	return nil
+}
+
+// Metadata returns the capacity and rate the named bucket was last created with, as stored by
+// Create with Options.Metadata set, such as to create it again after a restart with the same
+// ones. It reports whether there were any: there are none for a bucket not created since its
+// metadata expired, a day or its rate, whichever is longer, after the last Create.
+func (s *Storage) Metadata(name string) (leakybucket.BucketSpec, bool, error) {
+	key := s.key(name) + metadataSuffix
+	conn, err := s.getConn(context.Background(), key)
+	if err != nil {
+		return leakybucket.BucketSpec{}, false, err
+	}
+	defer conn.Close()
+	reply, err := conn.Do("HMGET", key, "capacity", "rate")
+	return metadataReply(name, reply, err)
+}
+
+// metadataReply converts the reply to an HMGET of the named bucket's metadata, reporting whether
+// it had any.
+func metadataReply(name string, reply interface{}, err error) (leakybucket.BucketSpec, bool, error) {
+	values, err := redis.Values(reply, err)
+	if err != nil {
+		return leakybucket.BucketSpec{}, false, err
+	}
+	var capacity, rate int64
+	if len(values) != 2 || values[0] == nil || values[1] == nil {
+		return leakybucket.BucketSpec{}, false, nil
+	}
+	if _, err := redis.Scan(values, &capacity, &rate); err != nil {
+		return leakybucket.BucketSpec{}, false, err
+	}
+	return leakybucket.BucketSpec{Name: name, Capacity: uint(capacity), Rate: time.Duration(rate * millisecond)}, true, nil
+}
+
+// removeMetadata deletes the metadata of the named bucket.
+func (s *Storage) removeMetadata(name string) error {
+	key := s.key(name) + metadataSuffix
+	conn, err := s.getConn(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("DEL", key)
+	return err
+}
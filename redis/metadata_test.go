@@ -0,0 +1,71 @@
+package redis
+
+import (
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/redigo/redis"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestMetadata(t *testing.T) {
+	flushDb()
+	var mismatches []leakybucket.BucketSpec
+	s, err := New("tcp", os.Getenv("REDIS_URL"), WithMetadata(func(name string, stored, given leakybucket.BucketSpec) {
+		mismatches = append(mismatches, stored)
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.Metadata("testbucket"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected no metadata before the bucket is created")
+	}
+
+	if _, err := s.Create("testbucket", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	expected := leakybucket.BucketSpec{Name: "testbucket", Capacity: 10, Rate: time.Minute}
+	if spec, ok, err := s.Metadata("testbucket"); err != nil {
+		t.Fatal(err)
+	} else if !ok || spec != expected {
+		t.Fatalf("expected metadata %+v, got %+v", expected, spec)
+	}
+	// Creating it again just as before isn't a mismatch.
+	if _, err := s.Create("testbucket", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 0 {
+		t.Fatalf("expected no mismatch, got %v", mismatches)
+	}
+
+	// A deploy changes the capacity.
+	if _, err := s.Create("testbucket", 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if len(mismatches) != 1 || mismatches[0] != expected {
+		t.Fatalf("expected a mismatch with %+v, got %v", expected, mismatches)
+	}
+	if spec, _, err := s.Metadata("testbucket"); err != nil {
+		t.Fatal(err)
+	} else if spec.Capacity != 5 {
+		t.Fatalf("expected the new capacity to be stored, got %+v", spec)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	if ttl, err := redis.Int64(conn.Do("PTTL", "testbucket"+metadataSuffix)); err != nil {
+		t.Fatal(err)
+	} else if ttl <= 0 || time.Duration(ttl)*time.Millisecond > minMetadataExpiry {
+		t.Fatalf("expected the metadata to expire within %v, got a PTTL of %d", minMetadataExpiry, ttl)
+	}
+	if err := s.Remove("testbucket"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok, err := s.Metadata("testbucket"); err != nil {
+		t.Fatal(err)
+	} else if ok {
+		t.Fatal("expected Remove to delete the metadata")
+	}
+}
@@ -0,0 +1,132 @@
+package redis
+
+import (
+	"crypto/tls"
+	"github.com/bububa/leakybucket"
+	"time"
+)
+
+// Option configures the connection to redis made by New.
+type Option func(*Options)
+
+func newOptions(opts []Option) Options {
+	var o Options
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
+// WithPassword sends password with AUTH after connecting.
+func WithPassword(password string) Option {
+	return func(o *Options) {
+		o.Password = password
+	}
+}
+
+// WithDB selects the database db after connecting.
+func WithDB(db int) Option {
+	return func(o *Options) {
+		o.DB = db
+	}
+}
+
+// WithPoolSize keeps up to maxIdle idle connections in the pool and limits the connections open
+// at once to maxActive, or to no limit if it is zero.
+func WithPoolSize(maxIdle, maxActive int) Option {
+	return func(o *Options) {
+		o.MaxIdle = maxIdle
+		o.MaxActive = maxActive
+	}
+}
+
+// WithTLS connects over TLS configured by config, or by the crypto/tls defaults if it is nil.
+func WithTLS(config *tls.Config) Option {
+	return func(o *Options) {
+		o.UseTLS = true
+		o.TLSConfig = config
+	}
+}
+
+// WithKeyPrefix prepends prefix to bucket names to make their redis keys.
+func WithKeyPrefix(prefix string) Option {
+	return func(o *Options) {
+		o.KeyPrefix = prefix
+	}
+}
+
+// WithNameHash makes the redis keys of buckets from their names hashed by hash, such as
+// HashName, as described for Options.NameHash.
+func WithNameHash(hash func(name string) string) Option {
+	return func(o *Options) {
+		o.NameHash = hash
+	}
+}
+
+// WithIdempotencyWindow makes AddIdempotent remember idempotency keys for window.
+func WithIdempotencyWindow(window time.Duration) Option {
+	return func(o *Options) {
+		o.IdempotencyWindow = window
+	}
+}
+
+// WithMetadata stores the capacity and rate of buckets next to their counters, calling
+// onMismatch, unless it is nil, when they change, as described for Options.Metadata.
+func WithMetadata(onMismatch func(name string, stored, given leakybucket.BucketSpec)) Option {
+	return func(o *Options) {
+		o.Metadata = true
+		o.OnMetadataMismatch = onMismatch
+	}
+}
+
+// WithDialTimeout bounds how long connecting may take.
+func WithDialTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.DialTimeout = timeout
+	}
+}
+
+// WithCommandTimeout bounds how long each command may take to be sent and to be answered.
+func WithCommandTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.CommandTimeout = timeout
+	}
+}
+
+// WithPingTimeout bounds how long creating a storage waits for redis to answer its first PING.
+func WithPingTimeout(timeout time.Duration) Option {
+	return func(o *Options) {
+		o.PingTimeout = timeout
+	}
+}
+
+// WithFailOpen lets adds through when redis fails, as described for Options.FailOpen.
+func WithFailOpen() Option {
+	return func(o *Options) {
+		o.FailOpen = true
+	}
+}
+
+// WithJitter randomizes the window length of each bucket created within its rate plus or minus
+// jitter.
+func WithJitter(jitter time.Duration) Option {
+	return func(o *Options) {
+		o.Jitter = jitter
+	}
+}
+
+// WithSlidingTTL makes every add that fits restart the expiry of its bucket, as described for
+// Options.SlidingTTL.
+func WithSlidingTTL() Option {
+	return func(o *Options) {
+		o.SlidingTTL = true
+	}
+}
+
+// WithReplica reads the state of buckets from the replica at address, as described for
+// Options.ReplicaAddress.
+func WithReplica(address string) Option {
+	return func(o *Options) {
+		o.ReplicaAddress = address
+	}
+}
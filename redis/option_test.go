@@ -0,0 +1,63 @@
+package redis
+
+import (
+	"crypto/tls"
+	"github.com/bububa/leakybucket"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOptions(t *testing.T) {
+	config := &tls.Config{ServerName: "redis"}
+	opts := newOptions([]Option{
+		WithPassword("secret"),
+		WithDB(2),
+		WithPoolSize(3, 10),
+		WithTLS(config),
+		WithKeyPrefix("app:"),
+		WithDialTimeout(time.Second),
+		WithCommandTimeout(500 * time.Millisecond),
+		WithPingTimeout(2 * time.Second),
+		WithFailOpen(),
+		WithJitter(5 * time.Second),
+		WithSlidingTTL(),
+		WithReplica("replica:6379"),
+		WithNameHash(HashName),
+		WithIdempotencyWindow(time.Minute),
+		WithMetadata(func(string, leakybucket.BucketSpec, leakybucket.BucketSpec) {}),
+	})
+	if opts.OnMetadataMismatch == nil {
+		t.Fatal("expected an OnMetadataMismatch")
+	}
+	opts.OnMetadataMismatch = nil
+	// Funcs can't be compared, so check the hash by what it does.
+	if opts.NameHash == nil || opts.NameHash("testbucket") != HashName("testbucket") {
+		t.Fatal("expected the NameHash to be HashName")
+	}
+	opts.NameHash = nil
+	expected := Options{
+		Password:          "secret",
+		DB:                2,
+		DialTimeout:       time.Second,
+		CommandTimeout:    500 * time.Millisecond,
+		PingTimeout:       2 * time.Second,
+		MaxIdle:           3,
+		MaxActive:         10,
+		UseTLS:            true,
+		TLSConfig:         config,
+		FailOpen:          true,
+		KeyPrefix:         "app:",
+		Jitter:            5 * time.Second,
+		SlidingTTL:        true,
+		ReplicaAddress:    "replica:6379",
+		IdempotencyWindow: time.Minute,
+		Metadata:          true,
+	}
+	if !reflect.DeepEqual(opts, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, opts)
+	}
+	if opts := newOptions(nil); !reflect.DeepEqual(opts, Options{}) {
+		t.Fatalf("expected the zero Options, got %+v", opts)
+	}
+}
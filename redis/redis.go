@@ -1,18 +1,47 @@
 package redis
 
 import (
+	"context"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
 	"github.com/bububa/leakybucket"
 	"github.com/bububa/redigo/redis"
-	"strconv"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 )
 
 type bucket struct {
-	name                string
+	name, key           string
 	capacity, remaining uint
 	reset               time.Time
+	synced              time.Time
 	rate                time.Duration
-	pool                *redis.Pool
+	getConn             ConnFunc
+	getReplicaConn      ConnFunc
+	clock               leakybucket.Clock
+	failOpen            failOpen
+	slidingTTL          bool
+	idempotencyWindow   time.Duration
+	hooks               *leakybucket.Hooks
+
+	// mutex guards remaining, reset and synced, which concurrent commands on the bucket update,
+	// and rate, which SetRate changes.
+	mutex sync.Mutex
+}
+
+// Name returns the name the bucket was created with.
+func (b *bucket) Name() string {
+	return b.name
+}
+
+// Key returns the redis key holding the bucket's counter: its name, hashed by any NameHash,
+// after any KeyPrefix.
+func (b *bucket) Key() string {
+	return b.key
 }
 
 func (b *bucket) Capacity() uint {
@@ -21,194 +50,1373 @@ func (b *bucket) Capacity() uint {
 
 // Remaining space in the bucket.
 func (b *bucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.remaining
 }
 
 // Reset returns when the bucket will be drained.
 func (b *bucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
 	return b.reset
 }
 
+// Rate returns how long it takes for the bucket's full capacity to drain.
+func (b *bucket) Rate() time.Duration {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.rate
+}
+
+// WindowStart returns when the bucket's current window started, as last read from redis: its
+// reset minus its rate. With Options.SlidingTTL, the window slides with each add that fits, so
+// it is then when the last of them happened.
+func (b *bucket) WindowStart() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset.Add(-b.rate)
+}
+
 func (b *bucket) State() leakybucket.BucketState {
-	return leakybucket.BucketState{b.Capacity(), b.Remaining(), b.Reset()}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
 }
 
-func byteArrayToUint(arr []uint8) (uint, error) {
-	if num, err := strconv.Atoi(string(arr)); err != nil {
-		return 0, err
-	} else {
-		return uint(num), err
-	}
+// setState records the state of the bucket last read from redis.
+func (b *bucket) setState(remaining uint, reset time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remaining, b.reset = remaining, reset
+	b.synced = b.clock.Now()
+}
+
+// LastSync returns when the bucket's state was last read from redis, or the zero time if it
+// never was, such as when creating it failed open.
+func (b *bucket) LastSync() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.synced
+}
+
+// replyToCount converts a counter reply to a number, returning an error rather than panicking
+// if the reply isn't one.
+func replyToCount(reply interface{}) (int64, error) {
+	return redis.Int64(reply, nil)
 }
 
 var millisecond = int64(time.Millisecond)
 
-func (b *bucket) updateOldReset() error {
-	if b.reset.Unix() > time.Now().Unix() {
-		return nil
+// expiryMilliseconds returns d in whole milliseconds for PEXPIRE, rounded up so that a window
+// shorter than a millisecond doesn't get a TTL of 0 and expire right away.
+func expiryMilliseconds(d time.Duration) int64 {
+	ms := (int64(d) + millisecond - 1) / millisecond
+	if ms < 1 {
+		return 1
+	}
+	return ms
+}
+
+// Add to the bucket.
+func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// TryAdd adds to the bucket, reporting whether the amount fit rather than returning ErrorFull.
+func (b *bucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	return leakybucket.TryAdd(b, amount)
+}
+
+// AddWithTime adds to the bucket as if at time t: a window started by this add expires at
+// t plus the rate, rather than a full rate from now.
+func (b *bucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.State(), err))
+	}
+	defer conn.Close()
+	expiry := t.Add(b.Rate()).Sub(b.clock.Now())
+	if expiry < time.Millisecond {
+		// The window t belongs to is already over; let it expire right away.
+		expiry = time.Millisecond
+	}
+	return b.failOpen.filter(b.hooks.Notify(b.name)(b.add(context.Background(), conn, amount, expiry)))
+}
+
+// AddContext adds to the bucket, bounding the redis commands by ctx.
+func (b *bucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.State(), err))
+	}
+	defer conn.Close()
+	return b.failOpen.filter(b.hooks.Notify(b.name)(b.add(ctx, conn, amount, b.Rate())))
+}
+
+// AddIdempotent adds to the bucket like Add, unless an add with the same idempotency key, such as
+// a request ID, was applied within the storage's IdempotencyWindow: it then adds nothing and
+// returns the bucket's state, as Peek does, so that a client retrying after a timeout doesn't
+// take the amount twice. An add that fails, such as with ErrorFull, isn't applied, so retrying
+// it tries again. Each key is remembered in a redis key of its own, next to the bucket's key,
+// until the window ends, so the memory it costs grows with the rate of idempotent adds times
+// the window.
+func (b *bucket) AddIdempotent(key string, amount uint) (leakybucket.BucketState, error) {
+	marker := b.key + idempotencyInfix + key
+	claimed, err := b.claim(marker)
+	if err != nil {
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.State(), err))
+	} else if !claimed {
+		return b.Peek()
+	}
+	state, err := b.Add(amount)
+	if err != nil {
+		// Let a retry apply the add instead.
+		if err := b.release(marker); err != nil {
+			return state, err
+		}
+	}
+	return state, err
+}
+
+// idempotencyInfix separates the key of a bucket from an idempotency key in the redis keys
+// recording them. The value of those keys isn't a number, so they aren't taken for counters.
+const (
+	idempotencyInfix = ":idempotency:"
+	idempotencyValue = "applied"
+)
+
+// claim records the idempotency key marker for the window, reporting whether it is new.
+func (b *bucket) claim(marker string) (bool, error) {
+	conn, err := b.getConn(context.Background(), marker)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	window := b.idempotencyWindow
+	if window <= 0 {
+		window = DefaultIdempotencyWindow
+	}
+	reply, err := conn.Do("SET", marker, idempotencyValue, "NX", "PX", expiryMilliseconds(window))
+	return reply != nil, err
+}
+
+// release forgets the idempotency key marker.
+func (b *bucket) release(marker string) error {
+	conn, err := b.getConn(context.Background(), marker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Do("DEL", marker)
+	return err
+}
+
+// conn returns a connection for commands on the bucket's key.
+func (b *bucket) conn(ctx context.Context) (redis.Conn, error) {
+	return b.getConn(ctx, b.key)
+}
+
+// ConnFunc returns a connection for commands on key. Storages get their connections from one:
+// from their pool, or on a cluster, to the node serving key. NewFromConnFunc takes any, such as
+// one returning a fake connection that records the commands sent to it, to test without redis.
+type ConnFunc func(ctx context.Context, key string) (redis.Conn, error)
+
+// poolConn returns a ConnFunc getting connections from pool, whatever the key.
+func poolConn(pool *redis.Pool) ConnFunc {
+	return func(ctx context.Context, key string) (redis.Conn, error) {
+		return pool.GetContext(ctx)
+	}
+}
+
+// capCount is Lua shared by the scripts below that lowers the counter at KEYS[1], read into
+// count, to the capacity ARGV[2] while keeping its expiry. A counter only exceeds the capacity
+// if it was written with a larger one, but it would then stay meaningless until it expired.
+const capCount = `
+if count > tonumber(ARGV[2]) then
+	local ttl = redis.call("PTTL", KEYS[1])
+	if ttl > 0 then
+		redis.call("SET", KEYS[1], ARGV[2], "PX", ttl)
+	end
+	count = tonumber(ARGV[2])
+end
+`
+
+// ensureExpiry is Lua shared by the scripts below that gives the counter at KEYS[1] the expiry
+// ARGV[3] if it has none, such as one left by a client that crashed between INCRBY and PEXPIRE
+// or written by hand, so that no counter outlives its window forever.
+const ensureExpiry = `
+if redis.call("PTTL", KEYS[1]) == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+`
+
+// addScript atomically increments the counter by ARGV[1] and checks it against capacity ARGV[2],
+// taking the amount back out if it doesn't fit, so that an add that fits, the common case,
+// runs no command but INCRBY and PTTL on the counter to read and write it. A counter without an
+// expiry after the INCRBY is one the add created, starting a new window, or one left without
+// one: either gets the expiry ARGV[3] in the same script, so that no counter is ever seen
+// without one. That the counter starts a window is told from its expiry rather than its count,
+// so that one a refund took back to zero keeps the window it had. If ARGV[4] is 1, every add
+// also restarts the expiry, as for Options.SlidingTTL. A full bucket's counter is left as it
+// was, capped to the capacity. It returns the resulting count, the key's PTTL, and 1 if the
+// amount was added or 0 if the bucket was full.
+var addScript = redis.NewScript(1, `
+local amount = tonumber(ARGV[1])
+local count = redis.call("INCRBY", KEYS[1], amount)
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl == -1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	ttl = tonumber(ARGV[3])
+end
+if count > tonumber(ARGV[2]) then
+	count = redis.call("DECRBY", KEYS[1], amount)
+	`+capCount+`
+	return {count, redis.call("PTTL", KEYS[1]), 0}
+end
+if ARGV[4] == "1" then
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	ttl = tonumber(ARGV[3])
+end
+return {count, ttl, 1}
+`)
+
+// add runs addScript, giving a newly started window the expiry window. Adding nothing only
+// reads the counter, rather than writing it for nothing.
+func (b *bucket) add(ctx context.Context, conn redis.Conn, amount uint, window time.Duration) (leakybucket.BucketState, error) {
+	if amount == 0 {
+		return b.peek(conn)
+	}
+	if amount > b.capacity {
+		return b.State(), leakybucket.ErrorOverCapacity
+	}
+	return b.addReply(addScript.DoContext(ctx, conn, b.addArgs(amount, window)...))
+}
+
+// addArgs returns the keys and arguments for running addScript or takeScript on the bucket.
+func (b *bucket) addArgs(amount uint, window time.Duration) []interface{} {
+	expiry := expiryMilliseconds(window)
+	sliding := 0
+	if b.slidingTTL {
+		sliding = 1
+	}
+	return []interface{}{b.key, amount, b.capacity, expiry, sliding}
+}
+
+// addReply updates the bucket from an addScript reply.
+func (b *bucket) addReply(result interface{}, err error) (leakybucket.BucketState, error) {
+	reply, err := redis.Values(result, err)
+	if err != nil {
+		return b.State(), err
+	}
+	var count, ttl, added int64
+	if _, err := redis.Scan(reply, &count, &ttl, &added); err != nil {
+		return b.State(), err
+	}
+	state := b.replyState(count, ttl)
+	if added == 0 {
+		return state, leakybucket.NewFullError(state)
+	}
+	return state, nil
+}
+
+// addWithCapacityScript atomically adds like addScript, but accepts the amount if the counter
+// stays within ARGV[5] rather than the capacity, which the counter is still kept within. It
+// returns the same reply. AddWithCapacity never runs it for an amount of 0, which only reads.
+var addWithCapacityScript = redis.NewScript(1, `
+local current = redis.call("GET", KEYS[1])
+local count = tonumber(current or "0")
+`+ensureExpiry+capCount+`
+if count + tonumber(ARGV[1]) > tonumber(ARGV[5]) then
+	return {count, redis.call("PTTL", KEYS[1]), 0}
+end
+count = math.min(count + tonumber(ARGV[1]), tonumber(ARGV[2]))
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 and ARGV[4] ~= "1" then
+	redis.call("SET", KEYS[1], count, "PX", ttl)
+else
+	redis.call("SET", KEYS[1], count, "PX", ARGV[3])
+end
+return {count, redis.call("PTTL", KEYS[1]), 1}
+`)
+
+// AddWithCapacity adds to the bucket, accepting the amount if it fits in tempCapacity minus
+// what the bucket has consumed.
+func (b *bucket) AddWithCapacity(amount, tempCapacity uint) (leakybucket.BucketState, error) {
+	if amount > tempCapacity {
+		return b.hooks.Notify(b.name)(b.State(), leakybucket.ErrorOverCapacity)
+	}
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.State(), err))
+	}
+	defer conn.Close()
+	if amount == 0 {
+		// Adding nothing is a read, as for Add.
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.peek(conn)))
+	}
+	args := append(b.addArgs(amount, b.Rate()), tempCapacity)
+	return b.failOpen.filter(b.hooks.Notify(b.name)(b.addReply(addWithCapacityScript.Do(conn, args...))))
+}
+
+// takeScript atomically increments the counter by as much of ARGV[1] as fits in capacity
+// ARGV[2], creating it with the expiry ARGV[3] like addScript when the add starts a new window,
+// or on every add if ARGV[4] is 1. It returns the resulting count, the key's PTTL, and the
+// amount added. Like addScript, it gives a counter without an expiry one, and caps it, and a
+// counter a refund took back to zero keeps the window it had.
+var takeScript = redis.NewScript(1, `
+local current = redis.call("GET", KEYS[1])
+if not current and tonumber(ARGV[1]) > 0 then
+	local amount = math.min(tonumber(ARGV[1]), tonumber(ARGV[2]))
+	redis.call("SET", KEYS[1], amount, "PX", ARGV[3], "NX")
+	return {amount, redis.call("PTTL", KEYS[1]), amount}
+end
+local count = tonumber(current or "0")
+`+ensureExpiry+capCount+`
+local amount = math.min(tonumber(ARGV[1]), math.max(tonumber(ARGV[2]) - count, 0))
+if amount > 0 then
+	count = redis.call("INCRBY", KEYS[1], amount)
+	if ARGV[4] == "1" then
+		redis.call("PEXPIRE", KEYS[1], ARGV[3])
+	end
+end
+return {count, redis.call("PTTL", KEYS[1]), amount}
+`)
+
+// TakeUpTo adds as much of amount to the bucket as fits, returning how much it added.
+func (b *bucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	var count, ttl, granted int64
+	conn, err := b.conn(context.Background())
+	if err == nil {
+		defer conn.Close()
+		var reply []interface{}
+		if reply, err = redis.Values(takeScript.Do(conn, b.addArgs(amount, b.Rate())...)); err == nil {
+			_, err = redis.Scan(reply, &count, &ttl, &granted)
+		}
+	}
+	if err != nil {
+		state, err := b.failOpen.filter(b.State(), err)
+		if err != nil {
+			return 0, state, err
+		}
+		return amount, state, nil
 	}
+	return uint(granted), b.replyState(count, ttl), nil
+}
+
+// replyState updates the bucket from the count and PTTL of its key, returning its state.
+func (b *bucket) replyState(count, ttl int64) leakybucket.BucketState {
+	// Build the state from this reply rather than the shared fields, which a concurrent Add on
+	// the same bucket may already have overwritten.
+	state := b.State()
+	state.Remaining = leakybucket.RemainingAfter(b.capacity, count)
+	if ttl >= 0 {
+		state.Reset = b.clock.Now().Add(time.Duration(ttl * millisecond))
+	} else if ttl == ttlNone {
+		// Report the window the key should have rather than a reset already past.
+		state.Reset = b.clock.Now().Add(b.Rate())
+	}
+	b.setState(state.Remaining, state.Reset)
+	return state
+}
+
+// setScript sets the counter while keeping its expiry, or gives it a new window if it had
+// none. It returns the key's PTTL.
+var setScript = redis.NewScript(1, `
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ttl)
+else
+	redis.call("SET", KEYS[1], ARGV[1], "PX", ARGV[2])
+end
+return redis.call("PTTL", KEYS[1])
+`)
 
-	conn := b.pool.Get()
+// WouldAccept reports whether adding amount would fit, reading the bucket's state without
+// adding to it. When redis fails, a bucket failing open reports that it would.
+func (b *bucket) WouldAccept(amount uint) (bool, error) {
+	state, err := b.Peek()
+	if err != nil {
+		_, err = b.failOpen.filter(state, err)
+		return err == nil, err
+	}
+	return amount <= state.Remaining, nil
+}
+
+// SetRemaining sets the remaining space in the bucket, up to its capacity, by writing the
+// counter while preserving its expiry.
+func (b *bucket) SetRemaining(n uint) error {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
 
-	ttl, err := conn.Do("PTTL", b.name)
+	remaining := leakybucket.Min(n, b.capacity)
+	expiry := expiryMilliseconds(b.Rate())
+	ttl, err := redis.Int64(setScript.Do(conn, b.key, b.capacity-remaining, expiry))
 	if err != nil {
 		return err
 	}
-	b.reset = time.Now().Add(time.Duration(ttl.(int64) * millisecond))
+	b.setState(remaining, b.clock.Now().Add(time.Duration(ttl*millisecond)))
 	return nil
 }
 
-func (b *bucket) updateOldResetWithTime(t time.Time) error {
-	if b.reset.Unix() > t.Unix() {
+// setRateScript moves the expiry of the counter by ARGV[1] milliseconds, keeping its count, or
+// deletes the counter if that ends its window. It returns the resulting count and the key's
+// PTTL.
+var setRateScript = redis.NewScript(1, `
+local ttl = redis.call("PTTL", KEYS[1])
+if ttl > 0 then
+	ttl = ttl + tonumber(ARGV[1])
+	if ttl > 0 then
+		redis.call("PEXPIRE", KEYS[1], ttl)
+	else
+		redis.call("DEL", KEYS[1])
+	end
+end
+return {tonumber(redis.call("GET", KEYS[1]) or "0"), redis.call("PTTL", KEYS[1])}
+`)
+
+// SetRate changes how long it takes for the bucket's full capacity to drain, without
+// recreating its key. The amount consumed in the current window is kept, and the window keeps
+// its start but is stretched or shortened to the new rate, ending right away if that much time
+// has already passed. Later windows are rate long. Other bucket values on the same key keep
+// their own rate until they also set it.
+func (b *bucket) SetRate(rate time.Duration) error {
+	if err := leakybucket.ValidateParams(b.capacity, rate); err != nil {
+		return err
+	}
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	b.mutex.Lock()
+	delta := rate - b.rate
+	b.rate = rate
+	b.mutex.Unlock()
+	reply, err := redis.Values(setRateScript.Do(conn, b.key, int64(delta)/millisecond))
+	if err != nil {
+		return err
+	}
+	var count, ttl int64
+	if _, err := redis.Scan(reply, &count, &ttl); err != nil {
+		return err
+	}
+	if ttl == ttlMissing {
+		b.setState(b.capacity, b.clock.Now().Add(rate))
 		return nil
 	}
+	b.replyState(count, ttl)
+	return nil
+}
+
+// refundScript decrements the counter by up to ARGV[1] if it exists, keeping its expiry. It
+// returns the resulting count and the key's PTTL.
+var refundScript = redis.NewScript(1, `
+local count = tonumber(redis.call("GET", KEYS[1]) or "0")
+local amount = math.min(tonumber(ARGV[1]), count)
+if amount > 0 then
+	count = redis.call("DECRBY", KEYS[1], amount)
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
 
-	conn := b.pool.Get()
+// Refund gives back amount to the bucket by decrementing its counter, up to its capacity.
+func (b *bucket) Refund(amount uint) (leakybucket.BucketState, error) {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.State(), err
+	}
 	defer conn.Close()
 
-	ttl, err := conn.Do("PTTL", b.name)
+	reply, err := redis.Values(refundScript.Do(conn, b.key, amount))
+	if err != nil {
+		return b.State(), err
+	}
+	var count, ttl int64
+	if _, err := redis.Scan(reply, &count, &ttl); err != nil {
+		return b.State(), err
+	}
+	if ttl == ttlMissing {
+		state := b.State()
+		state.Remaining, state.Reset = b.capacity, b.clock.Now().Add(b.Rate())
+		b.setState(state.Remaining, state.Reset)
+		return state, nil
+	}
+	return b.replyState(count, ttl), nil
+}
+
+// Drain the bucket by deleting its key.
+func (b *bucket) Drain() error {
+	conn, err := b.conn(context.Background())
 	if err != nil {
 		return err
 	}
-	b.reset = t.Add(time.Duration(ttl.(int64) * millisecond))
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", b.key); err != nil {
+		return err
+	}
+	b.setState(b.capacity, b.clock.Now().Add(b.Rate()))
 	return nil
 }
 
-// Add to the bucket.
-func (b *bucket) Add(amount uint) (leakybucket.BucketState, error) {
-	conn := b.pool.Get()
+// Peek refreshes the bucket's state from redis without adding to it.
+func (b *bucket) Peek() (leakybucket.BucketState, error) {
+	if b.getReplicaConn != nil {
+		state, err := b.peekReplica()
+		if !isReadOnly(err) {
+			return state, err
+		}
+		// Repairing the counter's expiry needs the primary.
+	}
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.State(), err
+	}
 	defer conn.Close()
+	return b.peek(conn)
+}
 
-	if count, err := conn.Do("GET", b.name); err != nil {
+// peekReplica refreshes the bucket's state from the storage's replica.
+func (b *bucket) peekReplica() (leakybucket.BucketState, error) {
+	conn, err := b.getReplicaConn(context.Background(), b.key)
+	if err != nil {
 		return b.State(), err
-	} else if count == nil {
-		b.remaining = b.capacity
-	} else if num, err := byteArrayToUint(count.([]uint8)); err != nil {
+	}
+	defer conn.Close()
+	return b.peek(conn)
+}
+
+// isReadOnly reports whether err is the error of a replica refusing a write.
+func isReadOnly(err error) bool {
+	e, ok := err.(redis.Error)
+	return ok && strings.HasPrefix(string(e), "READONLY")
+}
+
+// peekScript returns the counter at KEYS[1], or nil if there is none, and its PTTL. It makes
+// no write, so that it runs on a replica, and is a single command rather than a pipeline, so
+// that a cluster connection follows the redirections of its slot.
+var peekScript = redis.NewScript(1, `
+return {redis.call("GET", KEYS[1]), redis.call("PTTL", KEYS[1])}
+`)
+
+// peek refreshes the bucket's state with conn.
+func (b *bucket) peek(conn redis.Conn) (leakybucket.BucketState, error) {
+	reply, err := redis.Values(peekScript.Do(conn, b.key))
+	if err != nil {
+		return b.State(), err
+	}
+	var count interface{}
+	var ttl int64
+	if _, err := redis.Scan(reply, &count, &ttl); err != nil {
+		return b.State(), err
+	}
+
+	state := b.State()
+	if count == nil {
+		state.Remaining = b.capacity
+		state.Reset = b.clock.Now().Add(b.Rate())
+	} else if num, err := replyToCount(count); err != nil {
+		return b.State(), err
+	} else if reset, missing, err := b.resetFromTTL(conn, ttl); err != nil {
 		return b.State(), err
 	} else {
-		b.remaining = b.capacity - min(uint(num), b.capacity)
+		state.Remaining = leakybucket.RemainingAfter(b.capacity, num)
+		if missing {
+			// The key expired between the GET and the PTTL.
+			state.Remaining = b.capacity
+		}
+		state.Reset = reset
 	}
+	b.setState(state.Remaining, state.Reset)
+	return state, nil
+}
+
+// PTTL replies for a key with no expiry and for a missing key.
+const (
+	ttlNone    = -1
+	ttlMissing = -2
+)
 
-	if amount > b.remaining {
-		b.updateOldReset()
-		return b.State(), leakybucket.ErrorFull
+// resetFromTTL returns when the window of the bucket's key ends given its PTTL ttl, and whether
+// the key is missing, leaving the bucket empty. A key with no expiry would never reset, so it
+// is given a new window.
+func (b *bucket) resetFromTTL(conn redis.Conn, ttl int64) (time.Time, bool, error) {
+	now := b.clock.Now()
+	switch ttl {
+	case ttlMissing:
+		return now.Add(b.Rate()), true, nil
+	case ttlNone:
+		if _, err := conn.Do("PEXPIRE", b.key, expiryMilliseconds(b.Rate())); err != nil {
+			return time.Time{}, false, err
+		}
+		return now.Add(b.Rate()), false, nil
 	}
+	return now.Add(time.Duration(ttl * millisecond)), false, nil
+}
 
-	// Go y u no have Milliseconds method? Why only Seconds and Nanoseconds?
-	expiry := int(b.rate.Nanoseconds() / millisecond)
+// Storage is a redis-based leaky bucket factory. It keeps no buckets of its own: each Create
+// reads the bucket's state from redis into a new value, which is safe for concurrent use.
+type Storage struct {
+	pool              *redis.Pool
+	cluster           *cluster
+	getConn           ConnFunc
+	replica           *redis.Pool
+	clock             leakybucket.Clock
+	failOpen          failOpen
+	slidingTTL        bool
+	idempotencyWindow time.Duration
+	keyPrefix         string
+	nameHash          func(string) string
+	jitter            time.Duration
+	hooks             *leakybucket.Hooks
+	metadata          bool
+	onMismatch        func(name string, stored, given leakybucket.BucketSpec)
+}
+
+// SetClock makes the buckets created by the storage read the time from clock instead of the
+// system clock. Expiry itself is still tracked by redis in real time.
+func (s *Storage) SetClock(clock leakybucket.Clock) {
+	s.clock = clock
+}
+
+// SetHooks makes the buckets created by the storage afterwards call hooks on adds.
+func (s *Storage) SetHooks(hooks leakybucket.Hooks) {
+	s.hooks = &hooks
+}
 
-	count, err := conn.Do("INCRBY", b.name, amount)
+// Create a bucket. Creating it with a capacity below what its key's counter has consumed, such
+// as to tighten a limit, gives a full bucket, and the counter is clamped to the capacity the
+// next time an add is refused, so the excess isn't carried over.
+func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	b, _, err := s.CreateOrGet(name, capacity, rate)
+	return b, err
+}
+
+// CreateOrGet creates a bucket like Create, also reporting whether the bucket is new, that is
+// whether its key did not exist in redis.
+func (s *Storage) CreateOrGet(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, bool, error) {
+	if err := leakybucket.ValidateParams(capacity, rate); err != nil {
+		return nil, false, err
+	}
+	b := s.newBucket(name, capacity, rate)
+	created, err := b.load()
+	if err == nil && s.metadata {
+		err = s.storeMetadata(leakybucket.BucketSpec{Name: name, Capacity: capacity, Rate: rate})
+	}
 	if err != nil {
-		return b.State(), err
-	} else if uint(count.(int64)) == amount {
-		if _, err := conn.Do("PEXPIRE", b.name, expiry); err != nil {
-			return b.State(), err
+		if s.failOpen {
+			return b, false, nil
 		}
+		return nil, false, err
 	}
+	return b, created, nil
+}
 
-	b.updateOldReset()
-
-	// Ensure we can't overflow
-	b.remaining = b.capacity - min(uint(count.(int64)), b.capacity)
-	return b.State(), nil
+// newBucket returns a bucket in the state of one whose key doesn't exist yet.
+func (s *Storage) newBucket(name string, capacity uint, rate time.Duration) *bucket {
+	rate = leakybucket.JitterRate(rate, s.jitter)
+	return &bucket{
+		name:              name,
+		key:               s.key(name),
+		capacity:          capacity,
+		remaining:         capacity,
+		reset:             s.clock.Now().Add(rate),
+		rate:              rate,
+		getConn:           s.getConn,
+		getReplicaConn:    replicaConn(s.replica),
+		clock:             s.clock,
+		failOpen:          s.failOpen,
+		slidingTTL:        s.slidingTTL,
+		idempotencyWindow: s.idempotencyWindow,
+		hooks:             s.hooks,
+	}
 }
 
-func (b *bucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
-	conn := b.pool.Get()
+// load reads the bucket's state from redis, reporting whether its key was missing.
+func (b *bucket) load() (bool, error) {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return false, err
+	}
 	defer conn.Close()
-	if count, err := conn.Do("GET", b.name); err != nil {
-		return b.State(), err
+
+	if count, err := conn.Do("GET", b.key); err != nil {
+		return false, err
 	} else if count == nil {
-		b.remaining = b.capacity
-	} else if num, err := byteArrayToUint(count.([]uint8)); err != nil {
-		return b.State(), err
+		return true, nil
+	} else if ttl, err := redis.Int64(conn.Do("PTTL", b.key)); err != nil {
+		return false, err
 	} else {
-		b.remaining = b.capacity - min(uint(num), b.capacity)
+		return b.loadReply(conn, count, ttl)
 	}
+}
 
-	if amount > b.remaining {
-		b.updateOldResetWithTime(t)
-		return b.State(), leakybucket.ErrorFull
+// loadReply records the bucket's state from the replies to a GET and a PTTL of its key,
+// reporting whether the key was missing.
+func (b *bucket) loadReply(conn redis.Conn, count interface{}, ttl int64) (bool, error) {
+	if count == nil {
+		return true, nil
+	} else if num, err := replyToCount(count); err != nil {
+		return false, err
+	} else if reset, missing, err := b.resetFromTTL(conn, ttl); err != nil {
+		return false, err
+	} else if missing {
+		// The key expired between the GET and the PTTL.
+		return true, nil
+	} else {
+		b.setState(leakybucket.RemainingAfter(b.capacity, num), reset)
+		return false, nil
 	}
+}
 
-	// Go y u no have Milliseconds method? Why only Seconds and Nanoseconds?
-	expiry := int(b.rate.Nanoseconds() / millisecond)
+// CreateMulti creates several buckets, reading their keys in a single pipelined round trip to
+// redis rather than one per bucket. The returned buckets and errors correspond to specs by
+// index. A storage failing open returns the buckets it couldn't read as full ones.
+func (s *Storage) CreateMulti(specs []leakybucket.BucketSpec) ([]leakybucket.Bucket, []error) {
+	buckets := make([]leakybucket.Bucket, len(specs))
+	errs := make([]error, len(specs))
+	if s.cluster != nil || s.metadata {
+		// The keys may live on different nodes, or each bucket has its metadata to store, so
+		// read each bucket on its own.
+		for i, spec := range specs {
+			buckets[i], errs[i] = s.Create(spec.Name, spec.Capacity, spec.Rate)
+		}
+		return buckets, errs
+	}
 
-	count, err := conn.Do("INCRBY", b.name, amount)
+	created := make([]*bucket, len(specs))
+	for i, spec := range specs {
+		if errs[i] = leakybucket.ValidateParams(spec.Capacity, spec.Rate); errs[i] == nil {
+			created[i] = s.newBucket(spec.Name, spec.Capacity, spec.Rate)
+		}
+	}
+	fail := func(err error) ([]leakybucket.Bucket, []error) {
+		for i, b := range created {
+			if b == nil {
+				continue
+			}
+			if s.failOpen {
+				buckets[i] = b
+			} else {
+				errs[i] = err
+			}
+		}
+		return buckets, errs
+	}
+
+	conn, err := s.getConn(context.Background(), "")
 	if err != nil {
-		return b.State(), err
-	} else if uint(count.(int64)) == amount {
-		if _, err := conn.Do("PEXPIRE", b.name, expiry); err != nil {
-			return b.State(), err
+		return fail(err)
+	}
+	defer conn.Close()
+
+	for _, b := range created {
+		if b == nil {
+			continue
+		}
+		if err := conn.Send("GET", b.key); err != nil {
+			return fail(err)
+		}
+		if err := conn.Send("PTTL", b.key); err != nil {
+			return fail(err)
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		return fail(err)
+	}
+	counts := make([]interface{}, len(specs))
+	ttls := make([]int64, len(specs))
+	for i, b := range created {
+		if b == nil {
+			continue
+		}
+		count, err := conn.Receive()
+		ttl, ttlErr := redis.Int64(conn.Receive())
+		if err == nil {
+			err = ttlErr
+		}
+		if _, ok := err.(redis.Error); err != nil && !ok {
+			// The connection failed, rather than a command on this key.
+			return fail(err)
+		}
+		counts[i], ttls[i], errs[i] = count, ttl, err
+	}
+
+	// Only read the replies once all are in, since loadReply may send commands of its own.
+	for i, b := range created {
+		if b == nil {
+			continue
+		}
+		if errs[i] == nil {
+			_, errs[i] = b.loadReply(conn, counts[i], ttls[i])
+		}
+		if errs[i] != nil && s.failOpen {
+			errs[i] = nil
+		}
+		if errs[i] == nil {
+			buckets[i] = b
+		}
+	}
+	return buckets, errs
+}
+
+// AddMulti adds to several buckets in a single pipelined round trip to redis. The returned
+// states and errors correspond to requests by index.
+func (s *Storage) AddMulti(requests []leakybucket.Request) ([]leakybucket.BucketState, []error) {
+	states := make([]leakybucket.BucketState, len(requests))
+	errs := make([]error, len(requests))
+	buckets := make([]*bucket, len(requests))
+	for i, r := range requests {
+		buckets[i] = s.newBucket(r.Name, r.Capacity, r.Rate)
+		states[i] = buckets[i].State()
+		errs[i] = leakybucket.ValidateParams(r.Capacity, r.Rate)
+	}
+	defer func() {
+		for i := range errs {
+			states[i], errs[i] = s.failOpen.filter(states[i], errs[i])
+		}
+	}()
+
+	if s.cluster != nil {
+		// The keys may live on different nodes, so add to each bucket on its own.
+		for i, r := range requests {
+			if errs[i] == nil {
+				states[i], errs[i] = buckets[i].Add(r.Amount)
+			}
+		}
+		return states, errs
+	}
+
+	conn, err := s.getConn(context.Background(), "")
+	if err != nil {
+		for j := range errs {
+			errs[j] = err
 		}
+		return states, errs
 	}
+	defer conn.Close()
 
-	b.updateOldResetWithTime(t)
+	for i, r := range requests {
+		if errs[i] != nil {
+			continue
+		}
+		if r.Amount > r.Capacity {
+			states[i], errs[i] = buckets[i].hooks.Notify(buckets[i].name)(buckets[i].State(), leakybucket.ErrorOverCapacity)
+			continue
+		}
+		if r.Amount == 0 {
+			// Adding nothing is a read, peeked once the adds' replies are in.
+			continue
+		}
+		if err := addScript.Send(conn, buckets[i].addArgs(r.Amount, buckets[i].Rate())...); err != nil {
+			for j := range errs {
+				errs[j] = err
+			}
+			return states, errs
+		}
+	}
+	if err := conn.Flush(); err != nil {
+		for j := range errs {
+			errs[j] = err
+		}
+		return states, errs
+	}
+	for i, r := range requests {
+		if errs[i] == nil && r.Amount > 0 {
+			states[i], errs[i] = buckets[i].hooks.Notify(buckets[i].name)(buckets[i].addReply(conn.Receive()))
+		}
+	}
+	for i, r := range requests {
+		if errs[i] == nil && r.Amount == 0 {
+			states[i], errs[i] = buckets[i].hooks.Notify(buckets[i].name)(buckets[i].peek(conn))
+		}
+	}
+	return states, errs
+}
 
-	// Ensure we can't overflow
-	b.remaining = b.capacity - min(uint(count.(int64)), b.capacity)
-	return b.State(), nil
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *Storage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
 }
 
-// Storage is a redis-based, non thread-safe leaky bucket factory.
-type Storage struct {
-	pool *redis.Pool
+// Remove a bucket by deleting its key.
+func (s *Storage) Remove(name string) error {
+	key := s.key(name)
+	conn, err := s.getConn(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err = conn.Do("DEL", key); err != nil || !s.metadata {
+		return err
+	}
+	return s.removeMetadata(name)
 }
 
-// Create a bucket.
-func (s *Storage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
-	conn := s.pool.Get()
+// key returns the redis key of the named bucket.
+func (s *Storage) key(name string) string {
+	return bucketKey(s.keyPrefix, s.nameHash, name)
+}
+
+// RemovePrefix removes every bucket whose name starts with prefix, returning how many it
+// removed. It finds their keys with SCAN rather than KEYS, so as not to block redis. The
+// idempotency markers and metadata of the buckets are removed with them, without counting. With
+// NameHash set, only the empty prefix, removing every bucket, is supported.
+func (s *Storage) RemovePrefix(prefix string) (int, error) {
+	if s.nameHash != nil && prefix != "" {
+		return 0, errHashedPrefix
+	}
+	if s.cluster != nil {
+		return s.cluster.removePrefix(s.keyPrefix + prefix)
+	}
+	conn, err := s.getConn(context.Background(), "")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return removePrefix(conn, s.keyPrefix+prefix, true)
+}
+
+// Range calls fn with the name and state of each bucket starting with prefix, for a capacity of
+// capacity, until fn returns false, such as to list the limits on an admin page. Redis only
+// holds the counters, while each client creates its buckets with their capacity, so it has to
+// be given. Finding them takes a SCAN of every key with the prefix, in no particular order, and
+// a GET and a PTTL of each, so the cost grows with the number of buckets: it is meant for an
+// operator's occasional look, not for a request path. A counter without an expiry, which the
+// next add to it repairs, has the zero Reset. It isn't supported with NameHash set, since the
+// names can't be told from their keys.
+func (s *Storage) Range(prefix string, capacity uint, fn func(name string, state leakybucket.BucketState) bool) error {
+	if s.nameHash != nil {
+		return errHashedNames
+	}
+	visit := func(key string, count, ttl int64) bool {
+		state := leakybucket.BucketState{Capacity: capacity, Remaining: leakybucket.RemainingAfter(capacity, count)}
+		if ttl >= 0 {
+			state.Reset = s.clock.Now().Add(time.Duration(ttl * millisecond))
+		}
+		return fn(strings.TrimPrefix(key, s.keyPrefix), state)
+	}
+	if s.cluster != nil {
+		return s.cluster.scanCounters(s.keyPrefix+prefix, visit)
+	}
+	conn, err := s.getConn(context.Background(), "")
+	if err != nil {
+		return err
+	}
 	defer conn.Close()
+	_, err = scanCounters(conn, s.keyPrefix+prefix, visit)
+	return err
+}
 
-	if count, err := conn.Do("GET", name); err != nil {
+// FullBuckets returns the names of the buckets starting with prefix that have nothing remaining
+// for a capacity of capacity, sorted, such as to tell which tenants are being limited during an
+// incident. It reads every bucket with the prefix, as Range does, so the cost grows with the
+// number of buckets rather than of full ones.
+func (s *Storage) FullBuckets(prefix string, capacity uint) ([]string, error) {
+	var names []string
+	err := s.Range(prefix, capacity, func(name string, state leakybucket.BucketState) bool {
+		if state.Remaining == 0 {
+			names = append(names, name)
+		}
+		return true
+	})
+	if err != nil {
 		return nil, err
-	} else if count == nil {
-		b := &bucket{
-			name:      name,
-			capacity:  capacity,
-			remaining: capacity,
-			reset:     time.Now().Add(rate),
-			rate:      rate,
-			pool:      s.pool,
-		}
-		return b, nil
-	} else if num, err := byteArrayToUint(count.([]uint8)); err != nil {
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// scanCounters calls visit with the count and PTTL of each key starting with prefix on the node
+// conn is connected to, one batch of SCAN results at a time, until visit returns false, which it
+// reports by returning false too. Keys that aren't counters are skipped.
+func scanCounters(conn redis.Conn, prefix string, visit func(key string, count, ttl int64) bool) (bool, error) {
+	pattern := globEscaper.Replace(prefix) + "*"
+	cursor := int64(0)
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return false, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return false, err
+		}
+		for _, key := range keys {
+			conn.Send("GET", key)
+			conn.Send("PTTL", key)
+		}
+		if err := conn.Flush(); err != nil {
+			return false, err
+		}
+		// Read every reply of the batch, even after visit stops, to leave the connection usable.
+		more := true
+		for _, key := range keys {
+			count, err := conn.Receive()
+			if _, ok := err.(redis.Error); !ok && err != nil {
+				return false, err
+			}
+			ttl, ttlErr := redis.Int64(conn.Receive())
+			if _, ok := ttlErr.(redis.Error); !ok && ttlErr != nil {
+				return false, ttlErr
+			}
+			if err != nil || ttlErr != nil || count == nil || ttl == ttlMissing {
+				// The key holds something other than a string, or expired since the SCAN.
+				continue
+			}
+			if num, err := replyToCount(count); err == nil && more {
+				more = visit(key, num, ttl)
+			}
+		}
+		if cursor == 0 || !more {
+			return more, nil
+		}
+	}
+}
+
+// globEscaper escapes the characters special to the patterns of SCAN MATCH.
+var globEscaper = strings.NewReplacer(`\`, `\\`, "*", `\*`, "?", `\?`, "[", `\[`, "]", `\]`)
+
+// removePrefix deletes the keys starting with prefix from the node conn is connected to, one
+// batch of SCAN results at a time, returning how many buckets it removed. Each key gets its own
+// pipelined DEL, since keys in one DEL must share a hash slot on a cluster. If counters is set,
+// only the keys holding counters count as buckets: the idempotency markers and metadata hashes
+// sharing their prefix are deleted along with them, but not counted.
+func removePrefix(conn redis.Conn, prefix string, counters bool) (int, error) {
+	pattern := globEscaper.Replace(prefix) + "*"
+	removed := 0
+	cursor := int64(0)
+	for {
+		reply, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", pattern, "COUNT", 100))
+		if err != nil {
+			return removed, err
+		}
+		var keys []string
+		if _, err := redis.Scan(reply, &cursor, &keys); err != nil {
+			return removed, err
+		}
+		for _, key := range keys {
+			if counters {
+				conn.Send("GET", key)
+			}
+			conn.Send("DEL", key)
+		}
+		if err := conn.Flush(); err != nil {
+			return removed, err
+		}
+		for range keys {
+			bucket := true
+			if counters {
+				value, err := conn.Receive()
+				if _, ok := err.(redis.Error); !ok && err != nil {
+					return removed, err
+				}
+				// A key holding something other than a string, or a string that isn't a
+				// number, is another key of a bucket.
+				_, countErr := replyToCount(value)
+				bucket = err == nil && countErr == nil
+			}
+			n, err := redis.Int(conn.Receive())
+			if err != nil {
+				return removed, err
+			}
+			if bucket {
+				removed += n
+			}
+		}
+		if cursor == 0 {
+			return removed, nil
+		}
+	}
+}
+
+// Options configures the connection to redis.
+type Options struct {
+	// Password, if set, is sent with AUTH after connecting.
+	Password string
+	// DB is the database selected with SELECT after connecting.
+	DB int
+	// DialTimeout bounds how long connecting may take. Zero means no timeout.
+	DialTimeout time.Duration
+	// CommandTimeout bounds how long each command may take to be sent and to be answered, with
+	// deadlines on the connection, so that a slow redis doesn't hold up adds without a context
+	// to cancel them. A command timing out fails like redis being unreachable, which FailOpen
+	// lets through, and closes its connection. Zero means no timeout.
+	CommandTimeout time.Duration
+	// PingTimeout bounds how long creating a storage waits for redis to answer its first PING,
+	// connecting included, so that it fails rather than hangs on a server that never answers.
+	// Zero means the default of 5 seconds.
+	PingTimeout time.Duration
+	// MaxIdle is the number of idle connections kept in the pool. Zero means the default of 5.
+	MaxIdle int
+	// MaxActive limits the number of connections open at once. Zero means no limit.
+	MaxActive int
+	// UseTLS connects over TLS. It is implied by a non-nil TLSConfig.
+	UseTLS bool
+	// TLSConfig configures TLS connections. Nil means the crypto/tls defaults.
+	TLSConfig *tls.Config
+	// FailOpen lets adds through when redis fails, such as when it is unreachable: instead of
+	// the error, buckets return their last known state as if the add had fit. Creating a bucket
+	// then gives a full one. ErrorFull, ErrorOverCapacity and ErrorInvalidParams are still
+	// returned. The default is to fail closed, returning the error.
+	FailOpen bool
+	// KeyPrefix is prepended to bucket names to make their redis keys, so that several apps can
+	// share a redis without their buckets colliding.
+	KeyPrefix string
+	// NameHash, if set, maps bucket names to what follows KeyPrefix in their redis keys, such as
+	// HashName does, so that long names, such as whole URLs, don't bloat the memory of redis.
+	// Buckets still report their names from Name. Keys then share no prefixes but that of
+	// KeyPrefix, so RemovePrefix only takes the empty prefix and FullBuckets isn't supported,
+	// and the hash tags of names no longer pick their cluster slots. Setting it or changing it
+	// moves every bucket to a new key, starting them empty.
+	NameHash func(name string) string
+	// Jitter randomizes the window length of each bucket created within its rate plus or minus
+	// Jitter, so that buckets created in a burst don't all reset at once. Zero means no jitter.
+	Jitter time.Duration
+	// SlidingTTL makes every add that fits restart the expiry of the bucket's counter, so that
+	// the bucket drains a full rate after its last accepted add rather than a rate after the
+	// add that started its window. A bucket kept busy then doesn't drain at all: it accepts
+	// capacity in total until adds pause for a full rate. Rejected adds don't restart the
+	// expiry. The default is fixed windows, each draining a rate after it started. Sliding window
+	// storages ignore it.
+	SlidingTTL bool
+	// ReplicaAddress, if set, is the address of a replica of the redis at the address given to
+	// NewWithOptions, reached over the same network with the same options, that the Peek and
+	// WouldAccept of its buckets read from, so that read-heavy uses such as dashboards don't
+	// load the primary. Adds and other writes still go to the primary. A replica lags behind its
+	// primary, so what they read may miss the latest adds, by as long as the replication lag.
+	// NewCluster ignores it.
+	ReplicaAddress string
+	// IdempotencyWindow is how long AddIdempotent remembers the idempotency keys of the adds it
+	// applied, so how long after an add its retries are still told apart. Zero means
+	// DefaultIdempotencyWindow.
+	IdempotencyWindow time.Duration
+	// Metadata makes Create store the capacity and rate of each bucket in a hash next to its
+	// counter, since the counter alone doesn't tell which ones its clients use, so that Metadata
+	// can tell them after a restart, and Create can call OnMetadataMismatch when they change
+	// across deploys. It costs a script run on every Create, and CreateMulti then creates one
+	// bucket at a time.
+	Metadata bool
+	// OnMetadataMismatch, if set, is called by Create with Metadata set when the bucket was last
+	// created with another capacity or rate, such as to log the limit drifting. Create still
+	// uses those it is given, and stores them in place of the others.
+	OnMetadataMismatch func(name string, stored, given leakybucket.BucketSpec)
+}
+
+// DefaultIdempotencyWindow is how long AddIdempotent remembers idempotency keys unless
+// Options.IdempotencyWindow says otherwise, long enough for the retries of most clients.
+const DefaultIdempotencyWindow = 10 * time.Minute
+
+// failOpen is whether adds are let through when redis fails.
+type failOpen bool
+
+// filter lets an add through despite err if it fails open and err is a failure of redis rather
+// than a verdict on the add. The caller's own context ending is neither, so it is returned.
+func (f failOpen) filter(state leakybucket.BucketState, err error) (leakybucket.BucketState, error) {
+	if bool(f) && err != nil && !errors.Is(err, leakybucket.ErrorFull) && err != leakybucket.ErrorOverCapacity &&
+		err != leakybucket.ErrorInvalidParams && !errors.Is(err, context.Canceled) &&
+		!errors.Is(err, context.DeadlineExceeded) {
+		return state, nil
+	}
+	return state, err
+}
+
+// defaultMaxIdle is the pool size New has always used.
+const defaultMaxIdle = 5
+
+var errUnixTLS = errors.New("redis: TLS is not supported over unix sockets")
+
+var (
+	errHashedPrefix = errors.New("redis: bucket names are hashed, so their keys share no prefixes")
+	errHashedNames  = errors.New("redis: bucket names are hashed, so they can't be listed")
+)
+
+// HashName returns the hex SHA-1 of a bucket name, 40 characters however long the name is, for
+// Options.NameHash.
+func HashName(name string) string {
+	sum := sha1.Sum([]byte(name))
+	return hex.EncodeToString(sum[:])
+}
+
+// bucketKey returns the redis key of the named bucket: its name, hashed by hash unless it is
+// nil, after prefix.
+func bucketKey(prefix string, hash func(string) string, name string) string {
+	if hash != nil {
+		name = hash(name)
+	}
+	return prefix + name
+}
+
+// defaultPingTimeout is how long creating a storage waits for its first PING by default.
+const defaultPingTimeout = 5 * time.Second
+
+func (o Options) dialOptions() []redis.DialOption {
+	opts := []redis.DialOption{redis.DialDatabase(o.DB)}
+	if o.Password != "" {
+		opts = append(opts, redis.DialPassword(o.Password))
+	}
+	if o.DialTimeout > 0 {
+		opts = append(opts, redis.DialConnectTimeout(o.DialTimeout))
+	}
+	if o.CommandTimeout > 0 {
+		opts = append(opts, redis.DialReadTimeout(o.CommandTimeout), redis.DialWriteTimeout(o.CommandTimeout))
+	}
+	if o.UseTLS || o.TLSConfig != nil {
+		opts = append(opts, redis.DialUseTLS(true))
+	}
+	if o.TLSConfig != nil {
+		opts = append(opts, redis.DialTLSConfig(o.TLSConfig))
+	}
+	return opts
+}
+
+// New initializes the connection to redis, configured by any opts. network is "tcp" for an
+// address of host:port, or "unix" for the path of a unix socket, which saves the TCP overhead
+// when redis runs on the same host. Redis doesn't serve TLS on unix sockets, so the TLS options
+// are an error with one.
+func New(network, address string, opts ...Option) (*Storage, error) {
+	return NewWithOptions(network, address, newOptions(opts))
+}
+
+// NewWithOptions initializes the connection to redis, configured by opts.
+func NewWithOptions(network, address string, opts Options) (*Storage, error) {
+	pool, replica, err := newPools(network, address, opts)
+	if err != nil {
 		return nil, err
-	} else if ttl, err := conn.Do("PTTL", name); err != nil {
+	}
+	s := newStorage(opts)
+	s.pool, s.replica, s.getConn = pool, replica, poolConn(pool)
+	return s, nil
+}
+
+// newPools returns the pool of connections to redis at address, and to the replica at
+// opts.ReplicaAddress or nil if it is not set, configured by opts.
+func newPools(network, address string, opts Options) (*redis.Pool, *redis.Pool, error) {
+	pool, err := newPool(network, address, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	if opts.ReplicaAddress == "" {
+		return pool, nil, nil
+	}
+	replica, err := newPool(network, opts.ReplicaAddress, opts)
+	if err != nil {
+		pool.Close()
+		return nil, nil, err
+	}
+	return pool, replica, nil
+}
+
+// replicaConn returns a ConnFunc getting connections from the pool of a storage's replica, or
+// nil if it has none.
+func replicaConn(replica *redis.Pool) ConnFunc {
+	if replica == nil {
+		return nil
+	}
+	return poolConn(replica)
+}
+
+// NewCluster initializes the connection to a Redis Cluster, configured by any opts, given the
+// addresses of some of its nodes. Commands on each bucket go to the node serving the hash slot
+// of its key, following the redirections of slots that move between nodes. The DB option
+// doesn't apply, since a cluster only has database 0.
+func NewCluster(addrs []string, opts ...Option) (*Storage, error) {
+	o := newOptions(opts)
+	o.DB = 0
+	c := newCluster(addrs, o)
+	if err := c.refresh(); err != nil {
 		return nil, err
-	} else {
-		b := &bucket{
-			name:      name,
-			capacity:  capacity,
-			remaining: capacity - min(capacity, num),
-			reset:     time.Now().Add(time.Duration(ttl.(int64) * millisecond)),
-			rate:      rate,
-			pool:      s.pool,
-		}
-		return b, nil
 	}
+	s := newStorage(o)
+	s.cluster, s.getConn = c, c.get
+	return s, nil
 }
 
-// New initializes the connection to redis.
-func New(network, address string) (*Storage, error) {
-	s := &Storage{
-		pool: redis.NewPool(func() (redis.Conn, error) {
-			return redis.Dial(network, address)
-		}, 5)}
-	// When using a connection pool, you only get connection errors while trying to send commands.
-	// Try to PING so we can fail-fast in the case of invalid address.
-	conn := s.pool.Get()
-	defer conn.Close()
-	if _, err := conn.Do("PING"); err != nil {
+// newStorage returns a storage configured by opts, without its connections.
+func newStorage(opts Options) *Storage {
+	return &Storage{
+		clock:             leakybucket.RealClock{},
+		failOpen:          failOpen(opts.FailOpen),
+		slidingTTL:        opts.SlidingTTL,
+		idempotencyWindow: opts.IdempotencyWindow,
+		keyPrefix:         opts.KeyPrefix,
+		nameHash:          opts.NameHash,
+		jitter:            opts.Jitter,
+		metadata:          opts.Metadata,
+		onMismatch:        opts.OnMetadataMismatch,
+	}
+}
+
+// NewFromPool initializes a storage on a pool of connections to redis that the caller
+// manages, such as one shared with other uses of redis. Closing the pool is left to the caller.
+func NewFromPool(pool *redis.Pool) (*Storage, error) {
+	if err := ping(pool, defaultPingTimeout); err != nil {
 		return nil, err
 	}
+	s := newStorage(Options{})
+	s.pool, s.getConn = pool, poolConn(pool)
 	return s, nil
 }
 
-func min(a, b uint) uint {
-	if a < b {
-		return a
+// NewFromConnFunc initializes a storage that gets each of its connections from conn. Unlike
+// the other constructors, it doesn't check that redis can be reached, so that conn may return
+// fake connections in tests.
+func NewFromConnFunc(conn ConnFunc) *Storage {
+	s := newStorage(Options{})
+	s.getConn = conn
+	return s
+}
+
+// newPool returns a pool of connections to redis, configured by opts, once it has checked that
+// they can be made.
+func newPool(network, address string, opts Options) (*redis.Pool, error) {
+	if network == "unix" && (opts.UseTLS || opts.TLSConfig != nil) {
+		return nil, errUnixTLS
+	}
+	pool := poolFor(network, address, opts)
+	timeout := opts.PingTimeout
+	if timeout == 0 {
+		timeout = defaultPingTimeout
+	}
+	if err := ping(pool, timeout); err != nil {
+		return nil, err
+	}
+	return pool, nil
+}
+
+// poolFor returns a pool of connections to redis, configured by opts.
+func poolFor(network, address string, opts Options) *redis.Pool {
+	dialOptions := opts.dialOptions()
+	maxIdle := opts.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = defaultMaxIdle
 	}
-	return b
+	return &redis.Pool{
+		DialContext: func(ctx context.Context) (redis.Conn, error) {
+			return redis.DialContext(ctx, network, address, dialOptions...)
+		},
+		MaxIdle:   maxIdle,
+		MaxActive: opts.MaxActive,
+	}
+}
+
+// ping checks that pool can reach redis.
+func ping(pool *redis.Pool, timeout time.Duration) error {
+	// When using a connection pool, you only get connection errors while trying to send commands.
+	// Try to PING so we can fail-fast in the case of invalid address or TLS misconfiguration.
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	conn, err := pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = redis.DoContext(conn, ctx, "PING")
+	return err
 }
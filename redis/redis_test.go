@@ -1,8 +1,16 @@
 package redis
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"github.com/bububa/leakybucket"
+	"github.com/bububa/redigo/redis"
+	"net"
 	"os"
+	"reflect"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -33,42 +41,1422 @@ func TestInvalidHost(t *testing.T) {
 	}
 }
 
+func TestNewFromPool(t *testing.T) {
+	flushDb()
+	pool := redis.NewPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", os.Getenv("REDIS_URL"))
+	}, 1)
+	defer pool.Close()
+	storage, err := NewFromPool(pool)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := storage.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(3); err != nil {
+		t.Fatal(err)
+	}
+
+	conn := pool.Get()
+	defer conn.Close()
+	if count, err := redis.Int(conn.Do("GET", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if count != 3 {
+		t.Fatalf("expected the pool's redis to count 3, received %d", count)
+	}
+}
+
+func TestNewFromPoolInvalidHost(t *testing.T) {
+	pool := redis.NewPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", "localhost:6378")
+	}, 1)
+	defer pool.Close()
+	if _, err := NewFromPool(pool); err == nil {
+		t.Fatalf("expected error connecting to invalid host")
+	}
+}
+
+func TestSelectDB(t *testing.T) {
+	flushDb()
+	other, err := NewWithOptions("tcp", os.Getenv("REDIS_URL"), Options{DB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := other.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("FLUSHDB"); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := other.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := conn.Do("EXISTS", "testbucket"); err != nil {
+		t.Fatal(err)
+	} else if exists.(int64) != 1 {
+		t.Fatal("expected bucket to be stored in DB 1")
+	}
+
+	// The default DB must not see the bucket.
+	bucket, err = getLocalStorage().Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if remaining := bucket.Remaining(); remaining != 10 {
+		t.Fatalf("expected %d remaining in DB 0, got %d", 10, remaining)
+	}
+}
+
+func TestPoolSize(t *testing.T) {
+	s, err := NewWithOptions("tcp", os.Getenv("REDIS_URL"), Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.pool.MaxIdle != defaultMaxIdle || s.pool.MaxActive != 0 {
+		t.Fatalf("expected default pool of %d idle and unlimited active, got %d and %d",
+			defaultMaxIdle, s.pool.MaxIdle, s.pool.MaxActive)
+	}
+
+	s, err = NewWithOptions("tcp", os.Getenv("REDIS_URL"), Options{MaxIdle: 20, MaxActive: 50})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.pool.MaxIdle != 20 || s.pool.MaxActive != 50 {
+		t.Fatalf("expected pool of %d idle and %d active, got %d and %d",
+			20, 50, s.pool.MaxIdle, s.pool.MaxActive)
+	}
+}
+
+// TestTLS runs against a TLS-enabled redis at REDIS_TLS_URL, if there is one.
+func TestTLS(t *testing.T) {
+	address := os.Getenv("REDIS_TLS_URL")
+	if address == "" {
+		t.Skip("REDIS_TLS_URL is not set")
+	}
+	s, err := NewWithOptions("tcp", address, Options{TLSConfig: &tls.Config{InsecureSkipVerify: true}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 9 {
+		t.Fatalf("expected %d remaining, got %d", 9, state.Remaining)
+	}
+}
+
+// TestUnixSocket runs against a redis listening on the unix socket at REDIS_SOCKET, if there is
+// one.
+func TestUnixSocket(t *testing.T) {
+	path := os.Getenv("REDIS_SOCKET")
+	if path == "" {
+		t.Skip("REDIS_SOCKET is not set")
+	}
+	s, err := New("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bucket.Drain(); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 9 {
+		t.Fatalf("expected %d remaining, got %d", 9, state.Remaining)
+	}
+}
+
+// TestCounterOutOfRange checks that a counter over the capacity of the bucket, as after its
+// capacity shrank, or below zero leaves none or all of it rather than wrapping around.
+func TestCounterOutOfRange(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(8); err != nil {
+		t.Fatal(err)
+	}
+	if bucket, err = s.Create("testbucket", 5, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Remaining() != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, bucket.Remaining())
+	}
+	if state, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	} else if state.Remaining != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", "testbucket", -3, "PX", 60000); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucket.Peek(); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 5 {
+		t.Fatalf("expected %d remaining, got %d", 5, state.Remaining)
+	}
+}
+
+// TestAddAfterExpiry checks that an add reports the window it finds in redis, rather than the
+// state the bucket last saw, when the counter expired or was refunded to zero since.
+func TestAddAfterExpiry(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := bucket.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	// The counter expires between this add and the next.
+	if _, err := conn.Do("PEXPIRE", "testbucket", 1); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	state, err := bucket.Add(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != 3 {
+		t.Fatalf("expected %d remaining, got %d", 3, state.Remaining)
+	}
+	if until := time.Until(state.Reset); until < 59*time.Second || until > time.Minute {
+		t.Fatalf("expected a new window of a minute, got one ending in %v", until)
+	}
+
+	// A counter refunded to zero keeps its window, here as if half of it had passed.
+	if _, err := bucket.Refund(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Do("PEXPIRE", "testbucket", 30000); err != nil {
+		t.Fatal(err)
+	}
+	if state, err = bucket.Add(1); err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != 4 {
+		t.Fatalf("expected %d remaining, got %d", 4, state.Remaining)
+	}
+	if until := time.Until(state.Reset); until > 30*time.Second {
+		t.Fatalf("expected the window to keep its reset in 30s, got one ending in %v", until)
+	}
+}
+
+// TestTakeUpToAfterRefund checks that TakeUpTo on a counter a refund took back to zero keeps
+// the window the counter had, like Add does.
+func TestTakeUpToAfterRefund(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := bucket.Add(2); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Refund(2); err != nil {
+		t.Fatal(err)
+	}
+	// As if half of the window had passed.
+	if _, err := conn.Do("PEXPIRE", "testbucket", 30000); err != nil {
+		t.Fatal(err)
+	}
+	granted, state, err := bucket.TakeUpTo(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if granted != 3 || state.Remaining != 2 {
+		t.Fatalf("expected %d granted and %d remaining, got %d and %d", 3, 2, granted, state.Remaining)
+	}
+	if until := time.Until(state.Reset); until > 30*time.Second {
+		t.Fatalf("expected the window to keep its reset in 30s, got one ending in %v", until)
+	}
+}
+
+// TestReplica checks that peeks read from the replica while adds go to the primary, using a
+// replica that can't be reached.
+func TestReplica(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	s.replica = redis.NewPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", "localhost:6378")
+	}, 1)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 9 {
+		t.Fatalf("expected %d remaining, got %d", 9, state.Remaining)
+	}
+	if _, err := bucket.Peek(); err == nil {
+		t.Fatal("expected peeking from an unreachable replica to fail")
+	}
+}
+
+func TestIsReadOnly(t *testing.T) {
+	if !isReadOnly(redis.Error("READONLY You can't write against a read only replica.")) {
+		t.Fatal("expected a READONLY reply to be read-only")
+	}
+	if isReadOnly(redis.Error("ERR unknown command")) || isReadOnly(errors.New("READONLY")) {
+		t.Fatal("expected only READONLY replies to be read-only")
+	}
+}
+
+func TestUnixSocketTLS(t *testing.T) {
+	for _, opts := range []Options{{UseTLS: true}, {TLSConfig: &tls.Config{}}} {
+		if _, err := NewWithOptions("unix", "/tmp/redis.sock", opts); err != errUnixTLS {
+			t.Fatalf("expected errUnixTLS, received %v", err)
+		}
+	}
+}
+
+func TestTLSAgainstPlainServer(t *testing.T) {
+	_, err := NewWithOptions("tcp", os.Getenv("REDIS_URL"), Options{UseTLS: true, DialTimeout: time.Second})
+	if err == nil {
+		t.Fatalf("expected error speaking TLS to a plain redis")
+	}
+}
+
+// unreachableStorage returns a storage whose redis is down, bypassing the fail-fast PING of New.
+func unreachableStorage(open bool) *Storage {
+	pool := redis.NewPool(func() (redis.Conn, error) {
+		return redis.Dial("tcp", "localhost:6378")
+	}, 1)
+	return &Storage{
+		pool:     pool,
+		getConn:  poolConn(pool),
+		clock:    leakybucket.RealClock{},
+		failOpen: failOpen(open),
+	}
+}
+
+// fakeConn is a connection that records the commands sent to it and answers them from replies,
+// keyed by command name.
+type fakeConn struct {
+	commands []string
+	replies  map[string]interface{}
+}
+
+func (c *fakeConn) Close() error { return nil }
+func (c *fakeConn) Err() error   { return nil }
+
+func (c *fakeConn) Do(command string, args ...interface{}) (interface{}, error) {
+	c.commands = append(c.commands, command)
+	return c.replies[command], nil
+}
+
+func (c *fakeConn) DoContext(ctx context.Context, command string, args ...interface{}) (interface{}, error) {
+	return c.Do(command, args...)
+}
+
+func (c *fakeConn) Send(command string, args ...interface{}) error {
+	c.commands = append(c.commands, command)
+	return nil
+}
+
+func (c *fakeConn) Flush() error { return nil }
+
+func (c *fakeConn) Receive() (interface{}, error) {
+	return nil, errors.New("fakeConn: Receive is not supported")
+}
+
+func (c *fakeConn) ReceiveContext(ctx context.Context) (interface{}, error) {
+	return c.Receive()
+}
+
+func TestFakeConn(t *testing.T) {
+	conn := &fakeConn{replies: map[string]interface{}{
+		// A count of 1 with a minute left, after adding.
+		"EVALSHA": []interface{}{int64(1), int64(60000), int64(1)},
+	}}
+	var keys []string
+	s := NewFromConnFunc(func(ctx context.Context, key string) (redis.Conn, error) {
+		keys = append(keys, key)
+		return conn, nil
+	})
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := bucket.Add(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != 4 {
+		t.Fatalf("expected %d remaining, got %d", 4, state.Remaining)
+	}
+	if !reflect.DeepEqual(conn.commands, []string{"GET", "EVALSHA"}) {
+		t.Fatalf("expected a GET then an EVALSHA, got %v", conn.commands)
+	}
+	if !reflect.DeepEqual(keys, []string{"testbucket", "testbucket"}) {
+		t.Fatalf("expected both connections for the bucket's key, got %v", keys)
+	}
+}
+
+// TestFakeConnPeek checks that Peek reads the counter with a single command rather than a
+// pipeline, which a cluster connection couldn't redirect.
+func TestFakeConnPeek(t *testing.T) {
+	conn := &fakeConn{replies: map[string]interface{}{
+		// A count of 2 with half a minute left.
+		"EVALSHA": []interface{}{[]byte("2"), int64(30000)},
+	}}
+	s := NewFromConnFunc(func(ctx context.Context, key string) (redis.Conn, error) {
+		return conn, nil
+	})
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := bucket.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != 3 {
+		t.Fatalf("expected %d remaining, got %d", 3, state.Remaining)
+	}
+	if !reflect.DeepEqual(conn.commands, []string{"GET", "EVALSHA"}) {
+		t.Fatalf("expected a GET then an EVALSHA, got %v", conn.commands)
+	}
+}
+
+// TestConcurrentAdd shares one bucket between goroutines adding to and reading it, which run
+// with -race checks doesn't race on the bucket's state.
+func TestConcurrentAdd(t *testing.T) {
+	flushDb()
+	bucket, err := getLocalStorage().Create("testbucket", 50, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, err := bucket.Add(1); err != nil {
+				t.Error(err)
+			}
+			bucket.Remaining()
+			bucket.Reset()
+		}()
+	}
+	wg.Wait()
+	if state, err := bucket.Peek(); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+	}
+}
+
+// TestConcurrentFirstAccess has goroutines create and add to a bucket whose key doesn't exist
+// yet, all at once, as on a cold start.
+func TestConcurrentFirstAccess(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	var (
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		granted int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bucket, err := s.Create("testbucket", 10, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if _, err := bucket.Add(1); err == nil {
+				mutex.Lock()
+				granted++
+				mutex.Unlock()
+			} else if !errors.Is(err, leakybucket.ErrorFull) {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+	if granted != 10 {
+		t.Fatalf("expected %d adds granted, got %d", 10, granted)
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if count, err := redis.Int(conn.Do("GET", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if count != 10 {
+		t.Fatalf("expected the counter at %d, got %d", 10, count)
+	}
+	if ttl, err := redis.Int64(conn.Do("PTTL", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if ttl <= 0 || ttl > int64(time.Minute/time.Millisecond) {
+		t.Fatalf("expected the key to expire within the rate, received PTTL %d", ttl)
+	}
+}
+
+func TestPingTimeout(t *testing.T) {
+	// A server that accepts connections but never answers.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	start := time.Now()
+	if _, err := New("tcp", listener.Addr().String(), WithPingTimeout(100*time.Millisecond)); err == nil {
+		t.Fatal("expected New to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected New to give up after %s, took %s", 100*time.Millisecond, elapsed)
+	}
+}
+
+func TestCommandTimeout(t *testing.T) {
+	// A server that answers the PING of New, then nothing more.
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			go func() {
+				buf := make([]byte, 64)
+				if _, err := conn.Read(buf); err == nil {
+					conn.Write([]byte("+PONG\r\n"))
+				}
+			}()
+		}
+	}()
+
+	s, err := New("tcp", listener.Addr().String(), WithCommandTimeout(100*time.Millisecond))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := s.Create("testbucket", 10, time.Minute); err == nil {
+		t.Fatal("expected Create to time out")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected Create to give up after %s, took %s", 100*time.Millisecond, elapsed)
+	}
+}
+
+func TestFullCounterCapped(t *testing.T) {
+	flushDb()
+	bucket, err := getLocalStorage().Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(5); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 50; i++ {
+		if _, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		}
+	}
+	conn := getLocalStorage().pool.Get()
+	defer conn.Close()
+	if count, err := redis.Int(conn.Do("GET", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if count != 5 {
+		t.Fatalf("expected the counter to stay at %d, got %d", 5, count)
+	}
+
+	// A counter left over from a larger capacity is lowered to this one's.
+	if _, err := conn.Do("SET", "testbucket", 100, "PX", 60000); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	} else if state.Remaining != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+	}
+	if count, err := redis.Int(conn.Do("GET", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if count != 5 {
+		t.Fatalf("expected the counter to be capped at %d, got %d", 5, count)
+	}
+	if ttl, err := redis.Int64(conn.Do("PTTL", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if ttl <= 0 {
+		t.Fatalf("expected the capped counter to keep its expiry, got PTTL %d", ttl)
+	}
+}
+
+func TestExpiryMilliseconds(t *testing.T) {
+	for d, expected := range map[time.Duration]int64{
+		time.Nanosecond:            1,
+		500 * time.Microsecond:     1,
+		time.Millisecond:           1,
+		1500 * time.Microsecond:    2,
+		time.Minute:                60000,
+		100 * 365 * 24 * time.Hour: 3153600000000,
+		0:                          1,
+	} {
+		if ms := expiryMilliseconds(d); ms != expected {
+			t.Fatalf("expected %s to expire in %dms, got %dms", d, expected, ms)
+		}
+	}
+}
+
+func TestFailOpen(t *testing.T) {
+	s := unreachableStorage(true)
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatalf("expected Create to fail open, received %v", err)
+	}
+	if state, err := bucket.Add(1); err != nil {
+		t.Fatalf("expected Add to fail open, received %v", err)
+	} else if state.Capacity != 10 {
+		t.Fatalf("expected capacity %d, got %d", 10, state.Capacity)
+	}
+	if _, err := bucket.Add(11); err != leakybucket.ErrorOverCapacity {
+		t.Fatalf("expected ErrorOverCapacity, received %v", err)
+	}
+	_, errs := s.AddMulti([]leakybucket.Request{{Name: "testbucket", Capacity: 10, Rate: time.Minute, Amount: 1}})
+	if errs[0] != nil {
+		t.Fatalf("expected AddMulti to fail open, received %v", errs[0])
+	}
+}
+
+// TestFailOpenCanceled checks that failing open doesn't let an add through when the caller's
+// own context ended, rather than redis failing.
+func TestFailOpenCanceled(t *testing.T) {
+	s := NewFromConnFunc(func(ctx context.Context, key string) (redis.Conn, error) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("redis is down")
+	})
+	s.failOpen = true
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatalf("expected Create to fail open, received %v", err)
+	}
+	if _, err := bucket.Add(1); err != nil {
+		t.Fatalf("expected Add to fail open, received %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := bucket.AddContext(ctx, 1); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, received %v", err)
+	}
+	ctx, cancel = context.WithDeadline(context.Background(), time.Now())
+	defer cancel()
+	if _, err := bucket.AddContext(ctx, 1); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, received %v", err)
+	}
+}
+
+func TestFailClosed(t *testing.T) {
+	if _, err := unreachableStorage(false).Create("testbucket", 10, time.Minute); err == nil {
+		t.Fatal("expected an error from an unreachable redis")
+	}
+}
+
 func TestCreate(t *testing.T) {
 	flushDb()
-	leakybucket.CreateTest(getLocalStorage())(t)
+	leakybucket.CreateTest(getLocalStorage())(t)
+}
+
+func TestCreateMulti(t *testing.T) {
+	flushDb()
+	leakybucket.CreateMultiTest(getLocalStorage())(t)
+}
+
+func TestInvalidParams(t *testing.T) {
+	flushDb()
+	leakybucket.InvalidParamsTest(getLocalStorage())(t)
+}
+
+func TestAdd(t *testing.T) {
+	flushDb()
+	leakybucket.AddTest(getLocalStorage())(t)
+}
+
+func TestAddZero(t *testing.T) {
+	flushDb()
+	leakybucket.AddZeroTest(getLocalStorage())(t)
+}
+
+func TestAddOverCapacity(t *testing.T) {
+	flushDb()
+	leakybucket.AddOverCapacityTest(getLocalStorage())(t)
+}
+
+func TestTryAdd(t *testing.T) {
+	flushDb()
+	leakybucket.TryAddTest(getLocalStorage())(t)
+}
+
+func TestAddWithCapacity(t *testing.T) {
+	flushDb()
+	leakybucket.AddWithCapacityTest(getLocalStorage())(t)
+}
+
+func TestFullError(t *testing.T) {
+	flushDb()
+	leakybucket.FullErrorTest(getLocalStorage())(t)
+}
+
+func TestAddDetailed(t *testing.T) {
+	flushDb()
+	leakybucket.AddDetailedTest(getLocalStorage())(t)
+}
+
+func TestAllow(t *testing.T) {
+	flushDb()
+	leakybucket.AllowTest(getLocalStorage())(t)
+}
+
+func TestTakeUpTo(t *testing.T) {
+	flushDb()
+	leakybucket.TakeUpToTest(getLocalStorage())(t)
+}
+
+func TestAddMulti(t *testing.T) {
+	flushDb()
+	leakybucket.AddMultiTest(getLocalStorage())(t)
+}
+
+// TestAddMultiZero checks that a request adding nothing reads its bucket without creating its
+// counter, as Add(0) does.
+func TestAddMultiZero(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	states, errs := s.AddMulti([]leakybucket.Request{
+		{Name: "testbucket1", Capacity: 10, Rate: time.Minute, Amount: 3},
+		{Name: "testbucket2", Capacity: 5, Rate: time.Minute, Amount: 0},
+		{Name: "testbucket1", Capacity: 10, Rate: time.Minute, Amount: 0},
+	})
+	for i, remaining := range []uint{7, 5, 7} {
+		if errs[i] != nil {
+			t.Fatalf("request %d: %v", i, errs[i])
+		}
+		if states[i].Remaining != remaining {
+			t.Fatalf("request %d: expected %d remaining, got %d", i, remaining, states[i].Remaining)
+		}
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if exists, err := redis.Bool(conn.Do("EXISTS", "testbucket2")); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("expected adding nothing not to create the counter")
+	}
+}
+
+func TestThreadSafeAdd(t *testing.T) {
+	flushDb()
+	leakybucket.ThreadSafeAddTest(getLocalStorage())(t)
+}
+
+func TestConcurrentCapacity(t *testing.T) {
+	flushDb()
+	leakybucket.ConcurrentCapacityTest(getLocalStorage())(t)
+}
+
+func TestReset(t *testing.T) {
+	flushDb()
+	leakybucket.AddResetTest(getLocalStorage())(t)
+}
+
+func TestShortRate(t *testing.T) {
+	flushDb()
+	leakybucket.ShortRateTest(getLocalStorage())(t)
+}
+
+func TestFindOrCreate(t *testing.T) {
+	flushDb()
+	leakybucket.FindOrCreateTest(getLocalStorage())(t)
+}
+
+func TestBucketInstanceConsistencyTest(t *testing.T) {
+	flushDb()
+	leakybucket.BucketInstanceConsistencyTest(getLocalStorage())(t)
+}
+
+func TestAddContext(t *testing.T) {
+	flushDb()
+	leakybucket.AddContextTest(getLocalStorage())(t)
+}
+
+func TestAddWithTime(t *testing.T) {
+	flushDb()
+	leakybucket.AddWithTimeTest(getLocalStorage())(t)
+}
+
+func TestPeek(t *testing.T) {
+	flushDb()
+	leakybucket.PeekTest(getLocalStorage())(t)
+}
+
+func TestWouldAccept(t *testing.T) {
+	flushDb()
+	leakybucket.WouldAcceptTest(getLocalStorage())(t)
+}
+
+func TestHooks(t *testing.T) {
+	flushDb()
+	leakybucket.HooksTest(getLocalStorage())(t)
+}
+
+func TestRemove(t *testing.T) {
+	flushDb()
+	leakybucket.RemoveTest(getLocalStorage())(t)
+}
+
+func TestRemovePrefix(t *testing.T) {
+	flushDb()
+	leakybucket.RemovePrefixTest(getLocalStorage())(t)
+}
+
+// TestRemovePrefixCompanions checks that RemovePrefix counts buckets rather than the keys it
+// deletes, which include the idempotency markers and metadata of the buckets.
+func TestRemovePrefixCompanions(t *testing.T) {
+	flushDb()
+	s, err := New("tcp", os.Getenv("REDIS_URL"), WithMetadata(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := s.Create("testbucket", 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.(leakybucket.IdempotentAdder).AddIdempotent("request1", 1); err != nil {
+		t.Fatal(err)
+	}
+	if removed, err := s.RemovePrefix("test"); err != nil {
+		t.Fatal(err)
+	} else if removed != 1 {
+		t.Fatalf("expected %d removed, got %d", 1, removed)
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if n, err := redis.Int(conn.Do("DBSIZE")); err != nil {
+		t.Fatal(err)
+	} else if n != 0 {
+		t.Fatalf("expected every key of the bucket to be removed, %d left", n)
+	}
+}
+
+func TestSetRemaining(t *testing.T) {
+	flushDb()
+	leakybucket.SetRemainingTest(getLocalStorage())(t)
+}
+
+func TestDrain(t *testing.T) {
+	flushDb()
+	leakybucket.DrainTest(getLocalStorage())(t)
+}
+
+func TestRefund(t *testing.T) {
+	flushDb()
+	leakybucket.RefundTest(getLocalStorage())(t)
+}
+
+func TestAddHierarchical(t *testing.T) {
+	flushDb()
+	leakybucket.AddHierarchicalTest(getLocalStorage())(t)
+}
+
+func TestCreateOrGet(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	bucket, created, err := s.CreateOrGet("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	} else if !created {
+		t.Fatal("expected a missing key to be reported as new")
+	}
+	if _, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, created, err := s.CreateOrGet("testbucket", 10, time.Minute); err != nil {
+		t.Fatal(err)
+	} else if created {
+		t.Fatal("expected an existing key not to be reported as new")
+	}
+}
+
+// One implementation of redis leaky bucket had a bug where very fast access could result in us
+// creating buckets without a TTL on them. This test was reliably able to reproduce this bug.
+func TestNoExpiry(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	conn := s.pool.Get()
+	defer conn.Close()
+	// A counter that lost its expiry, as left by a client that crashed between INCRBY and PEXPIRE.
+	if _, err := conn.Do("SET", "testbucket", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Remaining() != 6 {
+		t.Fatalf("expected 6 remaining, received %d", bucket.Remaining())
+	}
+	if !bucket.Reset().After(time.Now()) {
+		t.Fatalf("expected a reset in the future, received %s", bucket.Reset())
+	}
+	if ttl, err := redis.Int64(conn.Do("PTTL", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if ttl <= 0 || ttl > int64(time.Minute/time.Millisecond) {
+		t.Fatalf("expected the key to expire within the rate, received PTTL %d", ttl)
+	}
+
+	if _, err := conn.Do("PERSIST", "testbucket"); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucket.Peek(); err != nil {
+		t.Fatal(err)
+	} else if !state.Reset.After(time.Now()) {
+		t.Fatalf("expected a reset in the future, received %s", state.Reset)
+	}
+	if ttl, err := redis.Int64(conn.Do("PTTL", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if ttl <= 0 {
+		t.Fatalf("expected Peek to restore the expiry, received PTTL %d", ttl)
+	}
+
+	// Adds restore it too, whether they fit or not.
+	for _, amount := range []uint{1, 10} {
+		if _, err := conn.Do("PERSIST", "testbucket"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(amount); err != nil && !errors.Is(err, leakybucket.ErrorFull) {
+			t.Fatal(err)
+		}
+		if ttl, err := redis.Int64(conn.Do("PTTL", "testbucket")); err != nil {
+			t.Fatal(err)
+		} else if ttl <= 0 {
+			t.Fatalf("expected adding %d to restore the expiry, received PTTL %d", amount, ttl)
+		}
+	}
 }
 
-func TestAdd(t *testing.T) {
+func TestAddZeroReadOnly(t *testing.T) {
 	flushDb()
-	leakybucket.AddTest(getLocalStorage())(t)
+	s := getLocalStorage()
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(0); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.(leakybucket.CapacityAdder).AddWithCapacity(0, 10); err != nil {
+		t.Fatal(err)
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if exists, err := redis.Bool(conn.Do("EXISTS", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("expected adding nothing not to write the key")
+	}
 }
 
-func TestThreadSafeAdd(t *testing.T) {
-	// Redis Add is not thread safe. If you run this, the test should fail because it never received
-	// ErrorFull. It's not thread safe because we don't atomically check the state of the bucket and
-	// increment.
-	t.Skip()
+func TestSetRate(t *testing.T) {
 	flushDb()
-	leakybucket.ThreadSafeAddTest(getLocalStorage())(t)
+	s := getLocalStorage()
+	conn := s.pool.Get()
+	defer conn.Close()
+	bucket, err := s.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.Add(2); err != nil {
+		t.Fatal(err)
+	}
+	setter, ok := bucket.(interface{ SetRate(time.Duration) error })
+	if !ok {
+		t.Fatal("expected the bucket to have SetRate")
+	}
+
+	if err := setter.SetRate(2 * time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if bucket.Rate() != 2*time.Minute {
+		t.Fatalf("expected the rate to be %s, got %s", 2*time.Minute, bucket.Rate())
+	}
+	if bucket.Remaining() != 3 {
+		t.Fatalf("expected the consumed count to be kept, got %d remaining", bucket.Remaining())
+	}
+	if ttl, err := redis.Int64(conn.Do("PTTL", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if ttl <= int64(time.Minute/time.Millisecond) {
+		t.Fatalf("expected the window to be stretched past a minute, received PTTL %d", ttl)
+	}
+
+	// Shortening the rate shortens the current window from its start.
+	if err := setter.SetRate(time.Second); err != nil {
+		t.Fatal(err)
+	}
+	if ttl, err := redis.Int64(conn.Do("PTTL", "testbucket")); err != nil {
+		t.Fatal(err)
+	} else if ttl <= 0 || ttl > 1000 {
+		t.Fatalf("expected the window to end within a second, received PTTL %d", ttl)
+	}
+	if state, err := bucket.Peek(); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 3 {
+		t.Fatalf("expected %d remaining, got %d", 3, state.Remaining)
+	}
+
+	if err := setter.SetRate(0); err != leakybucket.ErrorInvalidParams {
+		t.Fatalf("expected ErrorInvalidParams, received %v", err)
+	}
 }
 
-func TestReset(t *testing.T) {
+func TestInvalidCounter(t *testing.T) {
 	flushDb()
-	leakybucket.AddResetTest(getLocalStorage())(t)
+	s := getLocalStorage()
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("SET", "testbucket", "garbage"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Create("testbucket", 10, time.Minute); err == nil {
+		t.Fatal("expected an error creating a bucket on a non-numeric counter")
+	}
+	if _, err := s.newBucket("testbucket", 10, time.Minute).Peek(); err == nil {
+		t.Fatal("expected an error peeking at a non-numeric counter")
+	}
 }
 
-func TestFindOrCreate(t *testing.T) {
+func TestJitter(t *testing.T) {
 	flushDb()
-	leakybucket.FindOrCreateTest(getLocalStorage())(t)
+	s, err := NewWithOptions("tcp", os.Getenv("REDIS_URL"), Options{Jitter: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	ttls := make(map[int64]bool)
+	for i := 0; i < 20; i++ {
+		name := fmt.Sprintf("testbucket%d", i)
+		bucket, err := s.Create(name, 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(1); err != nil {
+			t.Fatal(err)
+		}
+		ttl, err := redis.Int64(conn.Do("PTTL", name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if ttl < 49000 || ttl > 70000 {
+			t.Fatalf("expected a window within 10s of a minute, received PTTL %d", ttl)
+		}
+		ttls[ttl/100] = true
+	}
+	if len(ttls) < 2 {
+		t.Fatal("expected buckets created together to reset at different times")
+	}
 }
 
-func TestBucketInstanceConsistencyTest(t *testing.T) {
+func TestJitterAddMulti(t *testing.T) {
 	flushDb()
-	leakybucket.BucketInstanceConsistencyTest(getLocalStorage())(t)
+	s, err := NewWithOptions("tcp", os.Getenv("REDIS_URL"), Options{Jitter: 10 * time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	requests := make([]leakybucket.Request, 20)
+	for i := range requests {
+		requests[i] = leakybucket.Request{Name: fmt.Sprintf("testbucket%d", i), Capacity: 5, Rate: time.Minute, Amount: 1}
+	}
+	_, errs := s.AddMulti(requests)
+	conn := s.pool.Get()
+	defer conn.Close()
+	ttls := make(map[int64]bool)
+	for i, r := range requests {
+		if errs[i] != nil {
+			t.Fatal(errs[i])
+		}
+		ttl, err := redis.Int64(conn.Do("PTTL", r.Name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ttls[ttl/100] = true
+	}
+	if len(ttls) < 2 {
+		t.Fatal("expected buckets added to together to reset at different times")
+	}
+}
+
+func TestSlidingTTL(t *testing.T) {
+	flushDb()
+	s, err := New("tcp", os.Getenv("REDIS_URL"), WithSlidingTTL())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bucket, err := s.Create("testbucket", 2, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := bucket.Add(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(600 * time.Millisecond)
+	if state, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	} else if !state.Reset.After(first.Reset.Add(500 * time.Millisecond)) {
+		t.Fatalf("expected the add to push the reset past %s, got %s", first.Reset, state.Reset)
+	}
+
+	// The first window would have ended by now, but the second add restarted it.
+	time.Sleep(600 * time.Millisecond)
+	if _, err := bucket.Add(1); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+}
+
+func TestLastSync(t *testing.T) {
+	flushDb()
+	before := time.Now()
+	bucket, err := getLocalStorage().Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	syncer := bucket.(leakybucket.Syncer)
+	created := syncer.LastSync()
+	if created.Before(before) {
+		t.Fatalf("expected Create to sync the bucket, last synced at %s", created)
+	}
+	if synced := syncer.LastSync(); !synced.Equal(created) {
+		t.Fatalf("expected reading LastSync not to sync, got %s after %s", synced, created)
+	}
+	time.Sleep(time.Millisecond)
+	if _, err := bucket.Add(1); err != nil {
+		t.Fatal(err)
+	}
+	if synced := syncer.LastSync(); !synced.After(created) {
+		t.Fatalf("expected Add to sync the bucket after %s, got %s", created, synced)
+	}
+
+	unsynced, err := unreachableStorage(true).Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if synced := unsynced.(leakybucket.Syncer).LastSync(); !synced.IsZero() {
+		t.Fatalf("expected a bucket never read from redis not to be synced, got %s", synced)
+	}
+}
+
+func TestFullBuckets(t *testing.T) {
+	flushDb()
+	s, err := New("tcp", os.Getenv("REDIS_URL"), WithKeyPrefix("app:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"user:c", "user:a", "user:b", "global"} {
+		bucket, err := s.Create(name, 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		amount := uint(2)
+		if name == "user:b" {
+			amount = 1
+		}
+		if _, err := bucket.Add(amount); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", "app:user:hash", "field", 5); err != nil {
+		t.Fatal(err)
+	}
+	if full, err := s.FullBuckets("user:", 2); err != nil {
+		t.Fatal(err)
+	} else if len(full) != 2 || full[0] != "user:a" || full[1] != "user:c" {
+		t.Fatalf("expected buckets user:a and user:c full, got %v", full)
+	}
+	if full, err := s.FullBuckets("user:", 3); err != nil {
+		t.Fatal(err)
+	} else if len(full) != 0 {
+		t.Fatalf("expected no bucket full for a larger capacity, got %v", full)
+	}
+}
+
+func TestRange(t *testing.T) {
+	flushDb()
+	s, err := New("tcp", os.Getenv("REDIS_URL"), WithKeyPrefix("app:"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, name := range []string{"user:a", "user:b", "global"} {
+		bucket, err := s.Create(name, 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(uint(i + 1)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if _, err := conn.Do("HSET", "app:user:hash", "field", 5); err != nil {
+		t.Fatal(err)
+	}
+	remaining := map[string]uint{}
+	err = s.Range("user:", 5, func(name string, state leakybucket.BucketState) bool {
+		remaining[name] = state.Remaining
+		if until := time.Until(state.Reset); until <= 0 || until > time.Minute {
+			t.Errorf("expected %s to reset within a minute, got %v", name, until)
+		}
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(remaining) != "map[user:a:4 user:b:3]" {
+		t.Fatalf("expected the buckets with the prefix, got %v", remaining)
+	}
+	visited := 0
+	if err := s.Range("", 5, func(string, leakybucket.BucketState) bool {
+		visited++
+		return false
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if visited != 1 {
+		t.Fatalf("expected Range to stop once the callback returns false, visited %d", visited)
+	}
+}
+
+func TestName(t *testing.T) {
+	s := getLocalStorage()
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := bucket.(interface{ Name() string }).Name(); name != "testbucket" {
+		t.Fatalf("expected name testbucket, received %s", name)
+	}
+	if key := bucket.(interface{ Key() string }).Key(); key != "testbucket" {
+		t.Fatalf("expected key testbucket, received %s", key)
+	}
+}
+
+func TestKeyPrefix(t *testing.T) {
+	flushDb()
+	getPrefixed := func(prefix string) *Storage {
+		storage, err := NewWithOptions("tcp", os.Getenv("REDIS_URL"), Options{KeyPrefix: prefix})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return storage
+	}
+	a, b := getPrefixed("a:"), getPrefixed("b:")
+
+	bucketA, err := a.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name := bucketA.(interface{ Name() string }).Name(); name != "testbucket" {
+		t.Fatalf("expected name testbucket, received %s", name)
+	}
+	if key := bucketA.(interface{ Key() string }).Key(); key != "a:testbucket" {
+		t.Fatalf("expected key a:testbucket, received %s", key)
+	}
+	if _, err := bucketA.Add(5); err != nil {
+		t.Fatal(err)
+	}
+
+	bucketB, err := b.Create("testbucket", 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucketB.Add(1); err != nil {
+		t.Fatalf("expected the other prefix's bucket to be separate, received %v", err)
+	} else if state.Remaining != 4 {
+		t.Fatalf("expected 4 remaining, received %d", state.Remaining)
+	}
+
+	if err := a.Remove("testbucket"); err != nil {
+		t.Fatal(err)
+	}
+	if state, err := bucketB.Peek(); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 4 {
+		t.Fatalf("expected Remove to leave the other prefix's bucket, received %d remaining", state.Remaining)
+	}
+	if state, err := bucketA.Peek(); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 5 {
+		t.Fatalf("expected Remove to empty the bucket, received %d remaining", state.Remaining)
+	}
+}
+
+func TestNameHash(t *testing.T) {
+	flushDb()
+	s, err := NewWithOptions("tcp", os.Getenv("REDIS_URL"), Options{KeyPrefix: "app:", NameHash: HashName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	name := strings.Repeat("https://example.com/very/long/path", 10)
+	bucket, err := s.Create(name, 5, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := bucket.(interface{ Name() string }).Name(); got != name {
+		t.Fatalf("expected name %s, received %s", name, got)
+	}
+	key := "app:" + HashName(name)
+	if got := bucket.(interface{ Key() string }).Key(); got != key {
+		t.Fatalf("expected key %s, received %s", key, got)
+	}
+	if _, err := bucket.Add(2); err != nil {
+		t.Fatal(err)
+	}
+	conn := s.pool.Get()
+	defer conn.Close()
+	if count, err := redis.Int(conn.Do("GET", key)); err != nil {
+		t.Fatal(err)
+	} else if count != 2 {
+		t.Fatalf("expected a count of %d at the hashed key, received %d", 2, count)
+	}
+
+	if _, err := s.RemovePrefix("https://"); err != errHashedPrefix {
+		t.Fatalf("expected errHashedPrefix, received %v", err)
+	}
+	if _, err := s.FullBuckets("", 5); err != errHashedNames {
+		t.Fatalf("expected errHashedNames, received %v", err)
+	}
+	if err := s.Remove(name); err != nil {
+		t.Fatal(err)
+	}
+	if exists, err := redis.Bool(conn.Do("EXISTS", key)); err != nil {
+		t.Fatal(err)
+	} else if exists {
+		t.Fatal("expected Remove to delete the hashed key")
+	}
+}
+
+func TestHashName(t *testing.T) {
+	if hash := HashName("testbucket"); len(hash) != 40 || hash != HashName("testbucket") {
+		t.Fatalf("expected 40 hex digits, stable across calls, received %s", hash)
+	}
+	if HashName("a") == HashName("b") {
+		t.Fatal("expected different names to hash differently")
+	}
+}
+
+func TestAddIdempotent(t *testing.T) {
+	flushDb()
+	s := getLocalStorage()
+	bucket, err := s.Create("testbucket", 3, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	adder := bucket.(leakybucket.IdempotentAdder)
+	if state, err := adder.AddIdempotent("request1", 2); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 1 {
+		t.Fatalf("expected %d remaining, got %d", 1, state.Remaining)
+	}
+	// A retry of the same request doesn't take the amount again.
+	if state, err := adder.AddIdempotent("request1", 2); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 1 {
+		t.Fatalf("expected the retry to leave %d remaining, got %d", 1, state.Remaining)
+	}
+	// An add that doesn't fit isn't applied, so retrying it tries again.
+	if _, err := adder.AddIdempotent("request2", 2); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull, received %v", err)
+	}
+	if state, err := adder.AddIdempotent("request2", 1); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+	}
+
+	conn := s.pool.Get()
+	defer conn.Close()
+	ttl, err := redis.Int64(conn.Do("PTTL", "testbucket"+idempotencyInfix+"request1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ttl <= 0 || ttl > DefaultIdempotencyWindow.Milliseconds() {
+		t.Fatalf("expected the idempotency key to expire within %v, got a PTTL of %d", DefaultIdempotencyWindow, ttl)
+	}
+	// The idempotency keys aren't taken for full buckets.
+	if full, err := s.FullBuckets("", 1); err != nil {
+		t.Fatal(err)
+	} else if !reflect.DeepEqual(full, []string{"testbucket"}) {
+		t.Fatalf("expected only testbucket to be full, got %v", full)
+	}
+}
+
+func TestWindowStart(t *testing.T) {
+	flushDb()
+	bucket, err := getLocalStorage().Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	before := time.Now()
+	state, err := bucket.Add(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := bucket.(interface{ WindowStart() time.Time }).WindowStart()
+	if !start.Equal(state.Reset.Add(-time.Minute)) {
+		t.Fatalf("expected the window to start a minute before its reset, got %v", state.Reset.Sub(start))
+	}
+	if e := time.Second; start.Before(before.Add(-e)) || start.After(time.Now().Add(e)) {
+		t.Fatalf("expected the window to start at the add, got %v", start.Sub(before))
+	}
 }
 
-// One implementation of redis leaky bucket had a bug where very fast access could result in us
-// creating buckets without a TTL on them. This test was reliably able to reproduce this bug.
 func TestFastAccess(t *testing.T) {
 	flushDb()
 	s := getLocalStorage()
@@ -83,8 +1471,8 @@ func TestFastAccess(t *testing.T) {
 		go func() {
 			defer wg.Done()
 			<-hold
-			if _, err := bucket.Add(1); err != nil && err != leakybucket.ErrorFull {
-				t.Fatal(err)
+			if _, err := bucket.Add(1); err != nil && !errors.Is(err, leakybucket.ErrorFull) {
+				t.Error(err)
 			}
 		}()
 	}
@@ -0,0 +1,509 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/bububa/leakybucket"
+	"github.com/bububa/redigo/redis"
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// slidingScript trims adds older than the window from the sorted set at KEYS[1], then records
+// an add of ARGV[3] at time ARGV[1] if it fits in capacity ARGV[4], or if ARGV[6] is 1, of as
+// much of it as fits. Each add is a member starting with the unique ARGV[5] and ending in
+// ":<amount>", scored by its time in milliseconds. It returns the amount in the window, the
+// time of its oldest add or -1 if it is empty, 1 if the amount was added or 0 if the bucket
+// was full, and the amount added. An amount of 0 just trims, and is never refused, even when the
+// window holds more than the capacity.
+var slidingScript = redis.NewScript(1, `
+local now = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local amount = tonumber(ARGV[3])
+local capacity = tonumber(ARGV[4])
+redis.call("ZREMRANGEBYSCORE", KEYS[1], "-inf", now - window)
+local used = 0
+local oldest = -1
+local adds = redis.call("ZRANGE", KEYS[1], 0, -1, "WITHSCORES")
+for i = 1, #adds, 2 do
+	used = used + tonumber(string.match(adds[i], ":(%d+)$"))
+	if oldest < 0 then
+		oldest = tonumber(adds[i + 1])
+	end
+end
+if ARGV[6] == "1" then
+	amount = math.min(amount, math.max(capacity - used, 0))
+elseif amount > 0 and used + amount > capacity then
+	return {used, oldest, 0, 0}
+end
+if amount > 0 then
+	redis.call("ZADD", KEYS[1], now, ARGV[5] .. ":" .. amount)
+	redis.call("PEXPIRE", KEYS[1], window)
+	if oldest < 0 then
+		oldest = now
+	end
+end
+return {used + amount, oldest, 1, amount}
+`)
+
+// slidingSetScript replaces the adds in the sorted set at KEYS[1] with a single add of ARGV[1]
+// at the time of the oldest add, or at ARGV[2] if there is none, so the window keeps its reset.
+var slidingSetScript = redis.NewScript(1, `
+local oldest = redis.call("ZRANGE", KEYS[1], 0, 0, "WITHSCORES")[2] or ARGV[2]
+redis.call("DEL", KEYS[1])
+if tonumber(ARGV[1]) > 0 then
+	redis.call("ZADD", KEYS[1], oldest, ARGV[4])
+	redis.call("PEXPIRE", KEYS[1], ARGV[3])
+end
+return oldest
+`)
+
+// slidingPeekScript reads the sorted set at KEYS[1] like slidingScript with an amount of 0, but
+// counts only the adds scored above ARGV[1] rather than trimming the others, so that it makes
+// no write and runs on a replica. It returns the amount in the window and the time of its
+// oldest add, or -1 if it is empty.
+var slidingPeekScript = redis.NewScript(1, `
+local adds = redis.call("ZRANGEBYSCORE", KEYS[1], ARGV[1], "+inf", "WITHSCORES")
+local used = 0
+for i = 1, #adds, 2 do
+	used = used + tonumber(string.match(adds[i], ":(%d+)$"))
+end
+return {used, tonumber(adds[2] or "-1")}
+`)
+
+type slidingBucket struct {
+	name, key           string
+	capacity, remaining uint
+	reset               time.Time
+	synced              time.Time
+	rate                time.Duration
+	getConn             ConnFunc
+	getReplicaConn      ConnFunc
+	clock               leakybucket.Clock
+	failOpen            failOpen
+	hooks               *leakybucket.Hooks
+
+	// mutex guards remaining, reset and synced, which concurrent commands on the bucket update.
+	mutex sync.Mutex
+}
+
+// Name returns the name the bucket was created with.
+func (b *slidingBucket) Name() string {
+	return b.name
+}
+
+// Key returns the redis key holding the bucket's log: its name, hashed by any NameHash,
+// after any KeyPrefix.
+func (b *slidingBucket) Key() string {
+	return b.key
+}
+
+func (b *slidingBucket) Capacity() uint {
+	return b.capacity
+}
+
+// Remaining space in the bucket.
+func (b *slidingBucket) Remaining() uint {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.remaining
+}
+
+// Reset returns when the oldest add in the window expires, freeing up space.
+func (b *slidingBucket) Reset() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.reset
+}
+
+// Rate returns the length of the bucket's sliding window.
+func (b *slidingBucket) Rate() time.Duration {
+	return b.rate
+}
+
+func (b *slidingBucket) State() leakybucket.BucketState {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return leakybucket.BucketState{Capacity: b.capacity, Remaining: b.remaining, Reset: b.reset}
+}
+
+// setState records the state of the bucket last read from redis.
+func (b *slidingBucket) setState(remaining uint, reset time.Time) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.remaining, b.reset = remaining, reset
+	b.synced = b.clock.Now()
+}
+
+// LastSync returns when the bucket's state was last read from redis, or the zero time if it
+// never was, such as when creating it failed open.
+func (b *slidingBucket) LastSync() time.Time {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.synced
+}
+
+// observe records the state of the bucket given the amount in its window as of now and the
+// time of its oldest add, or -1 if it is empty, returning it rather than the shared fields.
+func (b *slidingBucket) observe(used, oldest int64, now time.Time) leakybucket.BucketState {
+	state := b.State()
+	state.Remaining = leakybucket.RemainingAfter(b.capacity, used)
+	if oldest < 0 {
+		state.Reset = now.Add(b.rate)
+	} else {
+		state.Reset = fromMilliseconds(oldest).Add(b.rate)
+	}
+	b.setState(state.Remaining, state.Reset)
+	return state
+}
+
+// conn returns a connection for commands on the bucket's key.
+func (b *slidingBucket) conn(ctx context.Context) (redis.Conn, error) {
+	return b.getConn(ctx, b.key)
+}
+
+// Add to the bucket.
+func (b *slidingBucket) Add(amount uint) (leakybucket.BucketState, error) {
+	return b.AddContext(context.Background(), amount)
+}
+
+// TryAdd adds to the bucket, reporting whether the amount fit rather than returning ErrorFull.
+func (b *slidingBucket) TryAdd(amount uint) (leakybucket.BucketState, bool, error) {
+	return leakybucket.TryAdd(b, amount)
+}
+
+// AddWithTime adds to the bucket as if at time t.
+func (b *slidingBucket) AddWithTime(amount uint, t time.Time) (leakybucket.BucketState, error) {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.State(), err))
+	}
+	defer conn.Close()
+	return b.failOpen.filter(b.hooks.Notify(b.name)(b.add(context.Background(), conn, amount, t)))
+}
+
+// AddContext adds to the bucket, bounding the redis commands by ctx.
+func (b *slidingBucket) AddContext(ctx context.Context, amount uint) (leakybucket.BucketState, error) {
+	conn, err := b.conn(ctx)
+	if err != nil {
+		return b.failOpen.filter(b.hooks.Notify(b.name)(b.State(), err))
+	}
+	defer conn.Close()
+	return b.failOpen.filter(b.hooks.Notify(b.name)(b.add(ctx, conn, amount, b.clock.Now())))
+}
+
+func (b *slidingBucket) add(ctx context.Context, conn redis.Conn, amount uint, now time.Time) (leakybucket.BucketState, error) {
+	if amount > b.capacity {
+		return b.State(), leakybucket.ErrorOverCapacity
+	}
+	_, state, err := b.run(ctx, conn, amount, now, false)
+	return state, err
+}
+
+// TakeUpTo adds as much of amount to the bucket as fits, returning how much it added.
+func (b *slidingBucket) TakeUpTo(amount uint) (uint, leakybucket.BucketState, error) {
+	var granted uint
+	state := b.State()
+	conn, err := b.conn(context.Background())
+	if err == nil {
+		defer conn.Close()
+		granted, state, err = b.run(context.Background(), conn, amount, b.clock.Now(), true)
+	}
+	if err != nil {
+		state, err = b.failOpen.filter(state, err)
+		if err != nil {
+			return 0, state, err
+		}
+		return amount, state, nil
+	}
+	return granted, state, nil
+}
+
+// run runs slidingScript, adding as much of amount as fits if partial is set, and returns the
+// amount added.
+func (b *slidingBucket) run(ctx context.Context, conn redis.Conn, amount uint, now time.Time, partial bool) (uint, leakybucket.BucketState, error) {
+	flag := 0
+	if partial {
+		flag = 1
+	}
+	reply, err := redis.Values(slidingScript.DoContext(ctx, conn, b.key, unixMilliseconds(now),
+		expiryMilliseconds(b.rate), amount, b.capacity, memberPrefix(now), flag))
+	if err != nil {
+		return 0, b.State(), err
+	}
+	var used, oldest, added, granted int64
+	if _, err := redis.Scan(reply, &used, &oldest, &added, &granted); err != nil {
+		return 0, b.State(), err
+	}
+	state := b.observe(used, oldest, now)
+	if added == 0 {
+		return 0, state, leakybucket.NewFullError(state)
+	}
+	return uint(granted), state, nil
+}
+
+// Peek refreshes the bucket's state from redis without adding to it, from the storage's
+// replica if it has one.
+func (b *slidingBucket) Peek() (leakybucket.BucketState, error) {
+	if b.getReplicaConn != nil {
+		return b.peekReplica()
+	}
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.State(), err
+	}
+	defer conn.Close()
+	return b.add(context.Background(), conn, 0, b.clock.Now())
+}
+
+// peekReplica refreshes the bucket's state from the storage's replica, with slidingPeekScript
+// since the replica refuses the trimming of slidingScript.
+func (b *slidingBucket) peekReplica() (leakybucket.BucketState, error) {
+	conn, err := b.getReplicaConn(context.Background(), b.key)
+	if err != nil {
+		return b.State(), err
+	}
+	defer conn.Close()
+
+	now := b.clock.Now()
+	since := "(" + strconv.FormatInt(unixMilliseconds(now)-expiryMilliseconds(b.rate), 10)
+	reply, err := redis.Values(slidingPeekScript.Do(conn, b.key, since))
+	if err != nil {
+		return b.State(), err
+	}
+	var used, oldest int64
+	if _, err := redis.Scan(reply, &used, &oldest); err != nil {
+		return b.State(), err
+	}
+	return b.observe(used, oldest, now), nil
+}
+
+// WouldAccept reports whether adding amount would fit, reading the bucket's state without
+// adding to it. When redis fails, a bucket failing open reports that it would.
+func (b *slidingBucket) WouldAccept(amount uint) (bool, error) {
+	state, err := b.Peek()
+	if err != nil {
+		_, err = b.failOpen.filter(state, err)
+		return err == nil, err
+	}
+	return amount <= state.Remaining, nil
+}
+
+// SetRemaining sets the remaining space in the bucket, up to its capacity, by collapsing the
+// adds in the window into one at the time of the oldest.
+func (b *slidingBucket) SetRemaining(n uint) error {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	remaining := leakybucket.Min(n, b.capacity)
+	now := b.clock.Now()
+	oldest, err := redis.Int64(slidingSetScript.Do(conn, b.key, b.capacity-remaining,
+		unixMilliseconds(now), expiryMilliseconds(b.rate), member(now, b.capacity-remaining)))
+	if err != nil {
+		return err
+	}
+	b.setState(remaining, fromMilliseconds(oldest).Add(b.rate))
+	return nil
+}
+
+// slidingRefundScript takes up to ARGV[1] back from the most recent adds in the sorted set at
+// KEYS[1], removing the adds it takes all of and rewriting the one it takes part of as ARGV[2]
+// at the same time. It returns the amount left in the window and the time of its oldest add, or
+// -1 if it is empty. Adds that have left the window are not trimmed, so the amount may include
+// them.
+var slidingRefundScript = redis.NewScript(1, `
+local refund = tonumber(ARGV[1])
+local adds = redis.call("ZREVRANGE", KEYS[1], 0, -1, "WITHSCORES")
+for i = 1, #adds, 2 do
+	if refund == 0 then
+		break
+	end
+	local amount = tonumber(string.match(adds[i], ":(%d+)$"))
+	redis.call("ZREM", KEYS[1], adds[i])
+	if amount > refund then
+		redis.call("ZADD", KEYS[1], adds[i + 1], ARGV[2] .. ":" .. (amount - refund))
+		refund = 0
+	else
+		refund = refund - amount
+	end
+end
+local used = 0
+adds = redis.call("ZRANGE", KEYS[1], 0, -1, "WITHSCORES")
+for i = 1, #adds, 2 do
+	used = used + tonumber(string.match(adds[i], ":(%d+)$"))
+end
+return {used, tonumber(adds[2] or "-1")}
+`)
+
+// Refund gives back amount to the bucket by taking it off its most recent adds.
+func (b *slidingBucket) Refund(amount uint) (leakybucket.BucketState, error) {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return b.State(), err
+	}
+	defer conn.Close()
+
+	now := b.clock.Now()
+	// Trim first, so that only adds still in the window are refunded.
+	if _, err := b.add(context.Background(), conn, 0, now); err != nil {
+		return b.State(), err
+	}
+	reply, err := redis.Values(slidingRefundScript.Do(conn, b.key, amount, memberPrefix(now)))
+	if err != nil {
+		return b.State(), err
+	}
+	var used, oldest int64
+	if _, err := redis.Scan(reply, &used, &oldest); err != nil {
+		return b.State(), err
+	}
+	return b.observe(used, oldest, now), nil
+}
+
+// Drain the bucket by deleting its key.
+func (b *slidingBucket) Drain() error {
+	conn, err := b.conn(context.Background())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Do("DEL", b.key); err != nil {
+		return err
+	}
+	b.setState(b.capacity, b.clock.Now().Add(b.rate))
+	return nil
+}
+
+// member returns a unique sorted set member recording an add of amount at t.
+func member(t time.Time, amount uint) string {
+	return fmt.Sprintf("%s:%d", memberPrefix(t), amount)
+}
+
+// memberPrefix returns the unique start of a sorted set member recording an add at t.
+func memberPrefix(t time.Time) string {
+	return fmt.Sprintf("%d:%x", unixMilliseconds(t), rand.Int63())
+}
+
+// unixMilliseconds returns t as milliseconds since the Unix epoch, as sorted set scores are.
+func unixMilliseconds(t time.Time) int64 {
+	return t.UnixNano() / millisecond
+}
+
+func fromMilliseconds(ms int64) time.Time {
+	return time.Unix(0, ms*millisecond)
+}
+
+// SlidingWindowStorage is a redis-based factory of sliding window buckets. Rather than counting
+// adds in fixed windows, which lets up to twice the capacity through around the boundary of two
+// windows, a sliding window bucket accepts an add only if the adds over the preceding rate
+// leave room for it.
+//
+// The tradeoff is cost: each bucket is a sorted set holding every add in its window, up to
+// capacity members, and each add is linear in their number, whereas the counter of Storage is a
+// single integer. Windows are measured with the clients' clocks, so they should be in sync.
+type SlidingWindowStorage struct {
+	pool      *redis.Pool
+	replica   *redis.Pool
+	getConn   ConnFunc
+	clock     leakybucket.Clock
+	failOpen  failOpen
+	keyPrefix string
+	nameHash  func(string) string
+	hooks     *leakybucket.Hooks
+}
+
+// NewSlidingWindow initializes the connection to redis for sliding window buckets, configured
+// by any opts like New.
+func NewSlidingWindow(network, address string, opts ...Option) (*SlidingWindowStorage, error) {
+	o := newOptions(opts)
+	pool, replica, err := newPools(network, address, o)
+	if err != nil {
+		return nil, err
+	}
+	return &SlidingWindowStorage{
+		pool:      pool,
+		replica:   replica,
+		getConn:   poolConn(pool),
+		clock:     leakybucket.RealClock{},
+		failOpen:  failOpen(o.FailOpen),
+		keyPrefix: o.KeyPrefix,
+		nameHash:  o.NameHash,
+	}, nil
+}
+
+// SetClock makes the buckets created by the storage read the time from clock instead of the
+// system clock.
+func (s *SlidingWindowStorage) SetClock(clock leakybucket.Clock) {
+	s.clock = clock
+}
+
+// SetHooks makes the buckets created by the storage afterwards call hooks on adds.
+func (s *SlidingWindowStorage) SetHooks(hooks leakybucket.Hooks) {
+	s.hooks = &hooks
+}
+
+// Create a bucket whose window is rate long.
+func (s *SlidingWindowStorage) Create(name string, capacity uint, rate time.Duration) (leakybucket.Bucket, error) {
+	if err := leakybucket.ValidateParams(capacity, rate); err != nil {
+		return nil, err
+	}
+	b := &slidingBucket{
+		name:           name,
+		key:            s.key(name),
+		capacity:       capacity,
+		remaining:      capacity,
+		reset:          s.clock.Now().Add(rate),
+		rate:           rate,
+		getConn:        s.getConn,
+		getReplicaConn: replicaConn(s.replica),
+		clock:          s.clock,
+		failOpen:       s.failOpen,
+		hooks:          s.hooks,
+	}
+	if _, err := b.Peek(); err != nil && !s.failOpen {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Allow creates or gets the named bucket and adds 1 to it, reporting whether it fit.
+func (s *SlidingWindowStorage) Allow(name string, capacity uint, rate time.Duration) (bool, leakybucket.BucketState, error) {
+	return leakybucket.Allow(s, name, capacity, rate)
+}
+
+// Remove a bucket by deleting its key.
+func (s *SlidingWindowStorage) Remove(name string) error {
+	key := s.key(name)
+	conn, err := s.getConn(context.Background(), key)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Do("DEL", key)
+	return err
+}
+
+// key returns the redis key of the named bucket.
+func (s *SlidingWindowStorage) key(name string) string {
+	return bucketKey(s.keyPrefix, s.nameHash, name)
+}
+
+// RemovePrefix removes every bucket whose name starts with prefix, returning how many it
+// removed. With NameHash set, only the empty prefix, removing every bucket, is supported.
+func (s *SlidingWindowStorage) RemovePrefix(prefix string) (int, error) {
+	if s.nameHash != nil && prefix != "" {
+		return 0, errHashedPrefix
+	}
+	conn, err := s.getConn(context.Background(), "")
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	return removePrefix(conn, s.keyPrefix+prefix, false)
+}
@@ -0,0 +1,232 @@
+package redis
+
+import (
+	"errors"
+	"github.com/bububa/leakybucket"
+	"os"
+	"testing"
+	"time"
+)
+
+func getLocalSlidingWindowStorage() *SlidingWindowStorage {
+	storage, err := NewSlidingWindow("tcp", os.Getenv("REDIS_URL"))
+	if err != nil {
+		panic(err)
+	}
+	return storage
+}
+
+func TestSlidingWindowCreate(t *testing.T) {
+	flushDb()
+	leakybucket.CreateTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowCreateMulti(t *testing.T) {
+	flushDb()
+	leakybucket.CreateMultiTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowInvalidParams(t *testing.T) {
+	flushDb()
+	leakybucket.InvalidParamsTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowAdd(t *testing.T) {
+	flushDb()
+	leakybucket.AddTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowAddZero(t *testing.T) {
+	flushDb()
+	leakybucket.AddZeroTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowAddOverCapacity(t *testing.T) {
+	flushDb()
+	leakybucket.AddOverCapacityTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowTryAdd(t *testing.T) {
+	flushDb()
+	leakybucket.TryAddTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowFullError(t *testing.T) {
+	flushDb()
+	leakybucket.FullErrorTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowAddDetailed(t *testing.T) {
+	flushDb()
+	leakybucket.AddDetailedTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowAllow(t *testing.T) {
+	flushDb()
+	leakybucket.AllowTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowTakeUpTo(t *testing.T) {
+	flushDb()
+	leakybucket.TakeUpToTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowThreadSafeAdd(t *testing.T) {
+	flushDb()
+	leakybucket.ThreadSafeAddTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowConcurrentCapacity(t *testing.T) {
+	flushDb()
+	leakybucket.ConcurrentCapacityTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowReset(t *testing.T) {
+	flushDb()
+	leakybucket.AddResetTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowShortRate(t *testing.T) {
+	flushDb()
+	leakybucket.ShortRateTest(getLocalSlidingWindowStorage())(t)
+}
+
+// FindOrCreateTest doesn't apply: the window is given by the rate of each bucket instance
+// rather than fixed when its key was created.
+
+func TestSlidingWindowBucketInstanceConsistencyTest(t *testing.T) {
+	flushDb()
+	leakybucket.BucketInstanceConsistencyTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowAddContext(t *testing.T) {
+	flushDb()
+	leakybucket.AddContextTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowAddWithTime(t *testing.T) {
+	flushDb()
+	leakybucket.AddWithTimeTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowPeek(t *testing.T) {
+	flushDb()
+	leakybucket.PeekTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowWouldAccept(t *testing.T) {
+	flushDb()
+	leakybucket.WouldAcceptTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowHooks(t *testing.T) {
+	flushDb()
+	leakybucket.HooksTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowRemove(t *testing.T) {
+	flushDb()
+	leakybucket.RemoveTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowSetRemaining(t *testing.T) {
+	flushDb()
+	leakybucket.SetRemainingTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowDrain(t *testing.T) {
+	flushDb()
+	leakybucket.DrainTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowRefund(t *testing.T) {
+	flushDb()
+	leakybucket.RefundTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowAddHierarchical(t *testing.T) {
+	flushDb()
+	leakybucket.AddHierarchicalTest(getLocalSlidingWindowStorage())(t)
+}
+
+func TestSlidingWindowRemovePrefix(t *testing.T) {
+	flushDb()
+	leakybucket.RemovePrefixTest(getLocalSlidingWindowStorage())(t)
+}
+
+// A fixed window lets a full burst through at the end of one window and another at the start
+// of the next. A sliding window must not.
+func TestSlidingWindowBoundaryBurst(t *testing.T) {
+	flushDb()
+	bucket, err := getLocalSlidingWindowStorage().Create("testbucket", 10, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if _, err := bucket.AddWithTime(10, start); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := bucket.AddWithTime(1, start.Add(999*time.Millisecond)); !errors.Is(err, leakybucket.ErrorFull) {
+		t.Fatalf("expected ErrorFull just before the window slides, received %v", err)
+	}
+	if state, err := bucket.AddWithTime(10, start.Add(time.Second)); err != nil {
+		t.Fatal(err)
+	} else if state.Remaining != 0 {
+		t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+	}
+}
+
+// TestSlidingWindowReplica checks that peeking from a replica, here the primary itself, reads
+// the same window as the adds without writing to trim it.
+func TestSlidingWindowReplica(t *testing.T) {
+	flushDb()
+	s := getLocalSlidingWindowStorage()
+	s.replica = s.pool
+	bucket, err := s.Create("testbucket", 10, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	added, err := bucket.Add(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	state, err := bucket.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state.Remaining != 7 || !state.Reset.Equal(added.Reset) {
+		t.Fatalf("expected %d remaining until %v, got %d until %v", 7, added.Reset, state.Remaining, state.Reset)
+	}
+}
+
+// peekOverCapacityTest returns a test that peeking at a bucket holding more than its capacity,
+// as when clients with different capacities share its key, reads it rather than refusing an
+// add of nothing.
+func peekOverCapacityTest(s leakybucket.Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		large, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := large.Add(5); err != nil {
+			t.Fatal(err)
+		}
+		small, err := s.Create("testbucket", 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, err := small.Peek(); err != nil {
+			t.Fatalf("expected peeking at an overfull bucket to succeed, received %v", err)
+		} else if state.Remaining != 0 {
+			t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+		}
+		if _, err := small.Add(0); err != nil {
+			t.Fatalf("expected adding nothing to an overfull bucket to succeed, received %v", err)
+		}
+	}
+}
+
+func TestSlidingWindowPeekOverCapacity(t *testing.T) {
+	flushDb()
+	peekOverCapacityTest(getLocalSlidingWindowStorage())(t)
+}
@@ -1,6 +1,7 @@
 package leakybucket
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"math"
@@ -21,6 +22,9 @@ func CreateTest(s Storage) func(*testing.T) {
 		if capacity := bucket.Capacity(); capacity != 100 {
 			t.Fatalf("expected capacity of %d, got %d", 100, capacity)
 		}
+		if rate := bucket.Rate(); rate != time.Minute {
+			t.Fatalf("expected rate of %s, got %s", time.Minute, rate)
+		}
 		e := float64(1 * time.Second) // margin of error
 		if error := float64(bucket.Reset().Sub(now.Add(time.Minute))); math.Abs(error) > e {
 			t.Fatalf("expected reset time close to %s, got %s", now.Add(time.Minute),
@@ -29,6 +33,60 @@ func CreateTest(s Storage) func(*testing.T) {
 	}
 }
 
+// CreateMultiTest returns a test that CreateMulti creates each specified bucket in the state of
+// its existing counterpart, reporting invalid specs by index.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func CreateMultiTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		existing, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := existing.Add(3); err != nil {
+			t.Fatal(err)
+		}
+		buckets, errs := CreateMulti(s, []BucketSpec{
+			{Name: "testbucket", Capacity: 10, Rate: time.Minute},
+			{Name: "otherbucket", Capacity: 5, Rate: time.Minute},
+			{Name: "invalidbucket", Capacity: 0, Rate: time.Minute},
+		})
+		if len(buckets) != 3 || len(errs) != 3 {
+			t.Fatalf("expected %d buckets and errors, got %d and %d", 3, len(buckets), len(errs))
+		}
+		for i, expected := range []uint{7, 5} {
+			if errs[i] != nil {
+				t.Fatal(errs[i])
+			}
+			if remaining := buckets[i].Remaining(); remaining != expected {
+				t.Fatalf("bucket %d: expected %d remaining, got %d", i, expected, remaining)
+			}
+		}
+		if errs[2] != ErrorInvalidParams {
+			t.Fatalf("expected ErrorInvalidParams, received %v", errs[2])
+		}
+		if buckets[2] != nil {
+			t.Fatalf("expected no bucket for an invalid spec, got %v", buckets[2])
+		}
+	}
+}
+
+// InvalidParamsTest returns a test that creating a bucket with no capacity or a rate that isn't
+// positive fails with ErrorInvalidParams.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func InvalidParamsTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		for _, params := range []struct {
+			capacity uint
+			rate     time.Duration
+		}{{0, time.Minute}, {10, 0}, {10, -time.Minute}, {0, 0}} {
+			if _, err := s.Create("testbucket", params.capacity, params.rate); err != ErrorInvalidParams {
+				t.Fatalf("expected ErrorInvalidParams creating a bucket of capacity %d and rate %s, got %v",
+					params.capacity, params.rate, err)
+			}
+		}
+	}
+}
+
 // AddTest returns a test that adding to a single bucket works.
 // It is meant to be used by leakybucket implementers who wish to test this.
 func AddTest(s Storage) func(*testing.T) {
@@ -55,9 +113,297 @@ func AddTest(s Storage) func(*testing.T) {
 
 		if _, err := bucket.Add(1); err == nil {
 			t.Fatalf("expected ErrorFull, received no error")
-		} else if err != ErrorFull {
+		} else if !errors.Is(err, ErrorFull) {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		}
+	}
+}
+
+// AddZeroTest returns a test that adding nothing reads the bucket's state without consuming.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AddZeroTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, err := bucket.Add(0); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 5 {
+			t.Fatalf("expected %d remaining, got %d", 5, state.Remaining)
+		}
+		added, err := bucket.Add(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 3; i++ {
+			if state, err := bucket.Add(0); err != nil {
+				t.Fatal(err)
+			} else if state.Remaining != 2 {
+				t.Fatalf("expected %d remaining, got %d", 2, state.Remaining)
+			} else if !sameReset(state.Reset, added.Reset) {
+				t.Fatalf("expected reset %s, got %s", added.Reset, state.Reset)
+			}
+		}
+		if _, err := bucket.Add(2); err != nil {
+			t.Fatal(err)
+		}
+		if state, err := bucket.Add(0); err != nil {
+			t.Fatalf("expected adding nothing to a full bucket to succeed, received %v", err)
+		} else if state.Remaining != 0 {
+			t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+		}
+	}
+}
+
+// AddOverCapacityTest returns a test that adding more than a bucket's capacity is reported as
+// ErrorOverCapacity rather than ErrorFull, even on a fresh bucket.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AddOverCapacityTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(11); err != ErrorOverCapacity {
+			t.Fatalf("expected ErrorOverCapacity, received %v", err)
+		}
+		if remaining := bucket.Remaining(); remaining != 10 {
+			t.Fatalf("expected %d remaining, got %d", 10, remaining)
+		}
+		if _, ok, err := bucket.TryAdd(11); ok || err != ErrorOverCapacity {
+			t.Fatalf("expected ErrorOverCapacity from TryAdd, received %v", err)
+		}
+		if _, err := bucket.Add(10); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// AllowTest returns a test that Allow adds 1 to a bucket until it is full.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AllowTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		for i, expected := range []struct {
+			allowed   bool
+			remaining uint
+		}{{true, 1}, {true, 0}, {false, 0}} {
+			allowed, state, err := Allow(s, "testbucket", 2, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if allowed != expected.allowed || state.Remaining != expected.remaining {
+				t.Fatalf("request %d: expected allowed %v with %d remaining, got %v with %d",
+					i, expected.allowed, expected.remaining, allowed, state.Remaining)
+			}
+		}
+	}
+}
+
+// AddDetailedTest returns a test that AddDetailed reports the remaining space before each add.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AddDetailedTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			amount, before, after uint
+			err                   error
+		}{{2, 5, 3, nil}, {3, 3, 0, nil}, {1, 0, 0, ErrorFull}} {
+			before, state, err := AddDetailed(bucket, test.amount)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("adding %d: expected error %v, got %v", test.amount, test.err, err)
+			}
+			if before != test.before || state.Remaining != test.after {
+				t.Fatalf("adding %d: expected %d remaining before and %d after, got %d and %d",
+					test.amount, test.before, test.after, before, state.Remaining)
+			}
+		}
+	}
+}
+
+// TryAddTest returns a test that TryAdd reports a full bucket without an error.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func TryAddTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, ok, err := bucket.TryAdd(2); err != nil {
+			t.Fatal(err)
+		} else if !ok {
+			t.Fatal("expected add to fit")
+		} else if state.Remaining != 0 {
+			t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+		}
+		if state, ok, err := bucket.TryAdd(1); err != nil {
+			t.Fatalf("expected no error from a full bucket, received %v", err)
+		} else if ok {
+			t.Fatal("expected add not to fit")
+		} else if state.Remaining != 0 {
+			t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+		}
+	}
+}
+
+// FullErrorTest returns a test that a full bucket's error carries the state it was refused
+// against, recoverable with errors.As even once wrapped.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func FullErrorTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(2); err != nil {
+			t.Fatal(err)
+		}
+		state, err := bucket.Add(1)
+		if !errors.Is(err, ErrorFull) {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		}
+		var full *FullError
+		if !errors.As(fmt.Errorf("limiting: %w", err), &full) {
+			t.Fatalf("expected a *FullError, received %#v", err)
+		}
+		if full.Capacity != 2 || full.Remaining != state.Remaining || !full.Reset.Equal(state.Reset) {
+			t.Fatalf("expected the error to carry the state %+v, got %+v", state, full.BucketState)
+		}
+		if !full.Reset.After(time.Now()) {
+			t.Fatalf("expected a reset in the future, got %s", full.Reset)
+		}
+	}
+}
+
+// AddWithCapacityTest returns a test that AddWithCapacity judges an add against the capacity it
+// is given, leaving the bucket's own unchanged. The storage's buckets must be CapacityAdders.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AddWithCapacityTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		created, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket, ok := created.(CapacityAdder)
+		if !ok {
+			t.Fatalf("expected a CapacityAdder, got %T", created)
+		}
+		if _, err := bucket.Add(4); err != nil {
+			t.Fatal(err)
+		}
+		for i, test := range []struct {
+			amount, tempCapacity, remaining uint
+			err                             error
+		}{
+			{3, 8, 0, nil},
+			{9, 8, 0, ErrorOverCapacity},
+			{4, 8, 0, ErrorFull},
+			{3, 8, 0, nil},
+			{1, 5, 0, ErrorFull},
+		} {
+			state, err := bucket.AddWithCapacity(test.amount, test.tempCapacity)
+			if !errors.Is(err, test.err) {
+				t.Fatalf("add %d: expected error %v, got %v", i, test.err, err)
+			}
+			if state.Remaining != test.remaining || state.Capacity != 5 {
+				t.Fatalf("add %d: expected %d of %d remaining, got %d of %d", i, test.remaining, 5,
+					state.Remaining, state.Capacity)
+			}
+		}
+		if bucket.Capacity() != 5 {
+			t.Fatalf("expected the capacity to stay %d, got %d", 5, bucket.Capacity())
+		}
+		if _, err := bucket.Add(1); !errors.Is(err, ErrorFull) {
 			t.Fatalf("expected ErrorFull, received %v", err)
 		}
+
+		// Below the bucket's capacity, the remaining space isn't enough.
+		created, err = s.Create("lowered", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		bucket = created.(CapacityAdder)
+		if _, err := bucket.Add(2); err != nil {
+			t.Fatal(err)
+		}
+		if state, err := bucket.AddWithCapacity(2, 3); !errors.Is(err, ErrorFull) {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		} else if state.Remaining != 3 {
+			t.Fatalf("expected %d remaining, got %d", 3, state.Remaining)
+		}
+		if state, err := bucket.AddWithCapacity(1, 3); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 2 {
+			t.Fatalf("expected %d remaining, got %d", 2, state.Remaining)
+		}
+
+		// Adding nothing is a read, even with a temporary capacity below what has been consumed.
+		if state, err := bucket.AddWithCapacity(0, 2); err != nil {
+			t.Fatalf("expected adding nothing to succeed, received %v", err)
+		} else if state.Remaining != 2 {
+			t.Fatalf("expected %d remaining, got %d", 2, state.Remaining)
+		}
+	}
+}
+
+// AddMultiTest returns a test that AddMulti adds to each requested bucket independently.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AddMultiTest(s MultiAdder) func(*testing.T) {
+	return func(t *testing.T) {
+		requests := []Request{
+			{Name: "testbucket1", Capacity: 10, Rate: time.Minute, Amount: 3},
+			{Name: "testbucket2", Capacity: 2, Rate: time.Minute, Amount: 2},
+			{Name: "testbucket1", Capacity: 10, Rate: time.Minute, Amount: 4},
+			{Name: "testbucket2", Capacity: 2, Rate: time.Minute, Amount: 1},
+		}
+		states, errs := s.AddMulti(requests)
+		if len(states) != len(requests) || len(errs) != len(requests) {
+			t.Fatalf("expected %d results, got %d states and %d errors", len(requests), len(states), len(errs))
+		}
+		for i, expected := range []struct {
+			remaining uint
+			err       error
+		}{{7, nil}, {0, nil}, {3, nil}, {0, ErrorFull}} {
+			if !errors.Is(errs[i], expected.err) {
+				t.Fatalf("request %d: expected error %v, received %v", i, expected.err, errs[i])
+			}
+			if states[i].Remaining != expected.remaining {
+				t.Fatalf("request %d: expected %d remaining, got %d", i, expected.remaining, states[i].Remaining)
+			}
+		}
+	}
+}
+
+// TakeUpToTest returns a test that TakeUpTo adds as much as fits, down to nothing.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func TakeUpToTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			amount, granted, remaining uint
+		}{
+			{3, 3, 2},
+			{4, 2, 0},
+			{1, 0, 0},
+			{0, 0, 0},
+		} {
+			granted, state, err := bucket.TakeUpTo(test.amount)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if granted != test.granted {
+				t.Fatalf("taking up to %d: expected %d granted, got %d", test.amount, test.granted, granted)
+			}
+			if state.Remaining != test.remaining {
+				t.Fatalf("taking up to %d: expected %d remaining, got %d", test.amount, test.remaining, state.Remaining)
+			}
+		}
 	}
 }
 
@@ -77,17 +423,450 @@ func AddResetTest(s Storage) func(*testing.T) {
 			t.Fatal(err)
 		} else if state.Remaining != 0 {
 			t.Fatalf("expected full bucket, got %d", state.Remaining)
-		} else if state.Reset.Unix() < time.Now().Unix() {
+		} else if !state.Reset.After(time.Now()) {
 			t.Fatalf("reset time is in the past")
 		}
 	}
 }
 
+// ShortRateTest returns a test that a bucket whose rate is under a second reports its reset
+// with sub-second precision, stays full until then and is drained right after.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func ShortRateTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		rate := 400 * time.Millisecond
+		bucket, err := s.Create("testbucket", 1, rate)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := bucket.Add(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		now := time.Now()
+		if !state.Reset.After(now) || state.Reset.After(now.Add(rate)) {
+			t.Fatalf("expected a reset within %s from now, got %s", rate, state.Reset.Sub(now))
+		}
+		if _, err := bucket.Add(1); !errors.Is(err, ErrorFull) {
+			t.Fatalf("expected ErrorFull before the reset, received %v", err)
+		}
+		if peeked, err := bucket.Peek(); err != nil {
+			t.Fatal(err)
+		} else if !peeked.Reset.After(time.Now()) {
+			t.Fatalf("expected the reset %s from now to be in the future", peeked.Reset.Sub(time.Now()))
+		} else if peeked.Remaining != 0 {
+			t.Fatalf("expected %d remaining, got %d", 0, peeked.Remaining)
+		}
+
+		time.Sleep(state.Reset.Sub(time.Now()) + 50*time.Millisecond)
+		if state, err := bucket.Add(1); err != nil {
+			t.Fatalf("expected the bucket to be drained after its reset, received %v", err)
+		} else if !state.Reset.After(time.Now()) {
+			t.Fatalf("expected a new reset in the future, got %s ago", time.Since(state.Reset))
+		}
+	}
+}
+
+// AddContextTest returns a test that AddContext adds like Add and refuses a done context.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AddContextTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, err := bucket.AddContext(context.Background(), 3); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 7 {
+			t.Fatalf("expected %d remaining, got %d", 7, state.Remaining)
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := bucket.AddContext(ctx, 1); err == nil {
+			t.Fatal("expected an error from a canceled context")
+		}
+		if remaining := bucket.Remaining(); remaining != 7 {
+			t.Fatalf("expected canceled add to leave %d remaining, got %d", 7, remaining)
+		}
+	}
+}
+
+// AddWithTimeTest returns a test that AddWithTime starts its window at the supplied time.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AddWithTimeTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := time.Now().Add(-30 * time.Second)
+		state, err := bucket.AddWithTime(1, at)
+		if err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 9 {
+			t.Fatalf("expected %d remaining, got %d", 9, state.Remaining)
+		}
+		e := float64(1 * time.Second) // margin of error
+		if error := float64(state.Reset.Sub(at.Add(time.Minute))); math.Abs(error) > e {
+			t.Fatalf("expected reset time close to %s, got %s", at.Add(time.Minute), state.Reset)
+		}
+	}
+}
+
+// PeekTest returns a test that Peek reports the bucket's state without consuming from it.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func PeekTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, err := bucket.Peek(); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 10 {
+			t.Fatalf("expected %d remaining, got %d", 10, state.Remaining)
+		}
+		added, err := bucket.Add(4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Peeking through another instance sees the first instance's add.
+		other, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if state, err := other.Peek(); err != nil {
+				t.Fatal(err)
+			} else if state.Remaining != 6 {
+				t.Fatalf("expected %d remaining, got %d", 6, state.Remaining)
+			} else if !sameReset(state.Reset, added.Reset) {
+				t.Fatalf("expected reset %s, got %s", added.Reset, state.Reset)
+			}
+		}
+	}
+}
+
+// SetRemainingTest returns a test that SetRemaining credits a bucket, up to its capacity,
+// without moving its reset time.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func SetRemainingTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added, err := bucket.Add(8)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := bucket.SetRemaining(5); err != nil {
+			t.Fatal(err)
+		}
+		if remaining := bucket.Remaining(); remaining != 5 {
+			t.Fatalf("expected %d remaining, got %d", 5, remaining)
+		}
+		if reset := bucket.Reset(); !sameReset(reset, added.Reset) {
+			t.Fatalf("expected reset %s to be kept, got %s", added.Reset, reset)
+		}
+		if _, err := bucket.Add(5); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(1); !errors.Is(err, ErrorFull) {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		}
+
+		if err := bucket.SetRemaining(100); err != nil {
+			t.Fatal(err)
+		}
+		other, err := s.Create("testbucket", 10, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, err := other.Peek(); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 10 {
+			t.Fatalf("expected remaining clamped to %d, got %d", 10, state.Remaining)
+		}
+	}
+}
+
+// DrainTest returns a test that draining a bucket restores its full capacity.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func DrainTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(5); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(1); !errors.Is(err, ErrorFull) {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		}
+		if err := bucket.Drain(); err != nil {
+			t.Fatal(err)
+		}
+		if remaining := bucket.Remaining(); remaining != 5 {
+			t.Fatalf("expected %d remaining after drain, got %d", 5, remaining)
+		}
+		if state, err := bucket.Add(1); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 4 {
+			t.Fatalf("expected %d remaining, got %d", 4, state.Remaining)
+		}
+
+		// A bucket created after the drain must see the drained state too.
+		other, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.Add(4); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// RefundTest returns a test that Refund gives back space, up to the capacity, without moving
+// the reset time.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func RefundTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		added, err := bucket.Add(3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state, err := bucket.Refund(1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state.Remaining != 3 {
+			t.Fatalf("expected %d remaining, got %d", 3, state.Remaining)
+		}
+		if diff := state.Reset.Sub(added.Reset); diff > time.Second || diff < -time.Second {
+			t.Fatalf("expected reset to stay at %s, got %s", added.Reset, state.Reset)
+		}
+		if state, err := bucket.Refund(10); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 5 {
+			t.Fatalf("expected %d remaining, got %d", 5, state.Remaining)
+		}
+
+		other, err := s.Create("otherbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if state, err := other.Refund(2); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 5 {
+			t.Fatalf("expected %d remaining, got %d", 5, state.Remaining)
+		}
+	}
+}
+
+// AddHierarchicalTest returns a test that AddHierarchical consumes from a parent and a child
+// bucket together, and from neither when either is full.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func AddHierarchicalTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		parent, err := s.Create("global", 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		a, err := s.Create("user:a", 2, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := s.Create("user:b", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, test := range []struct {
+			child                           Bucket
+			amount                          uint
+			err                             error
+			parentRemaining, childRemaining uint
+		}{
+			{a, 2, nil, 1, 0},
+			{a, 1, ErrorFull, 1, 0},
+			{b, 2, ErrorFull, 1, 5},
+			{b, 1, nil, 0, 4},
+		} {
+			if _, _, err := AddHierarchical(parent, test.child, test.amount); !errors.Is(err, test.err) {
+				t.Fatalf("add %d: expected error %v, got %v", i, test.err, err)
+			}
+			parentState, err := parent.Peek()
+			if err != nil {
+				t.Fatal(err)
+			}
+			childState, err := test.child.Peek()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if parentState.Remaining != test.parentRemaining || childState.Remaining != test.childRemaining {
+				t.Fatalf("add %d: expected %d remaining in the parent and %d in the child, got %d and %d",
+					i, test.parentRemaining, test.childRemaining, parentState.Remaining, childState.Remaining)
+			}
+		}
+	}
+}
+
+// WouldAcceptTest returns a test that WouldAccept reports whether an add would fit without
+// adding it.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func WouldAcceptTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(3); err != nil {
+			t.Fatal(err)
+		}
+		for _, test := range []struct {
+			amount   uint
+			expected bool
+		}{{2, true}, {3, false}, {6, false}, {0, true}} {
+			if accepted, err := bucket.WouldAccept(test.amount); err != nil {
+				t.Fatal(err)
+			} else if accepted != test.expected {
+				t.Fatalf("expected WouldAccept(%d) to be %v, got %v", test.amount, test.expected, accepted)
+			}
+		}
+		if state, err := bucket.Peek(); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 2 {
+			t.Fatalf("expected %d remaining, got %d", 2, state.Remaining)
+		}
+	}
+}
+
+// HooksTest returns a test that adds call the hooks matching their outcome, and that TakeUpTo
+// doesn't call them.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func HooksTest(s HookedStorage) func(*testing.T) {
+	return func(t *testing.T) {
+		var allowed, rejected []uint
+		var exhausted []string
+		s.SetHooks(Hooks{
+			OnAllow: func(name string, state BucketState) {
+				allowed = append(allowed, state.Remaining)
+			},
+			OnReject: func(name string, state BucketState) {
+				rejected = append(rejected, state.Remaining)
+			},
+			OnError: func(name string, state BucketState, err error) {
+				t.Errorf("expected no error adding to %s, got %v", name, err)
+			},
+			OnExhausted: func(name string, state BucketState) {
+				exhausted = append(exhausted, name)
+			},
+		})
+		defer s.SetHooks(Hooks{})
+
+		bucket, err := s.Create("testbucket", 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(2); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(2); !errors.Is(err, ErrorFull) {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		}
+		if _, err := bucket.AddContext(context.Background(), 4); err != ErrorOverCapacity {
+			t.Fatalf("expected ErrorOverCapacity, received %v", err)
+		}
+		if _, _, err := bucket.TryAdd(1); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, err := bucket.TakeUpTo(1); err != nil {
+			t.Fatal(err)
+		}
+		if fmt.Sprint(allowed) != "[1 0]" {
+			t.Fatalf("expected OnAllow with 1 then 0 remaining, got %v", allowed)
+		}
+		if fmt.Sprint(rejected) != "[1 1]" {
+			t.Fatalf("expected OnReject twice with 1 remaining, got %v", rejected)
+		}
+		if _, err := bucket.Add(1); !errors.Is(err, ErrorFull) {
+			t.Fatalf("expected ErrorFull, received %v", err)
+		}
+		if fmt.Sprint(exhausted) != "[testbucket]" {
+			t.Fatalf("expected OnExhausted once for testbucket, got %v", exhausted)
+		}
+
+		// Hooks are set at creation, so other buckets of the storage call them too.
+		other, err := s.Create("otherbucket", 3, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := other.AddWithTime(1, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+		if len(allowed) != 3 {
+			t.Fatalf("expected OnAllow for the add to another bucket, got %v", allowed)
+		}
+	}
+}
+
+// RemoveTest returns a test that a removed bucket is created again at full capacity.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func RemoveTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		bucket, err := s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := bucket.Add(5); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Remove("testbucket"); err != nil {
+			t.Fatal(err)
+		}
+		// Removing a bucket that doesn't exist is not an error.
+		if err := s.Remove("testbucket"); err != nil {
+			t.Fatal(err)
+		}
+		bucket, err = s.Create("testbucket", 5, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if remaining := bucket.Remaining(); remaining != 5 {
+			t.Fatalf("expected %d remaining, got %d", 5, remaining)
+		}
+		if state, err := bucket.Add(5); err != nil {
+			t.Fatal(err)
+		} else if state.Remaining != 0 {
+			t.Fatalf("expected %d remaining, got %d", 0, state.Remaining)
+		}
+	}
+}
+
+// resetTolerance is how far apart two reset times of the same window may be and still match.
+// Backends that read the window's end as a TTL relative to the time of the read differ by the
+// time between reads, plus their rounding of the TTL.
+const resetTolerance = 100 * time.Millisecond
+
+// sameReset reports whether reset times a and b are of the same window, to well below a second
+// so that sub-second windows are told apart.
+func sameReset(a, b time.Time) bool {
+	d := a.Sub(b)
+	return d < resetTolerance && d > -resetTolerance
+}
+
 func compareBucketTimes(a, b Bucket) error {
-	if a.Reset().Unix() == b.Reset().Unix() {
+	if sameReset(a.Reset(), b.Reset()) {
 		return nil
 	}
-	return errors.New(fmt.Sprintf("first has %#v reset, second has %#v reset", a.Reset().Unix(), b.Reset().Unix()))
+	return errors.New(fmt.Sprintf("first has %s reset, second has %s reset", a.Reset(), b.Reset()))
 }
 func compareBuckets(a, b Bucket) error {
 	if a.Remaining() != b.Remaining() {
@@ -96,6 +875,58 @@ func compareBuckets(a, b Bucket) error {
 	return compareBucketTimes(a, b)
 }
 
+// RemovePrefixTest returns a test that RemovePrefix removes exactly the buckets whose names
+// start with the prefix, and counts them.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func RemovePrefixTest(s PrefixRemover) func(*testing.T) {
+	return func(t *testing.T) {
+		names := []string{"api:testbucket1", "api:testbucket2", "web:testbucket1", "a*c", "abc"}
+		for _, name := range names {
+			bucket, err := s.Create(name, 5, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := bucket.Add(5); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for _, test := range []struct {
+			prefix  string
+			removed int
+		}{
+			{"api:", 2},
+			{"api:", 0},
+			// The prefix is matched literally, not as a pattern.
+			{"a*", 1},
+		} {
+			if removed, err := s.RemovePrefix(test.prefix); err != nil {
+				t.Fatal(err)
+			} else if removed != test.removed {
+				t.Fatalf("prefix %q: expected %d removed, got %d", test.prefix, test.removed, removed)
+			}
+		}
+
+		for _, name := range names {
+			bucket, err := s.Create(name, 5, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			state, err := bucket.Peek()
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := uint(5)
+			if name == "web:testbucket1" || name == "abc" {
+				expected = 0
+			}
+			if state.Remaining != expected {
+				t.Fatalf("%s: expected %d remaining, got %d", name, expected, state.Remaining)
+			}
+		}
+	}
+}
+
 // FindOrCreateTest returns a test that the Create function is essentially a FindOrCreate: if you
 // create one bucket, wait some time, and create another bucket with the same name, all the
 // properties should be the same.
@@ -140,18 +971,18 @@ func ThreadSafeAddTest(s Storage) func(*testing.T) {
 		}
 		remaining := map[uint]bool{}     // record observed "remaining" counts. (ab)using map as set here
 		remainingMutex := sync.RWMutex{} // maps are not threadsafe
-		errors := []error{}              // record observed errors
+		errs := []error{}                // record observed errors, also guarded by remainingMutex
 		var wg sync.WaitGroup
 		for i := 0; i < n+1; i++ {
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
 				state, err := bucket.Add(1)
+				remainingMutex.Lock()
+				defer remainingMutex.Unlock()
 				if err != nil {
-					errors = append(errors, err)
+					errs = append(errs, err)
 				} else {
-					remainingMutex.Lock()
-					defer remainingMutex.Unlock()
 					remaining[state.Remaining] = true
 				}
 			}()
@@ -165,8 +996,76 @@ func ThreadSafeAddTest(s Storage) func(*testing.T) {
 			t.Fatalf("Did not observe correct bucket states. Saw %d distinct remaining values instead of %d: %v",
 				len(remaining), n, keys)
 		}
-		if !(len(errors) == 1 && errors[0] == ErrorFull) {
-			t.Fatalf("Did not observe one full error: %#v", errors)
+		if !(len(errs) == 1 && errors.Is(errs[0], ErrorFull)) {
+			t.Fatalf("Did not observe one full error: %#v", errs)
+		}
+	}
+}
+
+// ConcurrentCapacityTest returns a test that concurrent adds to a bucket never grant more than its
+// capacity, nor less while any of it is left. Each goroutine adds through its own instance of
+// the bucket, as separate clients of a shared backend would, so that a check of the remaining
+// space done apart from the add shows up as grants past the capacity.
+// It is meant to be used by leakybucket implementers who wish to test this.
+func ConcurrentCapacityTest(s Storage) func(*testing.T) {
+	return func(t *testing.T) {
+		for i, test := range []struct {
+			capacity, amount uint
+			workers, adds    int
+		}{
+			{capacity: 10, amount: 1, workers: 50, adds: 1},
+			{capacity: 100, amount: 1, workers: 20, adds: 10},
+			{capacity: 30, amount: 3, workers: 25, adds: 2},
+			{capacity: 1, amount: 1, workers: 10, adds: 3},
+		} {
+			name := fmt.Sprintf("concurrentbucket%d", i)
+			var (
+				mutex   sync.Mutex
+				granted uint
+				errs    []error
+				wg      sync.WaitGroup
+			)
+			for w := 0; w < test.workers; w++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					bucket, err := s.Create(name, test.capacity, time.Minute)
+					if err != nil {
+						mutex.Lock()
+						errs = append(errs, err)
+						mutex.Unlock()
+						return
+					}
+					for a := 0; a < test.adds; a++ {
+						_, err := bucket.Add(test.amount)
+						mutex.Lock()
+						if err == nil {
+							granted += test.amount
+						} else if !errors.Is(err, ErrorFull) {
+							errs = append(errs, err)
+						}
+						mutex.Unlock()
+					}
+				}()
+			}
+			wg.Wait()
+			if len(errs) > 0 {
+				t.Fatalf("%d workers adding %d to %s: expected only ErrorFull, received %v", test.workers,
+					test.amount, name, errs)
+			}
+			if granted != test.capacity {
+				t.Fatalf("%d workers adding %d %d times to %s: expected %d granted, got %d", test.workers,
+					test.amount, test.adds, name, test.capacity, granted)
+			}
+			bucket, err := s.Create(name, test.capacity, time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if state, err := bucket.Peek(); err != nil {
+				t.Fatal(err)
+			} else if state.Remaining != 0 {
+				t.Fatalf("%s: expected %d remaining, got %d", name, 0, state.Remaining)
+			}
 		}
 	}
 }
@@ -194,7 +1093,7 @@ func BucketInstanceConsistencyTest(s Storage) func(*testing.T) {
 		if err == nil {
 			t.Fatal("expected an error")
 		}
-		if err != ErrorFull {
+		if !errors.Is(err, ErrorFull) {
 			t.Fatalf("expected ErrorFull, received %#v", err)
 		}
 		time.Sleep(time.Second * 2)